@@ -0,0 +1,287 @@
+// offline analysis of an entire graph
+package analytics
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// In memory copy of every vertex and edge in the storage backend
+type Graph struct {
+	Vertices map[string]blend.Vertex
+	Edges    []blend.Edge
+}
+
+// Reads the whole graph from the storage backend, which needs to
+// support scanning
+func Load() (*Graph, error) {
+	g := &Graph{Vertices: map[string]blend.Vertex{}}
+
+	err := db.ScanVertices(func(v blend.Vertex) error {
+		g.Vertices[v.Id] = v
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.ScanEdges(func(e blend.Edge) error {
+		g.Edges = append(g.Edges, e)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Number of vertices having a given in and out degree, counting
+// only the edges of a single family and type
+type DegreeDistribution struct {
+	Family string      `json:"edge_family"`
+	Type   string      `json:"edge_type"`
+	Out    map[int]int `json:"out_degree"`
+	In     map[int]int `json:"in_degree"`
+}
+
+type Report struct {
+	Vertices int `json:"vertices"`
+	Edges    int `json:"edges"`
+
+	// edges with either end pointing to a vertex that does not exist
+	DanglingEdges int `json:"dangling_edges"`
+
+	Degrees []DegreeDistribution `json:"degrees"`
+
+	// sizes of the weakly connected components, largest first
+	Components []int `json:"components"`
+
+	// vertices without an incoming ownership edge
+	Orphans []string `json:"orphans"`
+
+	PageRank map[string]float64 `json:"pagerank"`
+}
+
+// true if both ends of the edge are present in the graph
+func (g *Graph) connected(e blend.Edge) bool {
+	_, from := g.Vertices[e.From]
+	_, to := g.Vertices[e.To]
+
+	return from && to
+}
+
+func (g *Graph) degrees() []DegreeDistribution {
+	type key struct{ family, typ string }
+
+	out := map[key]map[string]int{}
+	in := map[key]map[string]int{}
+
+	for _, e := range g.Edges {
+		if !g.connected(e) {
+			continue
+		}
+
+		k := key{e.Family, e.Type}
+		if out[k] == nil {
+			out[k] = map[string]int{}
+			in[k] = map[string]int{}
+		}
+
+		out[k][e.From]++
+		in[k][e.To]++
+	}
+
+	dists := []DegreeDistribution{}
+	for k := range out {
+		dist := DegreeDistribution{
+			Family: k.family,
+			Type:   k.typ,
+			Out:    map[int]int{},
+			In:     map[int]int{},
+		}
+
+		// vertices without any edge of this kind have degree zero
+		for id := range g.Vertices {
+			dist.Out[out[k][id]]++
+			dist.In[in[k][id]]++
+		}
+
+		dists = append(dists, dist)
+	}
+
+	sort.Slice(dists, func(i, j int) bool {
+		if dists[i].Family != dists[j].Family {
+			return dists[i].Family < dists[j].Family
+		}
+
+		return dists[i].Type < dists[j].Type
+	})
+
+	return dists
+}
+
+// sizes of the weakly connected components using union find
+func (g *Graph) components() []int {
+	parent := map[string]string{}
+	for id := range g.Vertices {
+		parent[id] = id
+	}
+
+	var find func(string) string
+	find = func(id string) string {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+
+		return parent[id]
+	}
+
+	for _, e := range g.Edges {
+		if g.connected(e) {
+			parent[find(e.From)] = find(e.To)
+		}
+	}
+
+	sizes := map[string]int{}
+	for id := range g.Vertices {
+		sizes[find(id)]++
+	}
+
+	components := []int{}
+	for _, size := range sizes {
+		components = append(components, size)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(components)))
+
+	return components
+}
+
+func (g *Graph) orphans() []string {
+	owned := map[string]bool{}
+	for _, e := range g.Edges {
+		if e.Family == "ownership" && g.connected(e) {
+			owned[e.To] = true
+		}
+	}
+
+	orphans := []string{}
+	for id := range g.Vertices {
+		if !owned[id] {
+			orphans = append(orphans, id)
+		}
+	}
+
+	sort.Strings(orphans)
+
+	return orphans
+}
+
+func (g *Graph) pageRank() map[string]float64 {
+	adj := map[string][]string{}
+	restart := map[string]float64{}
+
+	for id := range g.Vertices {
+		restart[id] = 1 / float64(len(g.Vertices))
+	}
+
+	for _, e := range g.Edges {
+		if g.connected(e) {
+			adj[e.From] = append(adj[e.From], e.To)
+		}
+	}
+
+	return PageRank(adj, restart)
+}
+
+func (g *Graph) Analyze() Report {
+	report := Report{
+		Vertices:   len(g.Vertices),
+		Edges:      len(g.Edges),
+		Degrees:    g.degrees(),
+		Components: g.components(),
+		Orphans:    g.orphans(),
+		PageRank:   g.pageRank(),
+	}
+
+	for _, e := range g.Edges {
+		if !g.connected(e) {
+			report.DanglingEdges++
+		}
+	}
+
+	return report
+}
+
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
+
+// Writes the report as metric,key,value rows
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	rows := [][]string{
+		{"metric", "key", "value"},
+		{"vertices", "", strconv.Itoa(r.Vertices)},
+		{"edges", "", strconv.Itoa(r.Edges)},
+		{"dangling_edges", "", strconv.Itoa(r.DanglingEdges)},
+	}
+
+	for _, dist := range r.Degrees {
+		for _, d := range []struct {
+			name   string
+			counts map[int]int
+		}{{"out_degree", dist.Out}, {"in_degree", dist.In}} {
+			degrees := []int{}
+			for degree := range d.counts {
+				degrees = append(degrees, degree)
+			}
+
+			sort.Ints(degrees)
+
+			metric := fmt.Sprintf("%s:%s:%s", d.name, dist.Family, dist.Type)
+			for _, degree := range degrees {
+				rows = append(rows, []string{
+					metric, strconv.Itoa(degree), strconv.Itoa(d.counts[degree]),
+				})
+			}
+		}
+	}
+
+	for i, size := range r.Components {
+		rows = append(rows, []string{"component", strconv.Itoa(i), strconv.Itoa(size)})
+	}
+
+	for _, id := range r.Orphans {
+		rows = append(rows, []string{"orphan", id, ""})
+	}
+
+	ids := []string{}
+	for id := range r.PageRank {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return r.PageRank[ids[i]] > r.PageRank[ids[j]] })
+
+	for _, id := range ids {
+		rows = append(rows, []string{
+			"pagerank", id, strconv.FormatFloat(r.PageRank[id], 'g', -1, 64),
+		})
+	}
+
+	return cw.WriteAll(rows)
+}
@@ -0,0 +1,177 @@
+package analytics
+
+import (
+	"math"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// a owns b and c, which link to each other and c links to d. d links to a
+// vertex that does not exist and e is on its own.
+func testGraph() *Graph {
+	g := &Graph{Vertices: map[string]blend.Vertex{}}
+
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		g.Vertices[id] = blend.Vertex{Id: id, Name: id, Type: "test"}
+	}
+
+	for _, e := range [][4]string{
+		{"ownership", "child", "a", "b"},
+		{"ownership", "child", "a", "c"},
+		{"public", "link", "b", "c"},
+		{"public", "link", "c", "b"},
+		{"public", "link", "c", "d"},
+		{"public", "link", "d", "missing"},
+	} {
+		g.Edges = append(g.Edges, blend.Edge{Family: e[0], Type: e[1], Name: e[3], From: e[2], To: e[3]})
+	}
+
+	return g
+}
+
+func TestAnalyze(t *testing.T) {
+	report := testGraph().Analyze()
+
+	if report.Vertices != 5 || report.Edges != 6 || report.DanglingEdges != 1 {
+		t.Error("Got back different counts then expected", report.Vertices, report.Edges, report.DanglingEdges)
+		return
+	}
+
+	for _, test := range []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"degrees", report.Degrees, []DegreeDistribution{
+			{Family: "ownership", Type: "child", Out: map[int]int{0: 4, 2: 1}, In: map[int]int{0: 3, 1: 2}},
+			{Family: "public", Type: "link", Out: map[int]int{0: 3, 1: 1, 2: 1}, In: map[int]int{0: 2, 1: 3}},
+		}},
+		{"components", report.Components, []int{4, 1}},
+		{"orphans", report.Orphans, []string{"a", "d", "e"}},
+	} {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Error("Got back different "+test.name+" then expected", test.got, test.expected)
+			return
+		}
+	}
+
+	total := 0.0
+	for _, r := range report.PageRank {
+		total += r
+	}
+
+	if len(report.PageRank) != 5 || math.Abs(total-1) > 1e-9 {
+		t.Error("Got back a different pagerank then expected", report.PageRank)
+		return
+	}
+
+	// c gets all the rank b passes on while b shares the rank of c with d,
+	// a and e are linked from no vertex
+	for id, r := range report.PageRank {
+		if (id != "c" && r >= report.PageRank["c"]) || r < report.PageRank["e"] {
+			t.Error("Got back a different order of pagerank then expected", report.PageRank)
+			return
+		}
+	}
+
+	if report.PageRank["a"] != report.PageRank["e"] {
+		t.Error("Got back a different pagerank for unlinked vertices then expected", report.PageRank)
+	}
+}
+
+func TestPageRank(t *testing.T) {
+	uniform := func(ids ...string) map[string]float64 {
+		restart := map[string]float64{}
+		for _, id := range ids {
+			restart[id] = 1 / float64(len(ids))
+		}
+
+		return restart
+	}
+
+	for _, test := range []struct {
+		name     string
+		adj      map[string][]string
+		restart  map[string]float64
+		expected map[string]float64
+	}{
+		{
+			"cycle",
+			map[string][]string{"a": {"b"}, "b": {"a"}},
+			uniform("a", "b"),
+			map[string]float64{"a": 0.5, "b": 0.5},
+		},
+		{
+			"no edges",
+			map[string][]string{},
+			uniform("a", "b", "c", "d"),
+			map[string]float64{"a": 0.25, "b": 0.25, "c": 0.25, "d": 0.25},
+		},
+		{
+			"dangling vertex",
+			map[string][]string{"a": {"b"}},
+			uniform("a", "b"),
+			// rank of b gets redistributed to both
+			map[string]float64{"a": 1 / (2 + Damping), "b": (1 + Damping) / (2 + Damping)},
+		},
+	} {
+		rank := PageRank(test.adj, test.restart)
+
+		for id, expected := range test.expected {
+			if math.Abs(rank[id]-expected) > 1e-6 {
+				t.Error("Got back a different pagerank then expected", test.name, rank, test.expected)
+				return
+			}
+		}
+	}
+
+	// a personalized pagerank never reaches vertices not linked from the
+	// vertex it restarts at
+	rank := PageRank(map[string][]string{"a": {"b"}, "c": {"b"}}, map[string]float64{"a": 1})
+	if rank["c"] != 0 || rank["a"] <= rank["b"] {
+		t.Error("Got back a different personalized pagerank then expected", rank)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	err := db.Init(path.Join(t.TempDir(), "graph.db"), &db.BoltStorage{})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	defer db.Close()
+
+	parent := &blend.Vertex{Name: "parent", Type: "test"}
+	child := &blend.Vertex{Name: "child", Type: "test"}
+
+	err = db.CreateVertex(parent)
+	if err == nil {
+		err = db.CreateChildVertex(parent, child, blend.Edge{Type: "child", Name: "child"})
+	}
+
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	g, err := Load()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(g.Vertices) != 2 || len(g.Edges) != 1 || g.Edges[0].To != child.Id {
+		t.Error("Got back a different graph then expected", g)
+		return
+	}
+
+	report := g.Analyze()
+	if !reflect.DeepEqual(report.Orphans, []string{parent.Id}) || !reflect.DeepEqual(report.Components, []int{2}) {
+		t.Error("Got back a different report then expected", report)
+	}
+}
@@ -0,0 +1,58 @@
+package analytics
+
+import "time"
+
+const (
+	Damping    = 0.85
+	Iterations = 20
+)
+
+// Computes pagerank over an adjacency list by power iteration. Random
+// walks restart according to the restart distribution, a uniform one
+// gives the classic global pagerank while restarting at a single vertex
+// gives its personalized pagerank. Rank held by vertices without outgoing
+// edges is redistributed the same way as a restart.
+func PageRank(adj map[string][]string, restart map[string]float64) map[string]float64 {
+	return PageRankUntil(adj, restart, time.Time{})
+}
+
+// Same as PageRank, but stops iterating once the deadline passed, after at
+// least one iteration. A zero deadline never passes.
+func PageRankUntil(adj map[string][]string, restart map[string]float64, deadline time.Time) map[string]float64 {
+	rank := map[string]float64{}
+	for id, r := range restart {
+		rank[id] = r
+	}
+
+	for i := 0; i < Iterations; i++ {
+		if i > 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+
+		next := map[string]float64{}
+		dangling := 0.0
+
+		for id, r := range rank {
+			tos := adj[id]
+			if len(tos) == 0 {
+				dangling += r
+				continue
+			}
+
+			share := Damping * r / float64(len(tos))
+			for _, to := range tos {
+				next[to] += share
+			}
+
+			dangling += (1 - Damping) * r
+		}
+
+		for id, r := range restart {
+			next[id] += dangling * r
+		}
+
+		rank = next
+	}
+
+	return rank
+}
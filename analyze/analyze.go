@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ziahamza/blend/analytics"
+	"github.com/ziahamza/blend/db"
+)
+
+func main() {
+	backend := flag.String("backend", "local",
+		`Storage backend for the graph. Only backends that can scan the entire
+graph are supported, which currently is just local`)
+
+	uri := flag.String("uri", path.Join(os.TempDir(), "blend.db"),
+		`URI for the storage backend, see the server for details`)
+
+	format := flag.String("format", "json", "Output format for the report, either json or csv")
+	out := flag.String("out", "", "File to write the report to, defaults to stdout")
+
+	flag.Parse()
+
+	err := db.Open(*backend, *uri)
+	if err != nil {
+		log.Fatalf("Cannot connect to the storage backend on %s: %s\n", *uri, err.Error())
+	}
+
+	defer db.Close()
+
+	graph, err := analytics.Load()
+	if err != nil {
+		log.Fatal("Cannot read the graph: ", err)
+	}
+
+	report := graph.Analyze()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer file.Close()
+		w = file
+	}
+
+	switch *format {
+	case "json":
+		err = report.WriteJSON(w)
+	case "csv":
+		err = report.WriteCSV(w)
+	default:
+		err = fmt.Errorf("Unknown report format %s", *format)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
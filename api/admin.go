@@ -0,0 +1,38 @@
+package api
+
+import (
+	"crypto/subtle"
+
+	"github.com/ziahamza/blend"
+)
+
+// empty while the admin endpoints are disabled
+var adminToken string
+
+// Enables the endpoints reading or changing the whole graph, like backups,
+// the changelog, the trash and the events of every vertex, for requests
+// carrying the token in the blend.AdminTokenHeader. The token is kept out
+// of urls so it does not end up in access logs. The endpoints stay
+// disabled while the token is empty.
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+func isAdmin(token string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// response for requests to admin endpoints without the admin token
+func adminRequired(what string) blend.APIResponse {
+	if adminToken == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: what + " is disabled as the server has no admin token",
+		}
+	}
+
+	return blend.APIResponse{
+		Success: false,
+		Message: what + " requires the admin token in the " + blend.AdminTokenHeader + " header",
+	}
+}
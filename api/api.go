@@ -4,37 +4,89 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 
 	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+	"github.com/ziahamza/blend/events"
 )
 
-func HandleRequest(req blend.APIRequest) blend.APIResponse {
+// Handles a single rpc request, token is the admin token the rpc
+// connection was opened with and addr the address it came from
+func HandleRequest(req blend.APIRequest, token, addr string) blend.APIResponse {
 	switch req.Method {
 	case "/":
 		return GetInfo()
 
 	case "/vertex/get":
-		return GetVertex(req.Vertex)
-	case "vertex/getChild":
+		return GetVertex(req.Vertex, req.AsOf)
+	case "/vertex/getChild":
 		return GetChildVertex(req.Vertex, req.Edge)
 
 	case "/vertex/create":
 		return CreateVertex(req.Vertex)
 	case "/vertex/createChild":
 		return CreateChildVertex(req.Vertex, req.ChildVertex, req.Edge)
+	case "/vertex/update":
+		return UpdateVertex(req.Vertex)
+	case "/vertex/delete":
+		return DeleteVertex(req.Vertex, false, addr, req.Actor)
+	case "/vertex/move":
+		return MoveVertex(req.ChildVertex, req.Vertex, req.Target, req.Edge)
+	case "/vertex/clone":
+		return CloneVertex(req.Vertex, req.Target, req.Edge, db.CloneOptions{Private: req.CopyPrivate, PrivateKey: req.CopyKey})
+	case "/vertex/revisions":
+		return GetRevisions(req.Vertex)
+
+	case "/path/get":
+		return GetPath(req.Vertex.Id, req.Path, req.ChildVertex.PrivateKey)
+	case "/path/create":
+		return CreatePath(req.Vertex, req.Path, req.ChildVertex)
 
 	case "/edge/get":
-		return GetEdges(req.Vertex, req.Edge)
+		return GetEdges(req.Vertex, req.Edge, req.AsOf)
+	case "/edge/getIncoming":
+		return GetIncomingEdges(req.Vertex, req.Edge)
 	case "/edge/create":
 		return CreateEdge(req.Vertex, req.ChildVertex, req.Edge)
+
+	case "/trash/list":
+		return GetTrash(token)
+	case "/trash/restore":
+		return RestoreTrash(req.Vertex, token)
+	case "/trash/purge":
+		return PurgeTrash(req.Vertex, token)
+
+	case "/changes/get":
+		return GetChanges(token, req.Since, req.Limit)
 	default:
 		return blend.APIResponse{Success: false, Message: "Unknown request method"}
 	}
 }
 
+func GetCacheStats() blend.APIResponse {
+	stats, err := db.CacheStats()
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return blend.APIResponse{Success: true, Cache: &stats}
+}
+
+func GetSyncStatus() blend.APIResponse {
+	status, err := db.SyncStatus()
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return blend.APIResponse{Success: true, Sync: &status}
+}
+
 func GetInfo() blend.APIResponse {
 	return blend.APIResponse{
 		Success: true,
@@ -68,30 +120,63 @@ func Handler() http.Handler {
 	grouter.HandleFunc("/rpc", func(wr http.ResponseWriter, rq *http.Request) {
 		conn, err := upgrader.Upgrade(wr, rq, nil)
 		if err != nil {
-			fmt.Printf("Error with rpc: %s %v \n", err.Error())
+			fmt.Printf("Error with rpc: %s \n", err.Error())
 			return
 		}
 
+		defer conn.Close()
+
+		token := rq.Header.Get(blend.AdminTokenHeader)
+
+		// requests are handled concurrently, responses carry the request
+		// id so clients can match them up in any order
+		var writeLock sync.Mutex
+
+		// closed once the connection is gone to stop event streams
+		done := make(chan bool)
+		defer close(done)
+
 		for {
-			var (
-				req  blend.APIRequest
-				resp blend.APIResponse
-			)
-			err = conn.ReadJSON(&req)
+			var req blend.APIRequest
 
+			_, bd, err := conn.ReadMessage()
 			if err != nil {
-				resp = blend.APIResponse{
+				break
+			}
+
+			err = json.Unmarshal(bd, &req)
+			if err != nil {
+				resp := blend.APIResponse{
 					Success: false,
 					Message: "Error Parsing api request" + err.Error(),
 				}
-			} else {
-				resp = HandleRequest(req)
+
+				writeLock.Lock()
+				conn.WriteJSON(&resp)
+				writeLock.Unlock()
+
+				continue
 			}
 
-			err = conn.WriteJSON(&resp)
-			if err != nil {
-				break
+			if req.Method == "/events/listen" {
+				go StreamEvents(conn, &writeLock, req, token, done)
+				continue
 			}
+
+			if req.Method == "/changes/tail" {
+				go StreamChanges(conn, &writeLock, req, token, done)
+				continue
+			}
+
+			go func(req blend.APIRequest) {
+				resp := HandleRequest(req, token, rq.RemoteAddr)
+				resp.RequestId = req.RequestId
+
+				writeLock.Lock()
+				defer writeLock.Unlock()
+
+				conn.WriteJSON(&resp)
+			}(req)
 		}
 	})
 
@@ -115,7 +200,151 @@ func Handler() http.Handler {
 	grouter.HandleFunc("/vertex/{vertex_id}", func(wr http.ResponseWriter, rq *http.Request) {
 		vars := mux.Vars(rq)
 		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
-		SendResponse(wr, GetVertex(v))
+
+		asOf, err := parseAsOf(rq)
+		if err != nil {
+			SendResponse(wr, blend.APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		SendResponse(wr, GetVertex(v, asOf))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/move", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"]}
+		from := blend.Vertex{Id: rq.FormValue("from_id"), PrivateKey: rq.FormValue("from_private_key")}
+		to := blend.Vertex{Id: rq.FormValue("to_id"), PrivateKey: rq.FormValue("to_private_key")}
+		e := blend.Edge{Type: rq.FormValue("edge_type"), Name: rq.FormValue("edge_name")}
+		SendResponse(wr, MoveVertex(v, from, to, e))
+	}).Methods("POST")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/clone", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		parent := blend.Vertex{Id: rq.FormValue("parent_id")}
+		e := blend.Edge{Type: rq.FormValue("edge_type"), Name: rq.FormValue("edge_name")}
+		opts := db.CloneOptions{
+			Private:    rq.FormValue("copy_private") == "true",
+			PrivateKey: rq.FormValue("copy_private_key"),
+		}
+
+		SendResponse(wr, CloneVertex(v, parent, e, opts))
+	}).Methods("POST")
+
+	grouter.HandleFunc("/path/{vertex_id}/{path:.*}", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		SendResponse(wr, GetPath(vars["vertex_id"], vars["path"], rq.FormValue("private_key")))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/path/{vertex_id}/{path:.*}", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		root := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+
+		var v blend.Vertex
+		if vbd := rq.FormValue("vertex"); vbd != "" {
+			err := json.Unmarshal([]byte(vbd), &v)
+			if err != nil {
+				SendResponse(wr, blend.APIResponse{
+					Success: false,
+					Message: "Can't parse vertex:" + vbd,
+				})
+
+				return
+			}
+		}
+
+		SendResponse(wr, CreatePath(root, vars["path"], v))
+	}).Methods("POST")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/revisions", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		SendResponse(wr, GetRevisions(v))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/vertex/{vertex_id}", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		async := rq.FormValue("async") == "true"
+		SendResponse(wr, DeleteVertex(v, async, rq.RemoteAddr, rq.FormValue("actor")))
+	}).Methods("DELETE")
+
+	grouter.HandleFunc("/trash", func(wr http.ResponseWriter, rq *http.Request) {
+		SendResponse(wr, GetTrash(rq.Header.Get(blend.AdminTokenHeader)))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/trash/{vertex_id}/restore", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		SendResponse(wr, RestoreTrash(v, rq.Header.Get(blend.AdminTokenHeader)))
+	}).Methods("POST")
+
+	grouter.HandleFunc("/trash/{vertex_id}", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		SendResponse(wr, PurgeTrash(v, rq.Header.Get(blend.AdminTokenHeader)))
+	}).Methods("DELETE")
+
+	grouter.HandleFunc("/cache", func(wr http.ResponseWriter, rq *http.Request) {
+		SendResponse(wr, GetCacheStats())
+	}).Methods("GET")
+
+	grouter.HandleFunc("/sync", func(wr http.ResponseWriter, rq *http.Request) {
+		SendResponse(wr, GetSyncStatus())
+	}).Methods("GET")
+
+	grouter.HandleFunc("/changes", func(wr http.ResponseWriter, rq *http.Request) {
+		since, _ := strconv.ParseUint(rq.FormValue("since"), 10, 64)
+		limit, _ := strconv.Atoi(rq.FormValue("limit"))
+		SendResponse(wr, GetChanges(rq.Header.Get(blend.AdminTokenHeader), since, limit))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/backup", func(wr http.ResponseWriter, rq *http.Request) {
+		SendBackup(wr, rq.Header.Get(blend.AdminTokenHeader))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/vertex/{vertex_id}", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+
+		var v blend.Vertex
+		vbd := rq.FormValue("vertex")
+		err := json.Unmarshal([]byte(vbd), &v)
+		if err != nil {
+			SendResponse(wr, blend.APIResponse{
+				Success: false,
+				Message: "Can't parse vertex:" + vbd,
+			})
+
+			return
+		}
+
+		v.Id = vars["vertex_id"]
+		v.PrivateKey = rq.FormValue("private_key")
+
+		SendResponse(wr, UpdateVertex(v))
+	}).Methods("PUT")
+
+	grouter.HandleFunc("/mounts", func(wr http.ResponseWriter, rq *http.Request) {
+		SendResponse(wr, GetMounts())
+	}).Methods("GET")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/mount", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		m := blend.Mount{URL: rq.FormValue("url"), Root: rq.FormValue("root_id")}
+		SendResponse(wr, MountGraph(v, m))
+	}).Methods("POST")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/mount", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		v := blend.Vertex{Id: vars["vertex_id"], PrivateKey: rq.FormValue("private_key")}
+		SendResponse(wr, UnmountGraph(v))
+	}).Methods("DELETE")
+
+	grouter.HandleFunc("/job/{job_id}", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		SendResponse(wr, GetJob(vars["job_id"]))
 	}).Methods("GET")
 
 	grouter.HandleFunc("/vertex/{vertex_id}", func(wr http.ResponseWriter, rq *http.Request) {
@@ -198,7 +427,76 @@ func Handler() http.Handler {
 			}
 		*/
 
-		SendResponse(wr, GetEdges(vertex, edge))
+		asOf, err := parseAsOf(rq)
+		if err != nil {
+			SendResponse(wr, blend.APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		SendResponse(wr, GetEdges(vertex, edge, asOf))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/edges/incoming", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		edge := blend.Edge{
+			To:     vars["vertex_id"],
+			Family: rq.FormValue("edge_family"),
+			Type:   rq.FormValue("edge_type"),
+			Name:   rq.FormValue("edge_name"),
+		}
+
+		vertex := blend.Vertex{
+			Id:         vars["vertex_id"],
+			PrivateKey: rq.FormValue("private_key"),
+		}
+
+		SendResponse(wr, GetIncomingEdges(vertex, edge))
+	}).Methods("GET")
+
+	grouter.HandleFunc("/vertex/{vertex_id}/discover", func(wr http.ResponseWriter, rq *http.Request) {
+		vars := mux.Vars(rq)
+		vertex := blend.Vertex{Id: vars["vertex_id"]}
+
+		opts := DiscoverOptions{
+			Method:     rq.FormValue("method"),
+			VertexType: rq.FormValue("vertex_type"),
+		}
+
+		var err error
+		for param, value := range map[string]*int{
+			"depth":        &opts.Depth,
+			"limit":        &opts.Limit,
+			"max_vertices": &opts.MaxVertices,
+		} {
+			if rq.FormValue(param) == "" {
+				continue
+			}
+
+			*value, err = strconv.Atoi(rq.FormValue(param))
+			if err != nil || *value < 0 {
+				SendResponse(wr, blend.APIResponse{
+					Success: false,
+					Message: "Can't parse " + param + ":" + rq.FormValue(param),
+				})
+				return
+			}
+		}
+
+		// timeout is given in milliseconds
+		if tbd := rq.FormValue("timeout"); tbd != "" {
+			ms, err := strconv.Atoi(tbd)
+			if err != nil || ms < 0 {
+				SendResponse(wr, blend.APIResponse{
+					Success: false,
+					Message: "Can't parse timeout:" + tbd,
+				})
+				return
+			}
+
+			opts.Timeout = time.Duration(ms) * time.Millisecond
+		}
+
+		SendResponse(wr, Discover(vertex, opts))
 	}).Methods("GET")
 
 	// grouter.HandleFunc("/vertex/{vertex_id}/events", ListenVertexEvents).Methods("GET")
@@ -206,6 +504,57 @@ func Handler() http.Handler {
 	return router
 }
 
+// Streams the events of the requested vertex over an rpc connection until
+// done is closed, which requires its private key. Every vertex is listened
+// to if no id is given, which requires the admin token. Every event is sent
+// as a separate response tagged with the id of the listen request.
+func StreamEvents(conn *websocket.Conn, writeLock *sync.Mutex, req blend.APIRequest, token string, done chan bool) {
+	send := func(resp blend.APIResponse) error {
+		resp.RequestId = req.RequestId
+
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		return conn.WriteJSON(&resp)
+	}
+
+	id := req.Vertex.Id
+	if id == "" {
+		if !isAdmin(token) {
+			send(adminRequired("Listening to every vertex"))
+			return
+		}
+
+		id = events.AllVertices
+	} else if req.Vertex.PrivateKey == "" || !db.ConfirmVertexKey(id, req.Vertex.PrivateKey) {
+		send(blend.APIResponse{
+			Success: false,
+			Message: "Listening to a vertex requires its private key",
+		})
+
+		return
+	}
+
+	ch := events.Subscribe(id)
+	defer events.Unsubscribe(id, ch)
+
+	// acknowledge the subscription before the first event
+	if send(blend.APIResponse{Success: true}) != nil {
+		return
+	}
+
+	for {
+		select {
+		case event := <-ch:
+			if send(blend.APIResponse{Success: true, Event: &event}) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
 func SendResponse(wr http.ResponseWriter, resp blend.APIResponse) {
 	resp.Version = "0.0.1"
 
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// holds back the headers of the backup until its first bytes, so a backup
+// failing right away can still be answered with an error
+type backupWriter struct {
+	wr      http.ResponseWriter
+	format  string
+	started bool
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+
+		name := "blend-" + time.Now().UTC().Format("20060102T150405Z")
+		if w.format == db.SnapshotFormat {
+			w.wr.Header().Set("Content-Type", "application/octet-stream")
+			name += ".db"
+		} else {
+			w.wr.Header().Set("Content-Type", "application/x-ndjson")
+			name += ".jsonl"
+		}
+
+		w.wr.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.wr.Header().Set("X-Backup-Format", w.format)
+	}
+
+	return w.wr.Write(p)
+}
+
+// Streams a backup of the graph taken while it keeps serving requests,
+// which requires the admin token
+func SendBackup(wr http.ResponseWriter, token string) {
+	if !isAdmin(token) {
+		SendResponse(wr, adminRequired("Taking backups"))
+		return
+	}
+
+	w := &backupWriter{wr: wr, format: db.BackupFormat()}
+
+	err := db.Backup(w)
+	if err == nil {
+		return
+	}
+
+	if !w.started {
+		SendResponse(wr, blend.APIResponse{Success: false, Message: err.Error()})
+		return
+	}
+
+	// too late to tell the client, the backup ends early
+	fmt.Printf("Backup failed: %s \n", err.Error())
+}
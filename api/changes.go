@@ -0,0 +1,108 @@
+package api
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// changes returned at most by a single read of the changelog
+const maxChangesPerRead = 1000
+
+// Reads the changelog after the sequence number, which requires the admin
+// token
+func GetChanges(token string, since uint64, limit int) blend.APIResponse {
+	if !isAdmin(token) {
+		return adminRequired("Reading changes")
+	}
+
+	if limit <= 0 || limit > maxChangesPerRead {
+		limit = maxChangesPerRead
+	}
+
+	changes, err := db.Changes(since, limit)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return blend.APIResponse{Success: true, Changes: &changes}
+}
+
+// Sends the changes after req.Since followed by every new change as it
+// happens, until the connection is gone. A client falling too far behind
+// gets an error and resumes from the last change it received.
+func StreamChanges(conn *websocket.Conn, writeLock *sync.Mutex, req blend.APIRequest, token string, done chan bool) {
+	send := func(resp blend.APIResponse) error {
+		resp.RequestId = req.RequestId
+
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		return conn.WriteJSON(&resp)
+	}
+
+	if !isAdmin(token) {
+		send(adminRequired("Reading changes"))
+		return
+	}
+
+	// subscribe before reading what was logged already, so nothing
+	// falls in between
+	ch, err := db.SubscribeChanges()
+	if err != nil {
+		send(blend.APIResponse{Success: false, Message: err.Error()})
+		return
+	}
+
+	defer db.UnsubscribeChanges(ch)
+
+	last := req.Since
+	for {
+		changes, err := db.Changes(last, maxChangesPerRead)
+		if err != nil {
+			send(blend.APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		for i := range changes {
+			if send(blend.APIResponse{Success: true, Change: &changes[i]}) != nil {
+				return
+			}
+
+			last = changes[i].Seq
+		}
+
+		if len(changes) < maxChangesPerRead {
+			break
+		}
+	}
+
+	for {
+		select {
+		case change, ok := <-ch:
+			if !ok {
+				send(blend.APIResponse{
+					Success: false,
+					Message: "Fell behind the changelog, resume after the last change received",
+				})
+
+				return
+			}
+
+			if change.Seq <= last {
+				continue
+			}
+
+			if send(blend.APIResponse{Success: true, Change: &change}) != nil {
+				return
+			}
+
+			last = change.Seq
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// Copies the vertex and everything it owns below the parent vertex, which
+// requires the private key of the vertex. The copies keep the private data
+// and keys of the vertices only if asked to, otherwise they share the key
+// given in the options or generated, returned along with the copy.
+func CloneVertex(v, parent blend.Vertex, e blend.Edge, opts db.CloneOptions) blend.APIResponse {
+	if v.Id == "" || parent.Id == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Vertex and the parent of its copy have to be supplied",
+		}
+	}
+
+	if v.PrivateKey == "" || !db.ConfirmVertexKey(v.Id, v.PrivateKey) {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Copying a vertex requires its private key",
+		}
+	}
+
+	if e.Type == "" || e.Name == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Edge type and name for the copy have to be supplied",
+		}
+	}
+
+	clone, err := db.CloneVertexTree(v, parent, e, opts)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	fmt.Printf("Copied vertex %s to %s under %s \n", v.Id, clone.Id, parent.Id)
+
+	e.Family = "ownership"
+	e.From = parent.Id
+	e.To = clone.Id
+
+	return blend.APIResponse{Success: true, Vertex: &clone, Edge: &e}
+}
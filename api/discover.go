@@ -0,0 +1,268 @@
+package api
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/analytics"
+	"github.com/ziahamza/blend/db"
+)
+
+// Options for a discovery query. Zero values are replaced with sane
+// defaults, so only the fields that matter to the caller need to be set.
+type DiscoverOptions struct {
+	// either "common" (common neighbor count) or "pagerank"
+	// (personalized pagerank around the source vertex)
+	Method string
+
+	// only return vertices of this type, all types if empty
+	VertexType string
+
+	// maximum number of hops to walk, either 2 or 3
+	Depth int
+
+	// maximum number of recommendations returned
+	Limit int
+
+	// upper bounds on the work done for a single query. Whatever has
+	// been explored when either of them is hit is ranked and returned,
+	// with the timeout bounding the ranking and reading of the results.
+	Timeout     time.Duration
+	MaxVertices int
+}
+
+func (opts *DiscoverOptions) setDefaults() {
+	if opts.Method == "" {
+		opts.Method = "common"
+	}
+
+	if opts.Depth == 0 {
+		opts.Depth = 3
+	}
+
+	if opts.Limit == 0 {
+		opts.Limit = 20
+	}
+
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	if opts.MaxVertices == 0 {
+		opts.MaxVertices = 5000
+	}
+}
+
+// neighborhood explored around a source vertex through public edges
+type neighborhood struct {
+	source string
+
+	// hops from the source for every explored vertex
+	depth map[string]int
+
+	// outgoing public edges for every expanded vertex
+	adj map[string][]string
+}
+
+// walks public edges breadth first from the source vertex until the
+// requested depth or one of the budgets is exhausted
+func exploreNeighborhood(source string, opts DiscoverOptions, deadline time.Time) (*neighborhood, error) {
+	n := &neighborhood{
+		source: source,
+		depth:  map[string]int{source: 0},
+		adj:    map[string][]string{},
+	}
+
+	frontier := []string{source}
+
+	for d := 1; d <= opts.Depth && len(frontier) > 0; d++ {
+		next := []string{}
+
+		for _, id := range frontier {
+			if time.Now().After(deadline) || len(n.depth) >= opts.MaxVertices {
+				return n, nil
+			}
+
+			edges, err := db.GetEdges(blend.Vertex{Id: id}, blend.Edge{Family: "public"})
+			if err != nil {
+				// only the source vertex is required to be readable,
+				// the rest of the graph is explored on a best effort basis
+				if id == source {
+					return nil, err
+				}
+
+				continue
+			}
+
+			for _, edge := range edges {
+				if edge.To == "" {
+					continue
+				}
+
+				if _, seen := n.depth[edge.To]; !seen {
+					// a single vertex might have more edges than the budget
+					if time.Now().After(deadline) || len(n.depth) >= opts.MaxVertices {
+						return n, nil
+					}
+
+					n.depth[edge.To] = d
+					next = append(next, edge.To)
+				}
+
+				n.adj[id] = append(n.adj[id], edge.To)
+			}
+		}
+
+		frontier = next
+	}
+
+	return n, nil
+}
+
+// scores every vertex at depth two or more by the number of distinct
+// vertices one hop closer to the source that link to it
+func (n *neighborhood) commonNeighbors() map[string]float64 {
+	linked := map[string]map[string]bool{}
+
+	for from, tos := range n.adj {
+		for _, to := range tos {
+			if n.depth[to] < 2 || n.depth[to] != n.depth[from]+1 {
+				continue
+			}
+
+			if linked[to] == nil {
+				linked[to] = map[string]bool{}
+			}
+
+			linked[to][from] = true
+		}
+	}
+
+	scores := map[string]float64{}
+	for id, froms := range linked {
+		scores[id] = float64(len(froms))
+	}
+
+	return scores
+}
+
+// personalized pagerank over the explored neighborhood, every random
+// walk restarts at the source vertex
+func (n *neighborhood) pageRank(deadline time.Time) map[string]float64 {
+	rank := analytics.PageRankUntil(n.adj, map[string]float64{n.source: 1}, deadline)
+
+	scores := map[string]float64{}
+	for id, r := range rank {
+		if n.depth[id] >= 2 {
+			scores[id] = r
+		}
+	}
+
+	return scores
+}
+
+// Ranks the second and third degree neighbors of a vertex reachable
+// through public edges. Direct neighbors are left out as they are
+// already known to the caller through the edges api.
+func Discover(v blend.Vertex, opts DiscoverOptions) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Vertex ID not supplied",
+		}
+	}
+
+	opts.setDefaults()
+
+	if opts.Depth < 2 || opts.Depth > 3 {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Discovery depth has to be either 2 or 3",
+		}
+	}
+
+	err := db.GetVertex(&v)
+	if err != nil {
+		return blend.APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+	}
+
+	if opts.Method != "common" && opts.Method != "pagerank" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Unknown discovery method given",
+		}
+	}
+
+	// the budget covers exploring, ranking and reading the recommendations
+	deadline := time.Now().Add(opts.Timeout)
+
+	n, err := exploreNeighborhood(v.Id, opts, deadline)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	var scores map[string]float64
+	if opts.Method == "pagerank" {
+		scores = n.pageRank(deadline)
+	} else {
+		scores = n.commonNeighbors()
+	}
+
+	recommendations := n.recommend(scores, opts, deadline)
+
+	return blend.APIResponse{
+		Success:         true,
+		Recommendations: &recommendations,
+	}
+}
+
+// reads the best scored vertices of the requested type, as many as the
+// deadline allows
+func (n *neighborhood) recommend(scores map[string]float64, opts DiscoverOptions, deadline time.Time) []blend.Recommendation {
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+
+		return ids[i] < ids[j]
+	})
+
+	recommendations := []blend.Recommendation{}
+	for _, id := range ids {
+		if len(recommendations) >= opts.Limit || time.Now().After(deadline) {
+			break
+		}
+
+		vertex := blend.Vertex{Id: id}
+
+		// vertices might have been deleted under dangling edges
+		if db.GetVertex(&vertex) != nil {
+			continue
+		}
+
+		if opts.VertexType != "" && vertex.Type != opts.VertexType {
+			continue
+		}
+
+		// never leak private data of a recommended vertex
+		vertex.Private = ""
+		vertex.PrivateKey = ""
+
+		recommendations = append(recommendations, blend.Recommendation{
+			Vertex: vertex,
+			Score:  scores[id],
+			Depth:  n.depth[id],
+		})
+	}
+
+	return recommendations
+}
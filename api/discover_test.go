@@ -0,0 +1,136 @@
+package api
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// source links to two hubs, both linking to x, one of them to y as well,
+// and x links to z
+func createDiscoverGraph(t *testing.T) map[string]*blend.Vertex {
+	err := db.Init(path.Join(t.TempDir(), "graph.db"), &db.BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	vertices := map[string]*blend.Vertex{}
+	for name, vtype := range map[string]string{
+		"source": "hub", "a": "hub", "b": "hub", "x": "person", "y": "page", "z": "person",
+	} {
+		vertices[name] = &blend.Vertex{Name: name, Type: vtype}
+
+		err = db.CreateVertex(vertices[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, link := range [][2]string{{"source", "a"}, {"source", "b"}, {"a", "x"}, {"a", "y"}, {"b", "x"}, {"x", "z"}} {
+		err = db.CreateEdge(*vertices[link[0]], *vertices[link[1]], &blend.Edge{Family: "public", Type: "link"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return vertices
+}
+
+func discoveredNames(t *testing.T, resp blend.APIResponse) []string {
+	if !resp.Success {
+		t.Fatal(resp.Message)
+	}
+
+	names := []string{}
+	for _, r := range *resp.Recommendations {
+		names = append(names, r.Vertex.Name)
+	}
+
+	return names
+}
+
+func TestDiscover(t *testing.T) {
+	vertices := createDiscoverGraph(t)
+	source := blend.Vertex{Id: vertices["source"].Id}
+
+	for _, method := range []string{"common", "pagerank"} {
+		names := discoveredNames(t, Discover(source, DiscoverOptions{Method: method}))
+		if len(names) != 3 || names[0] != "x" {
+			t.Fatal("Got back different recommendations then expected", method, names)
+		}
+
+		names = discoveredNames(t, Discover(source, DiscoverOptions{Method: method, Depth: 2}))
+		if len(names) != 2 || names[0] != "x" || names[1] != "y" {
+			t.Fatal("Got back different recommendations then expected", method, names)
+		}
+
+		names = discoveredNames(t, Discover(source, DiscoverOptions{Method: method, VertexType: "page"}))
+		if len(names) != 1 || names[0] != "y" {
+			t.Fatal("Got back different recommendations of a type then expected", method, names)
+		}
+	}
+
+	resp := Discover(source, DiscoverOptions{Method: "unknown"})
+	if resp.Success {
+		t.Fatal("Discovered with an unknown method")
+	}
+}
+
+func TestDiscoverBudgets(t *testing.T) {
+	vertices := createDiscoverGraph(t)
+	source := vertices["source"].Id
+
+	opts := DiscoverOptions{}
+	opts.setDefaults()
+
+	// the budget is hit within the edges of the source vertex
+	opts.MaxVertices = 2
+
+	n, err := exploreNeighborhood(source, opts, time.Now().Add(time.Minute))
+	if err != nil || len(n.depth) != 2 {
+		t.Fatal("Explored more vertices then the budget allows", n, err)
+	}
+
+	names := discoveredNames(t, Discover(blend.Vertex{Id: source}, opts))
+	if len(names) != 0 {
+		t.Fatal("Got back recommendations beyond the budget", names)
+	}
+
+	opts.MaxVertices = 100
+
+	n, err = exploreNeighborhood(source, opts, time.Now().Add(time.Minute))
+	if err != nil || len(n.depth) != 6 {
+		t.Fatal("Got back a different neighborhood then expected", n, err)
+	}
+
+	past := time.Now().Add(-time.Second)
+
+	// ranking stops after a single iteration, before any rank reaches the
+	// second degree
+	if scores := n.pageRank(past); len(scores) != 0 {
+		t.Fatal("Ranked the neighborhood after the deadline", scores)
+	}
+
+	scores := n.pageRank(time.Now().Add(time.Minute))
+	if len(scores) != 3 {
+		t.Fatal("Got back different scores then expected", scores)
+	}
+
+	if recommendations := n.recommend(scores, opts, past); len(recommendations) != 0 {
+		t.Fatal("Read recommendations after the deadline", recommendations)
+	}
+
+	if recommendations := n.recommend(scores, opts, time.Now().Add(time.Minute)); len(recommendations) != 3 {
+		t.Fatal("Got back different recommendations then expected", recommendations)
+	}
+
+	n, err = exploreNeighborhood(source, opts, past)
+	if err != nil || len(n.depth) != 1 {
+		t.Fatal("Explored the graph after the deadline", n, err)
+	}
+}
@@ -2,12 +2,15 @@ package api
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ziahamza/blend"
 	"github.com/ziahamza/blend/db"
 )
 
-func GetEdges(v blend.Vertex, e blend.Edge) blend.APIResponse {
+// Reads the edges as they were at the time if given, otherwise as they
+// are now
+func GetEdges(v blend.Vertex, e blend.Edge, asOf time.Time) blend.APIResponse {
 	if v.Id == "" {
 		return blend.APIResponse{
 			Success: false,
@@ -31,7 +34,13 @@ func GetEdges(v blend.Vertex, e blend.Edge) blend.APIResponse {
 
 	}
 
-	err := db.GetVertex(&v)
+	var err error
+	if asOf.IsZero() {
+		err = db.GetVertex(&v)
+	} else {
+		err = db.GetVertexAsOf(&v, asOf)
+	}
+
 	if err != nil {
 		return blend.APIResponse{
 			Success: false,
@@ -53,7 +62,12 @@ func GetEdges(v blend.Vertex, e blend.Edge) blend.APIResponse {
 		}
 	}
 
-	edges, err := db.GetEdges(v, e)
+	var edges []blend.Edge
+	if asOf.IsZero() {
+		edges, err = db.GetEdges(v, e)
+	} else {
+		edges, err = db.GetEdgesAsOf(v, e, asOf)
+	}
 
 	if err != nil {
 		return blend.APIResponse{Success: false, Message: err.Error()}
@@ -72,6 +86,57 @@ func GetEdges(v blend.Vertex, e blend.Edge) blend.APIResponse {
 	}
 }
 
+func GetIncomingEdges(v blend.Vertex, e blend.Edge) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Vertex ID not supplied",
+		}
+	}
+
+	switch e.Family {
+	case "", "public", "private", "ownership", "event":
+		// do nothing
+	default:
+		return blend.APIResponse{
+			Success: false,
+			Message: "Unknown edge family given",
+		}
+	}
+
+	err := db.GetVertex(&v)
+	if err != nil {
+		return blend.APIResponse{
+			Success: false,
+			Message: err.Error(),
+		}
+	}
+
+	if e.Family != "public" && v.PrivateKey == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "private_key needs to be supplied to list non public incoming edges",
+		}
+	}
+
+	edges, err := db.GetIncomingEdges(v, e)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	// edge data belongs to the source vertex
+	for i := range edges {
+		if edges[i].Family != "public" {
+			edges[i].Data = ""
+		}
+	}
+
+	return blend.APIResponse{
+		Success: true,
+		Edges:   &edges,
+	}
+}
+
 func CreateEdge(sourceVertex, destVertex blend.Vertex, e blend.Edge) blend.APIResponse {
 	var err error
 
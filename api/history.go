@@ -0,0 +1,41 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// Lists the revisions kept of the vertex and its outgoing edges, private
+// data included only with the private key of the vertex
+func GetRevisions(v blend.Vertex) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	revisions, err := db.Revisions(v.Id, v.PrivateKey)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return blend.APIResponse{Success: true, Revisions: &revisions}
+}
+
+// the as_of parameter is given as an RFC 3339 time, empty reads the
+// current graph
+func parseAsOf(rq *http.Request) (time.Time, error) {
+	abd := rq.FormValue("as_of")
+	if abd == "" {
+		return time.Time{}, nil
+	}
+
+	asOf, err := time.Parse(time.RFC3339Nano, abd)
+	if err != nil {
+		return time.Time{}, errors.New("Can't parse as_of:" + abd)
+	}
+
+	return asOf, nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// graph urls that can be mounted through the api, as the server dials
+// whatever gets mounted. Every url is refused while empty.
+var mountTargets []*url.URL
+
+// Sets the graph urls that can be mounted through the api. A target allows
+// the urls with the same scheme and host and a path at or below its path.
+// Empty targets are skipped.
+func SetMountTargets(targets []string) error {
+	allowed := []*url.URL{}
+
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Cannot parse mount target %s, expected a url like ws://host/graph/rpc", target)
+		}
+
+		allowed = append(allowed, u)
+	}
+
+	mountTargets = allowed
+
+	return nil
+}
+
+func mountAllowed(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil {
+		return false
+	}
+
+	// dot segments could lead out of the allowed path
+	if u.Path != "" && path.Clean(u.Path) != strings.TrimSuffix(u.Path, "/") {
+		return false
+	}
+
+	for _, allowed := range mountTargets {
+		if u.Scheme == allowed.Scheme && strings.EqualFold(u.Host, allowed.Host) &&
+			pathWithin(u.Path, allowed.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// /graph allows /graph and /graph/rpc but not /graphs
+func pathWithin(p, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	return p == base || strings.HasPrefix(p, base+"/")
+}
+
+func GetMounts() blend.APIResponse {
+	mounts := db.Mounts()
+	return blend.APIResponse{Success: true, Mounts: &mounts}
+}
+
+// Attaches a remote graph at the vertex, which requires its private key
+// and the url to be one of the mount targets. The mount lasts until the
+// server restarts.
+func MountGraph(v blend.Vertex, m blend.Mount) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	if v.PrivateKey == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Mounting a graph requires the private key of the vertex",
+		}
+	}
+
+	if !db.ConfirmVertexKey(v.Id, v.PrivateKey) {
+		return blend.APIResponse{Success: false, Message: "Vertex not found or wrong private key"}
+	}
+
+	if len(mountTargets) == 0 {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Mounting graphs through the api is disabled as the server allows no mount targets",
+		}
+	}
+
+	if !mountAllowed(m.URL) {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Graph url " + m.URL + " is not one of the mount targets of the server",
+		}
+	}
+
+	err := db.Mount(blend.Mount{Vertex: v.Id, URL: m.URL, Root: m.Root, Temporary: true})
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	fmt.Printf("Mounted graph %s at vertex %s until the server restarts \n", m.URL, v.Id)
+
+	resp := GetMounts()
+	resp.Message = "Graph mounted until the server restarts"
+
+	return resp
+}
+
+func UnmountGraph(v blend.Vertex) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	if v.PrivateKey == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Unmounting a graph requires the private key of the vertex",
+		}
+	}
+
+	if !db.ConfirmVertexKey(v.Id, v.PrivateKey) {
+		return blend.APIResponse{Success: false, Message: "Vertex not found or wrong private key"}
+	}
+
+	err := db.Unmount(v.Id)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return GetMounts()
+}
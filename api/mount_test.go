@@ -0,0 +1,30 @@
+package api
+
+import "testing"
+
+func TestMountAllowed(t *testing.T) {
+	err := SetMountTargets([]string{"ws://graph.example.com/graph", "wss://other.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer SetMountTargets(nil)
+
+	for target, expected := range map[string]bool{
+		"ws://graph.example.com/graph":          true,
+		"ws://graph.example.com/graph/":         true,
+		"ws://graph.example.com/graph/rpc":      true,
+		"ws://GRAPH.example.com/graph/rpc":      true,
+		"ws://graph.example.com/graphs-private": false,
+		"ws://graph.example.com/graph/../admin": false,
+		"ws://graph.example.com/":               false,
+		"wss://graph.example.com/graph/rpc":     false,
+		"ws://user@graph.example.com/graph/rpc": false,
+		"wss://other.example.com/graph/rpc":     true,
+		"wss://other.example.com":               true,
+	} {
+		if mountAllowed(target) != expected {
+			t.Fatal("Got back a different decision for the mount target then expected", target, expected)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// Moves the vertex from the vertex owning it to another one, optionally
+// renaming its ownership edge. Requires the private keys of both owners,
+// only one of them if the vertex stays with the same owner.
+func MoveVertex(v, from, to blend.Vertex, e blend.Edge) blend.APIResponse {
+	if v.Id == "" || from.Id == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Vertex and the vertex owning it have to be supplied",
+		}
+	}
+
+	if to.Id == "" {
+		to = from
+	}
+
+	if from.Id == to.Id && to.PrivateKey == "" {
+		to.PrivateKey = from.PrivateKey
+	}
+
+	for _, owner := range []blend.Vertex{from, to} {
+		if owner.PrivateKey == "" || !db.ConfirmVertexKey(owner.Id, owner.PrivateKey) {
+			return blend.APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Moving a vertex requires the private key of vertex %s", owner.Id),
+			}
+		}
+	}
+
+	edge, err := db.MoveVertex(v, from, to, e)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	fmt.Printf("Moved vertex %s from %s to %s (%s) \n", v.Id, from.Id, to.Id, edge.Name)
+
+	return blend.APIResponse{Success: true, Edge: &edge}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// Reads the vertex at the end of the path of type:name segments from the
+// root vertex. Its private data is included if its private key is given.
+func GetPath(rootId, path, privateKey string) blend.APIResponse {
+	if rootId == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	edges, err := db.ParsePath(path)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	v, err := db.ResolvePath(blend.Vertex{Id: rootId}, edges)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	if privateKey != "" {
+		v.PrivateKey = privateKey
+
+		err = db.GetVertex(&v)
+		if err != nil {
+			return blend.APIResponse{Success: false, Message: err.Error()}
+		}
+	}
+
+	return blend.APIResponse{Success: true, Vertex: &v}
+}
+
+// Creates the vertices missing along the path from the root vertex, the
+// last one from the given vertex. Private data of the vertex is only sent
+// back if the private key of the root vertex is given.
+func CreatePath(root blend.Vertex, path string, v blend.Vertex) blend.APIResponse {
+	if root.Id == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	edges, err := db.ParsePath(path)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	v, err = db.CreatePath(root, edges, v)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	fmt.Printf("Created path %s below %s ending at %s \n", path, root.Id, v.Id)
+
+	if root.PrivateKey == "" || !db.ConfirmVertexKey(root.Id, root.PrivateKey) {
+		v.Private = ""
+		v.PrivateKey = ""
+	}
+
+	return blend.APIResponse{Success: true, Vertex: &v}
+}
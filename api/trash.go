@@ -0,0 +1,76 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// Lists every tree in the trash, which requires the admin token
+func GetTrash(token string) blend.APIResponse {
+	if !isAdmin(token) {
+		return adminRequired("Listing the trash")
+	}
+
+	entries, err := db.TrashEntries()
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return blend.APIResponse{Success: true, Trash: &entries}
+}
+
+// trashed trees can be handled with the private key of the vertex they
+// were trashed with or the admin token
+func confirmTrashed(v blend.Vertex, token string) error {
+	if v.Id == "" {
+		return errors.New("Vertex Id not supplied")
+	}
+
+	if !isAdmin(token) && !db.ConfirmTrashKey(v.Id, v.PrivateKey) {
+		return fmt.Errorf("Trashed vertex %s not found or wrong private key supplied", v.Id)
+	}
+
+	return nil
+}
+
+// Brings a tree back from the trash under the vertices it was owned by
+func RestoreTrash(v blend.Vertex, token string) blend.APIResponse {
+	err := confirmTrashed(v, token)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	entry, err := db.RestoreTrash(v.Id)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	fmt.Printf("Restored vertex %s with %d vertices from the trash \n", v.Id, len(entry.Vertices))
+
+	return blend.APIResponse{Success: true, Trashed: &entry}
+}
+
+// Permanently deletes a tree in the trash before its retention is over
+func PurgeTrash(v blend.Vertex, token string) blend.APIResponse {
+	err := confirmTrashed(v, token)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	job := blend.Job{Started: time.Now()}
+
+	job.Deleted, err = db.PurgeTrash(v.Id)
+	job.Finished = time.Now()
+
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	job.Status = "done"
+
+	return blend.APIResponse{Success: true, Job: &job}
+}
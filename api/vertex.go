@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ziahamza/blend"
 
@@ -27,12 +28,18 @@ func ListenVertexEvents(wr http.ResponseWriter, rq *http.Request) {
 }
 */
 
-func GetVertex(v blend.Vertex) blend.APIResponse {
+// Reads the vertex as it was at the time if given, otherwise as it is now
+func GetVertex(v blend.Vertex, asOf time.Time) blend.APIResponse {
 	if v.Id == "" {
 		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
 	}
 
-	err := db.GetVertex(&v)
+	var err error
+	if asOf.IsZero() {
+		err = db.GetVertex(&v)
+	} else {
+		err = db.GetVertexAsOf(&v, asOf)
+	}
 
 	if err != nil {
 		return blend.APIResponse{Success: false, Message: err.Error()}
@@ -162,3 +169,110 @@ func CreateVertex(v blend.Vertex) blend.APIResponse {
 		Vertex:  &v,
 	}
 }
+
+// Replaces the name, type and data of a vertex, its private key
+// stays the same
+func UpdateVertex(v blend.Vertex) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	if v.PrivateKey == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Updating a vertex requires its private key",
+		}
+	}
+
+	if v.Name == "" || v.Type == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Vertex name and type cannot be empty",
+		}
+	}
+
+	existing := blend.Vertex{Id: v.Id, PrivateKey: v.PrivateKey}
+	err := db.GetVertex(&existing)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	v.LastChanged = time.Now()
+
+	err = db.UpdateVertex(&v)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	fmt.Printf("Updated vertex %s successfully \n", v.Id)
+
+	return blend.APIResponse{Success: true, Vertex: &v}
+}
+
+// Deletes the vertex along with everything it owns. Large trees can be
+// deleted in the background, in which case the returned job can be
+// polled for progress. With the trash enabled the tree is moved to the
+// trash instead, recording the address the request came from along with
+// the actor the client claims to be.
+func DeleteVertex(v blend.Vertex, async bool, from, actor string) blend.APIResponse {
+	if v.Id == "" {
+		return blend.APIResponse{Success: false, Message: "Vertex Id not supplied"}
+	}
+
+	if v.PrivateKey == "" {
+		return blend.APIResponse{
+			Success: false,
+			Message: "Deleting a vertex requires its private key",
+		}
+	}
+
+	err := db.GetVertex(&v)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	if db.TrashEnabled() {
+		entry, err := db.TrashVertexTree(&v, from, actor)
+		if err != nil {
+			return blend.APIResponse{Success: false, Message: err.Error()}
+		}
+
+		fmt.Printf("Moved vertex %s with %d vertices to the trash \n", v.Id, len(entry.Vertices))
+
+		return blend.APIResponse{Success: true, Trashed: &entry}
+	}
+
+	if async {
+		job, err := db.StartDeleteVertexTree([]*blend.Vertex{&v})
+		if err != nil {
+			return blend.APIResponse{Success: false, Message: err.Error()}
+		}
+
+		return blend.APIResponse{Success: true, Job: &job}
+	}
+
+	job := blend.Job{Started: time.Now()}
+
+	job.Deleted, err = db.DeleteVertexTree([]*blend.Vertex{&v}, nil)
+	job.Finished = time.Now()
+
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	job.Status = "done"
+
+	fmt.Printf("Deleted vertex %s with %d vertices and %d edges \n",
+		v.Id, job.Deleted.Vertices, job.Deleted.Edges)
+
+	return blend.APIResponse{Success: true, Job: &job}
+}
+
+func GetJob(id string) blend.APIResponse {
+	job, err := db.GetJob(id)
+	if err != nil {
+		return blend.APIResponse{Success: false, Message: err.Error()}
+	}
+
+	return blend.APIResponse{Success: true, Job: &job}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/db"
+)
+
+// Takes a backup from a running server, or restores one into a backend
+// while no server is using it:
+//
+//	backup -url http://localhost:8080 -token admintoken -out graph.db
+//	backup -restore graph.db -backend local -uri /tmp/blend.db
+func main() {
+	server := flag.String("url", "http://localhost:8080", "Address of the server to back up")
+	token := flag.String("token", "", "Admin token of the server")
+	out := flag.String("out", "", "File to write the backup to, defaults to stdout")
+
+	restore := flag.String("restore", "", "Backup file to restore instead of taking a backup")
+
+	backend := flag.String("backend", "local",
+		`Storage backend to restore into. Snapshots only restore into the
+backend they were taken from, which currently is just local`)
+
+	uri := flag.String("uri", path.Join(os.TempDir(), "blend.db"),
+		`URI for the storage backend, see the server for details`)
+
+	flag.Parse()
+
+	var err error
+	if *restore != "" {
+		err = restoreBackup(*restore, *backend, *uri)
+	} else {
+		err = takeBackup(*server, *token, *out)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func takeBackup(server, token, out string) error {
+	req, err := http.NewRequest("GET", server+"/graph/backup", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(blend.AdminTokenHeader, token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.Header.Get("X-Backup-Format") == "" {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Server refused the backup: %s", body)
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		w = f
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %s backup of %d bytes\n", resp.Header.Get("X-Backup-Format"), n)
+
+	return nil
+}
+
+func restoreBackup(file, backend, uri string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// exports are json lines, anything else is a snapshot
+	first, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	if first[0] != '{' {
+		if backend != "local" {
+			return fmt.Errorf("Snapshots cannot be restored into the %s backend", backend)
+		}
+
+		err = db.RestoreSnapshot(r, uri)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Restored snapshot into %s\n", uri)
+		}
+
+		return err
+	}
+
+	err = db.Open(backend, uri)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	vertices, edges, skipped, err := db.Restore(r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Restored %d vertices and %d edges\n", vertices, edges)
+
+	for _, e := range skipped {
+		fmt.Fprintf(os.Stderr, "Skipped %s edge %s from %s to %s missing from the export\n",
+			e.Family, e.Name, e.From, e.To)
+	}
+
+	return nil
+}
@@ -4,6 +4,10 @@ import (
 	"time"
 )
 
+// header carrying the admin token of a server, which grants access to the
+// whole graph
+const AdminTokenHeader = "X-Admin-Token"
+
 type Vertex struct {
 	Id          string    `json:"vertex_id"`
 	LastChanged time.Time `json:"last_changed"`
@@ -30,20 +34,161 @@ type Edge struct {
 	To          string `json:"vertex_to"`
 	Data        string `json:"edge_data"`
 }
+
+// A vertex suggested by the discovery api along with its score and
+// the number of hops it is away from the source vertex
+type Recommendation struct {
+	Vertex Vertex  `json:"vertex"`
+	Score  float64 `json:"score"`
+	Depth  int     `json:"depth"`
+}
+
+// Number of vertices and edges removed by a tree deletion. Cycles counts
+// the ownership edges found pointing back to an ancestor in the tree.
+type DeleteStats struct {
+	Vertices int `json:"vertices_removed"`
+	Edges    int `json:"edges_removed"`
+	Cycles   int `json:"cycles"`
+}
+
+// Progress of a long running operation started through the api. Status
+// is one of running, done or failed.
+type Job struct {
+	Id       string      `json:"job_id,omitempty"`
+	Status   string      `json:"status"`
+	Message  string      `json:"message,omitempty"`
+	Deleted  DeleteStats `json:"deleted"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+}
+
+// Cache effectiveness of backends serving another graph
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+// Replication state of backends that keep accepting writes while their
+// source graph is unreachable. Queued counts the writes waiting to be
+// replayed, Conflicts the ones rejected during replay.
+type SyncStatus struct {
+	Online       bool      `json:"online"`
+	Queued       int       `json:"queued"`
+	Conflicts    int       `json:"conflicts"`
+	LastConflict string    `json:"last_conflict,omitempty"`
+	LastSync     time.Time `json:"last_sync"`
+}
+
+// A remote graph attached at a local vertex, the vertex stands in for the
+// root vertex of the remote graph
+type Mount struct {
+	Vertex string `json:"vertex_id"`
+	URL    string `json:"url"`
+	Root   string `json:"root_id"`
+
+	// mounted through the api rather than configured on the server, gone
+	// once the server restarts
+	Temporary bool `json:"temporary"`
+}
+
+// A change committed to the graph, numbered in the order of the changes.
+// Type is one of vertex:create, vertex:update, vertex:delete, edge:create,
+// edge:update or edge:delete. The vertex or edge is given as it was before
+// and after the change as far as it existed, private data left out.
+type Change struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"change_type"`
+	Time time.Time `json:"change_time"`
+
+	VertexBefore *Vertex `json:"vertex_before,omitempty"`
+	VertexAfter  *Vertex `json:"vertex_after,omitempty"`
+	EdgeBefore   *Edge   `json:"edge_before,omitempty"`
+	EdgeAfter    *Edge   `json:"edge_after,omitempty"`
+}
+
+// A revision of a vertex or edge kept by versioning, as it was from the
+// time it was changed until the next revision. Deleted revisions only
+// identify the vertex or edge.
+type Revision struct {
+	Changed time.Time `json:"changed"`
+	Deleted bool      `json:"deleted,omitempty"`
+	Vertex  *Vertex   `json:"vertex,omitempty"`
+	Edge    *Edge     `json:"edge,omitempty"`
+}
+
+// A vertex tree moved to the trash by a delete, along with the ownership
+// edges it was detached from which are restored with it
+type TrashEntry struct {
+	Vertex   string    `json:"vertex_id"`
+	Vertices []string  `json:"vertices"`
+	Parents  []Edge    `json:"parents"`
+	Deleted  time.Time `json:"deleted"`
+
+	// address the delete came from as seen by the server
+	DeletedFrom string `json:"deleted_from,omitempty"`
+
+	// who deleted the vertex as claimed by the client, not verified
+	DeletedBy string `json:"deleted_by_claimed,omitempty"`
+}
+
 type APIRequest struct {
+	// echoed back in the response so requests multiplexed over a
+	// single connection can be told apart
+	RequestId uint64 `json:"request_id,omitempty"`
+
 	Method      string `json:"method,omitempty"`
 	Edge        Edge   `json:"edge,omitempty"`
 	Vertex      Vertex `json:"vertex,omitempty"`
 	ChildVertex Vertex `json:"child_vertex,omitempty"`
+
+	// the vertex a child vertex is moved or copied to
+	Target Vertex `json:"target_vertex,omitempty"`
+
+	// copies of vertices keep their private data and keys
+	CopyPrivate bool `json:"copy_private,omitempty"`
+
+	// key of copies made without their private data, generated if empty
+	CopyKey string `json:"copy_private_key,omitempty"`
+
+	// slash separated type:name segments of the ownership edges leading
+	// from the vertex to another one
+	Path string `json:"path,omitempty"`
+
+	// reading the changelog starts after this sequence number and
+	// returns at most limit changes
+	Since uint64 `json:"since,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+
+	// reads the vertex or edges as they were at the time if set
+	AsOf time.Time `json:"as_of,omitempty"`
+
+	// who deletes a vertex as claimed by the client, kept unverified with
+	// it in the trash
+	Actor string `json:"actor,omitempty"`
 }
 
 // only a subset of the following fields are send as the response
 type APIResponse struct {
+	RequestId uint64 `json:"request_id,omitempty"`
+
 	Success bool    `json:"success"`
 	Version string  `json:"graph-version"`
 	Message string  `json:"message,omitempty"`
 	Vertex  *Vertex `json:"vertex,omitempty"`
 	Edge    *Edge   `json:"edge,omitempty"`
 	Edges   *[]Edge `json:"edges,omitempty"`
+
+	Recommendations *[]Recommendation `json:"recommendations,omitempty"`
+	Job             *Job              `json:"job,omitempty"`
+	Event           *Event            `json:"event,omitempty"`
+	Cache           *CacheStats       `json:"cache,omitempty"`
+	Sync            *SyncStatus       `json:"sync,omitempty"`
+	Mounts          *[]Mount          `json:"mounts,omitempty"`
+	Changes         *[]Change         `json:"changes,omitempty"`
+	Change          *Change           `json:"change,omitempty"`
+	Revisions       *[]Revision       `json:"revisions,omitempty"`
+	Trash           *[]TrashEntry     `json:"trash,omitempty"`
+	Trashed         *TrashEntry       `json:"trashed,omitempty"`
 	// TODO: add type to send an entire graph
 }
@@ -0,0 +1,226 @@
+// backups of the graph taken while it is in use
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+// Optionally implemented by backends that can copy their storage as it is.
+// The copy has to be consistent while writes go on, a later restore brings
+// the graph back to the moment the snapshot started.
+type Snapshotter interface {
+	Snapshot(io.Writer) (int64, error)
+}
+
+// Formats written by Backup. Snapshots copy the storage of the backend and
+// can only be restored into the same kind of backend, exports are json
+// lines with a vertex or an edge each that restore into any backend.
+const (
+	SnapshotFormat = "snapshot"
+	ExportFormat   = "export"
+)
+
+// a line of an export
+type exportRecord struct {
+	Vertex *blend.Vertex `json:"vertex,omitempty"`
+	Edge   *blend.Edge   `json:"edge,omitempty"`
+
+	// id of a vertex kept as a root by garbage collection
+	Root string `json:"root,omitempty"`
+}
+
+// The format Backup writes with the current backend
+func BackupFormat() string {
+	if _, ok := backend.(Snapshotter); ok {
+		return SnapshotFormat
+	}
+
+	return ExportFormat
+}
+
+// Writes a snapshot of the graph if the backend can take one, otherwise an
+// export of every vertex and edge
+func Backup(w io.Writer) error {
+	if snapshotter, ok := backend.(Snapshotter); ok {
+		_, err := snapshotter.Snapshot(w)
+		return err
+	}
+
+	return Export(w)
+}
+
+// Writes every vertex followed by the roots the backend keeps and every
+// edge as json lines, private data included. Backends scan vertices and
+// edges one after the other, so edges written in between can point at
+// vertices missing from the export.
+func Export(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+
+	err := ScanVertices(func(v blend.Vertex) error {
+		return enc.Encode(exportRecord{Vertex: &v})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if keeper, ok := backend.(RootKeeper); ok {
+		err = keeper.ScanRoots(func(id string) error {
+			return enc.Encode(exportRecord{Root: id})
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ScanEdges(func(e blend.Edge) error {
+		return enc.Encode(exportRecord{Edge: &e})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
+
+// Adds the vertices and edges of an export to the graph, keeping their ids.
+// Vertices already in the graph are overwritten. Returns the number of
+// vertices and edges restored, along with the edges skipped as they point
+// from or to a vertex neither in the export nor in the graph.
+func Restore(r io.Reader) (vertices, edges int, skipped []blend.Edge, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	skipped = []blend.Edge{}
+
+	// vertices known to be in the graph, or known to be missing
+	found := map[string]bool{}
+	exists := func(id string) bool {
+		if _, ok := found[id]; !ok {
+			found[id] = backend.GetVertex(&blend.Vertex{Id: id}) == nil
+		}
+
+		return found[id]
+	}
+
+	keeper, keepsRoots := backend.(RootKeeper)
+
+	// exports from backends not keeping their roots get every vertex
+	// restored without an owner as a root
+	restored := []string{}
+	owned := map[string]bool{}
+	rooted := false
+
+	for {
+		record := exportRecord{}
+
+		err = dec.Decode(&record)
+		if err == io.EOF {
+			err = nil
+			if keepsRoots && !rooted {
+				for _, id := range restored {
+					if !owned[id] && err == nil {
+						err = keeper.AddRoot(id)
+					}
+				}
+			}
+
+			return vertices, edges, skipped, err
+		}
+
+		if err != nil {
+			return vertices, edges, skipped, fmt.Errorf("Cannot read export: %s", err.Error())
+		}
+
+		switch {
+		case record.Vertex != nil:
+			err = backend.CreateVertex(record.Vertex)
+			restored = append(restored, record.Vertex.Id)
+			found[record.Vertex.Id] = err == nil
+			vertices++
+		case record.Root != "":
+			rooted = true
+			if keepsRoots {
+				err = keeper.AddRoot(record.Root)
+			}
+		case record.Edge != nil:
+			e := record.Edge
+
+			// edges written while the export scanned the vertices
+			if !exists(e.From) || !exists(e.To) {
+				skipped = append(skipped, *e)
+				continue
+			}
+
+			err = backend.CreateEdge(blend.Vertex{Id: e.From}, blend.Vertex{Id: e.To}, e)
+			if e.Family == "ownership" {
+				owned[e.To] = true
+			}
+
+			edges++
+		default:
+			err = errors.New("Export line without a vertex or edge")
+		}
+
+		if err != nil {
+			return vertices, edges, skipped, err
+		}
+	}
+}
+
+// Replaces the bolt database at the path with a snapshot. The database must
+// not be open, the snapshot is checked before it takes the place of the
+// database so a broken one leaves the database as it was.
+func RestoreSnapshot(r io.Reader, path string) error {
+	tmp := path + ".restore"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+
+	if err == nil {
+		err = checkSnapshot(tmp)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func checkSnapshot(path string) error {
+	store, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("Not a bolt snapshot: %s", err.Error())
+	}
+
+	defer store.Close()
+
+	return store.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("vertex")) == nil || tx.Bucket([]byte("edge")) == nil {
+			return errors.New("Snapshot does not hold a graph")
+		}
+
+		return nil
+	})
+}
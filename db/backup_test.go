@@ -0,0 +1,165 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = Init(path.Join(dir, "graph.db"), &BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := &blend.Vertex{Name: "parent", Type: "test", PrivateKey: "key", Private: "secret"}
+	child := &blend.Vertex{Name: "child", Type: "test"}
+
+	err = CreateVertex(parent)
+	if err == nil {
+		err = CreateChildVertex(parent, child, blend.Edge{Type: "child", Name: "child"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, export := &bytes.Buffer{}, &bytes.Buffer{}
+
+	if BackupFormat() != SnapshotFormat {
+		t.Fatal("Bolt backend does not take snapshots")
+	}
+
+	err = Backup(snapshot)
+	if err == nil {
+		err = Export(export)
+	}
+
+	Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot restores into a bolt database of its own
+	restored := path.Join(dir, "restored.db")
+
+	err = RestoreSnapshot(snapshot, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Init(restored, &BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := blend.Vertex{Id: parent.Id, PrivateKey: "key"}
+	err = GetVertex(&v)
+	Close()
+
+	if err != nil || v.Private != "secret" {
+		t.Fatal("Got back a different vertex from the snapshot", v, err)
+	}
+
+	err = RestoreSnapshot(bytes.NewBufferString("not a snapshot"), restored)
+	if err == nil {
+		t.Fatal("Restored a broken snapshot")
+	}
+
+	// the export restores into any backend
+	err = Init("sqlite::memory:", &SQLStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer Close()
+
+	// as if the edge was written while the vertices were exported
+	missing := blend.Edge{From: parent.Id, To: "missing", Family: "public", Type: "link", Name: "missing"}
+	err = json.NewEncoder(export).Encode(exportRecord{Edge: &missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vertices, edges, skipped, err := Restore(export)
+	if err != nil || vertices != 2 || edges != 1 {
+		t.Fatal("Restored a different export then expected", vertices, edges, err)
+	}
+
+	if len(skipped) != 1 || skipped[0] != missing {
+		t.Fatal("Skipped different edges then expected", skipped)
+	}
+
+	found, err := GetChildVertex(*parent, blend.Edge{Family: "ownership", Type: "child", Name: "child"})
+	if err != nil || found.Id != child.Id {
+		t.Fatal("Child vertex not restored from the export", found, err)
+	}
+
+	// the roots come along, so the restored graph is no garbage
+	result, err := CollectGarbage(GCOptions{})
+	if err != nil || len(result.Unreachable) != 0 {
+		t.Fatal("Roots not restored from the export", result, err)
+	}
+}
+
+// backends without snapshots export every vertex and edge they scan
+func TestCassandraExport(t *testing.T) {
+	err := Init("", &CassandraStorage{connect: newFakeCluster().connect})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := &blend.Vertex{Name: "parent", Type: "test", PrivateKey: "key", Private: "secret"}
+	child := &blend.Vertex{Name: "child", Type: "test"}
+
+	err = CreateVertex(parent)
+	if err == nil {
+		err = CreateChildVertex(parent, child, blend.Edge{Type: "child", Name: "child"})
+	}
+
+	export := &bytes.Buffer{}
+	if err == nil {
+		err = Backup(export)
+	}
+
+	Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Init("", &CassandraStorage{connect: newFakeCluster().connect})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer Close()
+
+	vertices, edges, skipped, err := Restore(export)
+	if err != nil || vertices != 2 || edges != 1 || len(skipped) != 0 {
+		t.Fatal("Restored a different export then expected", vertices, edges, skipped, err)
+	}
+
+	v := blend.Vertex{Id: parent.Id, PrivateKey: "key"}
+	err = GetVertex(&v)
+	if err != nil || v.Private != "secret" {
+		t.Fatal("Got back a different vertex from the export", v, err)
+	}
+
+	found, err := GetChildVertex(*parent, blend.Edge{Family: "ownership", Type: "child", Name: "child"})
+	if err != nil || found.Id != child.Id {
+		t.Fatal("Child vertex not restored from the export", found, err)
+	}
+}
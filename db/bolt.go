@@ -3,14 +3,19 @@ package db
 
 import (
 	"bytes"
-	"encoding/json"
+	"encoding/binary"
 	"errors"
 	"github.com/boltdb/bolt"
 	"github.com/ziahamza/blend"
+	"io"
 	"os"
 	"time"
 )
 
+func init() {
+	Register("local", func() Storage { return &BoltStorage{} })
+}
+
 type BoltStorage struct {
 	store *bolt.DB
 	path  string
@@ -44,12 +49,169 @@ func (db *BoltStorage) Init(path string) error {
 			return err
 		}
 
-		return nil
+		err = upgradeBoltFormat(tx)
+		if err != nil {
+			return err
+		}
+
+		if tx.Bucket([]byte("roots")) == nil {
+			err = createRoots(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if tx.Bucket([]byte("incoming")) != nil {
+			return nil
+		}
+
+		incomingBucket, err := tx.CreateBucket([]byte("incoming"))
+		if err != nil {
+			return err
+		}
+
+		// index the edges written before the incoming index existed
+		return tx.Bucket([]byte("edge")).ForEach(func(k, ebytes []byte) error {
+			edge, err := decodeEdge(ebytes)
+			if err != nil {
+				return err
+			}
+
+			return incomingBucket.Put(incomingKey(edge), k)
+		})
 	})
 
 	return err
 }
 
+// Vertices created without an owner are kept as roots. Which vertices were
+// is not known for databases created before, so every vertex without an
+// owner at the time the roots are created is kept as a root and nothing
+// that exists is taken for garbage.
+func createRoots(tx *bolt.Tx) error {
+	roots, err := tx.CreateBucket([]byte("roots"))
+	if err != nil {
+		return err
+	}
+
+	owned := map[string]bool{}
+
+	err = tx.Bucket([]byte("edge")).ForEach(func(k, ebytes []byte) error {
+		edge, err := decodeEdge(ebytes)
+		if err != nil {
+			return err
+		}
+
+		if edge.Family == "ownership" {
+			owned[edge.To] = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte("vertex")).ForEach(func(k, _ []byte) error {
+		if owned[string(k)] {
+			return nil
+		}
+
+		return roots.Put(k, []byte{})
+	})
+}
+
+// Keys are made of ids and names each prefixed by its length as a varint,
+// so the key of one vertex is never a prefix of the key of another one
+// whatever characters their ids contain
+func appendKey(key []byte, parts ...string) []byte {
+	for _, part := range parts {
+		key = binary.AppendUvarint(key, uint64(len(part)))
+		key = append(key, part...)
+	}
+
+	return key
+}
+
+// the parts of the family, type and name of the edge that are known,
+// matching every edge with the same ones
+func appendEdgeParts(key []byte, e blend.Edge) []byte {
+	if e.Family == "" {
+		return key
+	}
+
+	key = appendKey(key, e.Family)
+	if e.Type == "" {
+		return key
+	}
+
+	key = appendKey(key, e.Type)
+	if e.Name == "" {
+		return key
+	}
+
+	return appendKey(key, e.Name)
+}
+
+// format for edge key:
+// vertexFromId family type name
+func edgeKey(e blend.Edge) []byte {
+	return appendKey(nil, e.From, e.Family, e.Type, e.Name)
+}
+
+// prefix of the keys of every edge from the vertex matching the family,
+// type and name of the given edge, as far as they are known. The same
+// prefix finds the incoming index keys of the edges to the vertex.
+func edgePrefix(v blend.Vertex, e blend.Edge) []byte {
+	return appendEdgeParts(appendKey(nil, v.Id), e)
+}
+
+// format for the incoming index key, the value is the edge key:
+// vertexToId family type name vertexFromId
+func incomingKey(e blend.Edge) []byte {
+	return appendKey(nil, e.To, e.Family, e.Type, e.Name, e.From)
+}
+
+// stores the edge along with its entry in the incoming index
+func putEdge(tx *bolt.Tx, e blend.Edge) error {
+	// drop the index entry of an older edge being overwritten
+	err := deleteEdge(tx, edgeKey(e))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte("edge")).Put(edgeKey(e), encodeEdge(e))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte("incoming")).Put(incomingKey(e), edgeKey(e))
+}
+
+// removes the edge stored under the key along with its entry in
+// the incoming index
+func deleteEdge(tx *bolt.Tx, key []byte) error {
+	edgeBucket := tx.Bucket([]byte("edge"))
+
+	ebytes := edgeBucket.Get(key)
+	if ebytes == nil {
+		return nil
+	}
+
+	edge, err := decodeEdge(ebytes)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte("incoming")).Delete(incomingKey(edge))
+	if err != nil {
+		return err
+	}
+
+	return edgeBucket.Delete(key)
+}
+
 func (db *BoltStorage) Close() {
 	db.store.Close()
 }
@@ -63,7 +225,24 @@ func (db *BoltStorage) Drop() error {
 }
 
 func (db *BoltStorage) GetVertex(v *blend.Vertex) error {
-	vkey := v.PrivateKey
+	vertex := blend.Vertex{Id: v.Id}
+
+	err := db.GetPrivateVertex(&vertex)
+	if err != nil {
+		return err
+	}
+
+	err = checkVertexKey(&vertex, v.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	*v = vertex
+
+	return nil
+}
+
+func (db *BoltStorage) GetPrivateVertex(v *blend.Vertex) error {
 	return db.store.View(func(tx *bolt.Tx) error {
 		vertexBucket := tx.Bucket([]byte("vertex"))
 
@@ -72,16 +251,12 @@ func (db *BoltStorage) GetVertex(v *blend.Vertex) error {
 			return errors.New("Vertex not found.")
 		}
 
-		err := json.Unmarshal(vbytes, v)
+		vertex, err := decodeVertex(vbytes)
 		if err != nil {
 			return err
 		}
 
-		if vkey == "" {
-			v.PrivateKey = ""
-		} else if v.PrivateKey != vkey {
-			return errors.New("Wront private key supplied for vertex")
-		}
+		*v = vertex
 
 		return nil
 	})
@@ -97,23 +272,42 @@ func (db *BoltStorage) GetEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, err
 	err := db.store.View(func(tx *bolt.Tx) error {
 		cursor := tx.Bucket([]byte("edge")).Cursor()
 
-		// format for edge key:
-		// vertexFromId:family:type:name
+		prefix := edgePrefix(v, e)
 
-		id := v.Id + ":" + e.Family
-		if e.Type != "" {
-			id += ":" + e.Type
-
-			if e.Name != "" {
-				id += ":" + e.Name
+		for k, v := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			edge, err := decodeEdge(v)
+			if err != nil {
+				return err
 			}
+
+			edges = append(edges, edge)
 		}
 
-		prefix := []byte(id)
+		return nil
+	})
 
-		for k, v := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
-			edge := blend.Edge{}
-			json.Unmarshal(v, &edge)
+	return edges, err
+}
+
+func (db *BoltStorage) GetIncomingEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
+	edges := []blend.Edge{}
+
+	err := db.store.View(func(tx *bolt.Tx) error {
+		edgeBucket := tx.Bucket([]byte("edge"))
+		cursor := tx.Bucket([]byte("incoming")).Cursor()
+
+		prefix := edgePrefix(v, e)
+
+		for k, key := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, key = cursor.Next() {
+			ebytes := edgeBucket.Get(key)
+			if ebytes == nil {
+				continue
+			}
+
+			edge, err := decodeEdge(ebytes)
+			if err != nil {
+				return err
+			}
 
 			edges = append(edges, edge)
 		}
@@ -149,57 +343,25 @@ func (backend *BoltStorage) CreateChildVertex(v, vc *blend.Vertex, e blend.Edge)
 
 	if err == nil {
 		vc.Id = vertex.Id
-		return UpdateVertex(vc)
-	}
-
-	vbytes, err := json.Marshal(vc)
-	if err != nil {
-		return err
-	}
-
-	ebytes, err := json.Marshal(e)
-	if err != nil {
-		return err
+		return backend.UpdateVertex(vc)
 	}
 
 	return backend.store.Update(func(tx *bolt.Tx) error {
-		vertexBucket := tx.Bucket([]byte("vertex"))
-		edgeBucket := tx.Bucket([]byte("edge"))
-
-		vertexBucket.Put([]byte(vc.Id), vbytes)
-
-		edgeId := e.From + ":" + e.Family + ":" + e.Type + ":" + e.Name
-		edgeBucket.Put([]byte(edgeId), ebytes)
+		err := tx.Bucket([]byte("vertex")).Put([]byte(vc.Id), encodeVertex(*vc))
+		if err != nil {
+			return err
+		}
 
-		return nil
+		return putEdge(tx, e)
 	})
 }
 
 func (backend *BoltStorage) CreateVertex(v *blend.Vertex) error {
-	vbytes, err := json.Marshal(v)
-	if err != nil {
-		return err
-	}
-
-	return backend.store.Update(func(tx *bolt.Tx) error {
-		vertexBucket := tx.Bucket([]byte("vertex"))
-		vertexBucket.Put([]byte(v.Id), vbytes)
-
-		return nil
-	})
+	return backend.putVertex(*v)
 }
 
 func (backend *BoltStorage) UpdateVertex(v *blend.Vertex) error {
-	vbytes, err := json.Marshal(v)
-	if err != nil {
-		return err
-	}
-
-	return backend.store.Update(func(tx *bolt.Tx) error {
-		vertexBucket := tx.Bucket([]byte("vertex"))
-		vertexBucket.Put([]byte(v.Id), vbytes)
-		return nil
-	})
+	return backend.putVertex(*v)
 }
 
 func (backend *BoltStorage) CreateEdge(v, vc blend.Vertex, e *blend.Edge) error {
@@ -210,67 +372,222 @@ func (backend *BoltStorage) CreateEdge(v, vc blend.Vertex, e *blend.Edge) error
 	})
 
 	if err == nil && len(edges) > 0 {
-		e.To = edges[0].To
+		*e = edges[0]
 
 		// edge already found, returning the old one
 		return nil
 	}
 
-	ebytes, err := json.Marshal(e)
-	if err != nil {
-		return err
-	}
-
 	return backend.store.Update(func(tx *bolt.Tx) error {
-		edgeBucket := tx.Bucket([]byte("edge"))
 		vertexBucket := tx.Bucket([]byte("vertex"))
 
 		if vertexBucket.Get([]byte(e.From)) == nil {
 			return errors.New("The edge from vertex not found")
 		}
 
-		edgeId := e.From + ":" + e.Family + ":" + e.Type + ":" + e.Name
-		edgeBucket.Put([]byte(edgeId), ebytes)
+		if vertexBucket.Get([]byte(e.To)) == nil {
+			return errors.New("The edge to vertex not found")
+		}
 
-		return nil
+		return putEdge(tx, *e)
 	})
 }
 
-func (backend *BoltStorage) DeleteVertex(v *blend.Vertex) error {
+func (backend *BoltStorage) DeleteEdge(e blend.Edge) error {
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		return deleteEdge(tx, edgeKey(e))
+	})
+}
+
+// Replaces the edge in a single transaction
+func (backend *BoltStorage) MoveEdge(old blend.Edge, e *blend.Edge) error {
 	return backend.store.Update(func(tx *bolt.Tx) error {
 		vertexBucket := tx.Bucket([]byte("vertex"))
 
-		// TODO: Delete corresponding edges ...
+		for _, id := range []string{e.From, e.To} {
+			if vertexBucket.Get([]byte(id)) == nil {
+				return errors.New("The edge vertex " + id + " not found")
+			}
+		}
 
-		vertexBucket.Delete([]byte(v.Id))
+		err := deleteEdge(tx, edgeKey(old))
+		if err != nil {
+			return err
+		}
 
-		return nil
+		return putEdge(tx, *e)
 	})
 }
 
-func (backend *BoltStorage) DeleteVertexTree(vertices []*blend.Vertex) error {
-	if len(vertices) == 0 {
-		return nil
+// Stores the vertex as is, also used to keep copies of vertices from
+// other graphs
+func (backend *BoltStorage) putVertex(v blend.Vertex) error {
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("vertex")).Put([]byte(v.Id), encodeVertex(v))
+	})
+}
+
+// Stores the edge as is without checking its vertices
+func (backend *BoltStorage) storeEdge(e blend.Edge) error {
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		return putEdge(tx, e)
+	})
+}
+
+// Replaces every edge matching the query with the given ones without
+// checking their vertices, used to keep copies of edges from other graphs
+func (backend *BoltStorage) replaceEdges(v blend.Vertex, query blend.Edge, edges []blend.Edge) error {
+	if query.Family == "" {
+		query.Family = "public"
 	}
 
-	vertex := vertices[0]
-	vertices = vertices[1:]
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		keys := [][]byte{}
+		prefix := edgePrefix(v, query)
 
-	backEdges, err := backend.GetEdges(*vertex, blend.Edge{Family: "ownership"})
+		cursor := tx.Bucket([]byte("edge")).Cursor()
+		for k, _ := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
 
-	if err != nil {
-		return err
+		for _, k := range keys {
+			err := deleteEdge(tx, k)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, e := range edges {
+			err := putEdge(tx, e)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// removes the vertex along with its outgoing edges, incoming ones are
+// taken care of by the delete policies. Returns the number of edges removed.
+func deleteVertex(tx *bolt.Tx, v *blend.Vertex) (int, error) {
+	keys := [][]byte{}
+	prefix := appendKey(nil, v.Id)
+
+	cursor := tx.Bucket([]byte("edge")).Cursor()
+	for k, _ := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
 	}
 
-	// Breadth first deletion
-	for _, edge := range backEdges {
-		vertices = append(vertices, &blend.Vertex{Id: edge.To})
+	for _, k := range keys {
+		err := deleteEdge(tx, k)
+		if err != nil {
+			return 0, err
+		}
 	}
-	err = backend.DeleteVertexTree(vertices)
 
+	err := tx.Bucket([]byte("roots")).Delete([]byte(v.Id))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return backend.DeleteVertex(vertex)
+	return len(keys), tx.Bucket([]byte("vertex")).Delete([]byte(v.Id))
+}
+
+func (backend *BoltStorage) DeleteVertex(v *blend.Vertex) error {
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		_, err := deleteVertex(tx, v)
+		return err
+	})
+}
+
+func (backend *BoltStorage) DeleteVertices(vertices []*blend.Vertex) (int, error) {
+	edges := 0
+
+	err := backend.store.Update(func(tx *bolt.Tx) error {
+		edges = 0
+
+		for _, v := range vertices {
+			count, err := deleteVertex(tx, v)
+			if err != nil {
+				return err
+			}
+
+			edges += count
+		}
+
+		return nil
+	})
+
+	return edges, err
+}
+
+// Copies the database as of the start of a read transaction, writes
+// carry on meanwhile
+func (backend *BoltStorage) Snapshot(w io.Writer) (int64, error) {
+	var n int64
+
+	err := backend.store.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+func (backend *BoltStorage) AddRoot(id string) error {
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("roots")).Put([]byte(id), []byte{})
+	})
+}
+
+func (backend *BoltStorage) ScanRoots(fn func(string) error) error {
+	return backend.store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("roots")).ForEach(func(k, _ []byte) error {
+			return fn(string(k))
+		})
+	})
+}
+
+func (backend *BoltStorage) RecordTrash(path string) error {
+	return backend.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("meta")).Put([]byte("trash"), []byte(path))
+	})
+}
+
+func (backend *BoltStorage) RecordedTrash() (string, error) {
+	path := ""
+	err := backend.store.View(func(tx *bolt.Tx) error {
+		path = string(tx.Bucket([]byte("meta")).Get([]byte("trash")))
+		return nil
+	})
+
+	return path, err
+}
+
+func (backend *BoltStorage) ScanVertices(fn func(blend.Vertex) error) error {
+	return backend.store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("vertex")).ForEach(func(k, vbytes []byte) error {
+			vertex, err := decodeVertex(vbytes)
+			if err != nil {
+				return err
+			}
+
+			return fn(vertex)
+		})
+	})
+}
+
+func (backend *BoltStorage) ScanEdges(fn func(blend.Edge) error) error {
+	return backend.store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("edge")).ForEach(func(k, ebytes []byte) error {
+			edge, err := decodeEdge(ebytes)
+			if err != nil {
+				return err
+			}
+
+			return fn(edge)
+		})
+	})
 }
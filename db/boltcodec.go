@@ -0,0 +1,162 @@
+// binary records of the bolt backend
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ziahamza/blend"
+)
+
+// Vertices and edges are stored as a record version byte followed by their
+// fields, strings prefixed by their length and times as nanoseconds since
+// the epoch, both as varints. New fields go at the end under a new record
+// version, decoders keep reading every older version.
+const recordVersion = 1
+
+type recordWriter struct {
+	buf []byte
+}
+
+func (w *recordWriter) string(s string) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// the zero time is kept apart, its nanoseconds do not fit into an int64
+func (w *recordWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.buf = append(w.buf, 0)
+		return
+	}
+
+	w.buf = append(w.buf, 1)
+	w.buf = binary.AppendVarint(w.buf, t.UnixNano())
+}
+
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+var errShortRecord = errors.New("Record ends before all of its fields")
+
+func (r *recordReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+
+	n, size := binary.Uvarint(r.buf)
+	if size <= 0 || uint64(len(r.buf)-size) < n {
+		r.err = errShortRecord
+		return ""
+	}
+
+	s := string(r.buf[size : size+int(n)])
+	r.buf = r.buf[size+int(n):]
+
+	return s
+}
+
+func (r *recordReader) time() time.Time {
+	if r.err != nil {
+		return time.Time{}
+	}
+
+	if len(r.buf) == 0 {
+		r.err = errShortRecord
+		return time.Time{}
+	}
+
+	set := r.buf[0]
+	r.buf = r.buf[1:]
+
+	if set == 0 {
+		return time.Time{}
+	}
+
+	nanos, size := binary.Varint(r.buf)
+	if size <= 0 {
+		r.err = errShortRecord
+		return time.Time{}
+	}
+
+	r.buf = r.buf[size:]
+
+	return time.Unix(0, nanos)
+}
+
+// checks the version byte the record starts with
+func newRecordReader(buf []byte) *recordReader {
+	if len(buf) == 0 {
+		return &recordReader{err: errShortRecord}
+	}
+
+	if buf[0] != recordVersion {
+		return &recordReader{err: fmt.Errorf("Unknown record version %d", buf[0])}
+	}
+
+	return &recordReader{buf: buf[1:]}
+}
+
+func encodeVertex(v blend.Vertex) []byte {
+	w := &recordWriter{buf: []byte{recordVersion}}
+
+	w.string(v.Id)
+	w.time(v.LastChanged)
+	w.string(v.Name)
+	w.string(v.Type)
+	w.string(v.Public)
+	w.string(v.Private)
+	w.string(v.PrivateKey)
+
+	return w.buf
+}
+
+func decodeVertex(buf []byte) (blend.Vertex, error) {
+	r := newRecordReader(buf)
+
+	v := blend.Vertex{
+		Id:          r.string(),
+		LastChanged: r.time(),
+		Name:        r.string(),
+		Type:        r.string(),
+		Public:      r.string(),
+		Private:     r.string(),
+		PrivateKey:  r.string(),
+	}
+
+	return v, r.err
+}
+
+func encodeEdge(e blend.Edge) []byte {
+	w := &recordWriter{buf: []byte{recordVersion}}
+
+	w.string(e.LastChanged)
+	w.string(e.Family)
+	w.string(e.Type)
+	w.string(e.Name)
+	w.string(e.From)
+	w.string(e.To)
+	w.string(e.Data)
+
+	return w.buf
+}
+
+func decodeEdge(buf []byte) (blend.Edge, error) {
+	r := newRecordReader(buf)
+
+	e := blend.Edge{
+		LastChanged: r.string(),
+		Family:      r.string(),
+		Type:        r.string(),
+		Name:        r.string(),
+		From:        r.string(),
+		To:          r.string(),
+		Data:        r.string(),
+	}
+
+	return e, r.err
+}
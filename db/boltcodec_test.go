@@ -0,0 +1,217 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+func TestBoltUpgrade(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "json.db")
+
+	// a database as written before the binary records
+	vertex := blend.Vertex{Id: "a", Name: "a", Type: "test", PrivateKey: "key", LastChanged: time.Now()}
+	edge := blend.Edge{Family: "public", Type: "link", Name: "b", From: "a", To: "b", Data: "data"}
+
+	store, err := bolt.Open(file, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		vbytes, _ := json.Marshal(vertex)
+		ebytes, _ := json.Marshal(edge)
+
+		vertices, err := tx.CreateBucket([]byte("vertex"))
+		if err != nil {
+			return err
+		}
+
+		edges, err := tx.CreateBucket([]byte("edge"))
+		if err != nil {
+			return err
+		}
+
+		err = vertices.Put([]byte("a"), vbytes)
+		if err != nil {
+			return err
+		}
+
+		return edges.Put([]byte("a:public:link:b"), ebytes)
+	})
+
+	store.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &BoltStorage{}
+	err = backend.Init(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer backend.Close()
+
+	v := blend.Vertex{Id: "a", PrivateKey: "key"}
+	err = backend.GetVertex(&v)
+	if err != nil || v.Name != "a" || !v.LastChanged.Equal(vertex.LastChanged) {
+		t.Fatal("Got back a different vertex after the upgrade", v, err)
+	}
+
+	edges, err := backend.GetIncomingEdges(blend.Vertex{Id: "b"}, blend.Edge{})
+	if err != nil || len(edges) != 1 || edges[0] != edge {
+		t.Fatal("Got back different edges after the upgrade", edges, err)
+	}
+
+	roots := []string{}
+	err = backend.ScanRoots(func(id string) error {
+		roots = append(roots, id)
+		return nil
+	})
+
+	if err != nil || len(roots) != 1 || roots[0] != "a" {
+		t.Fatal("Vertex without an owner not kept as a root after the upgrade", roots, err)
+	}
+
+	// the edges of a vertex whose id starts with the id and family of
+	// another one stay apart
+	err = backend.storeEdge(blend.Edge{Family: "public", Type: "link", Name: "c", From: "a:public2", To: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edges, err = backend.GetEdges(blend.Vertex{Id: "a"}, blend.Edge{Family: "public"})
+	if err != nil || len(edges) != 1 || edges[0] != edge {
+		t.Fatal("Got back edges of another vertex", edges, err)
+	}
+}
+
+func BenchmarkEdgeDecoding(b *testing.B) {
+	edge := blend.Edge{
+		LastChanged: time.Now().Format(time.RFC3339Nano),
+		Family:      "public", Type: "link", Name: "a benchmark edge",
+		From: "8a8c5ad4-b8e5-4c0b-6ebb-f2bcd93a2b5c", To: "e05f11dd-06e6-4490-5987-27e17e0e347d",
+		Data: "some data on the edge",
+	}
+
+	b.Run("json", func(b *testing.B) {
+		ebytes, _ := json.Marshal(edge)
+
+		for i := 0; i < b.N; i++ {
+			e := blend.Edge{}
+			json.Unmarshal(ebytes, &e)
+		}
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		ebytes := encodeEdge(edge)
+
+		for i := 0; i < b.N; i++ {
+			decodeEdge(ebytes)
+		}
+	})
+}
+
+// reads the same 1000 edges stored as the json the edges were kept in
+// before the binary records and as the binary records
+func BenchmarkBoltGetEdges(b *testing.B) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	backend := &BoltStorage{}
+	err = backend.Init(path.Join(dir, "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer backend.Close()
+
+	source := blend.Vertex{Id: "source"}
+	err = backend.store.Update(func(tx *bolt.Tx) error {
+		jsonEdges, err := tx.CreateBucket([]byte("json edge"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 1000; i++ {
+			edge := blend.Edge{
+				Family: "public", Type: "link", Name: fmt.Sprintf("edge %d", i),
+				From: source.Id, To: fmt.Sprintf("target %d", i), Data: "some data on the edge",
+			}
+
+			err := putEdge(tx, edge)
+			if err != nil {
+				return err
+			}
+
+			ebytes, _ := json.Marshal(edge)
+			err = jsonEdges.Put(edgeKey(edge), ebytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			edges := []blend.Edge{}
+
+			err := backend.store.View(func(tx *bolt.Tx) error {
+				cursor := tx.Bucket([]byte("json edge")).Cursor()
+				prefix := edgePrefix(source, blend.Edge{Family: "public"})
+
+				for k, v := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+					edge := blend.Edge{}
+
+					err := json.Unmarshal(v, &edge)
+					if err != nil {
+						return err
+					}
+
+					edges = append(edges, edge)
+				}
+
+				return nil
+			})
+
+			if err != nil || len(edges) != 1000 {
+				b.Fatal("Got back different edges then expected", len(edges), err)
+			}
+		}
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			edges, err := backend.GetEdges(source, blend.Edge{Family: "public"})
+			if err != nil || len(edges) != 1000 {
+				b.Fatal("Got back different edges then expected", len(edges), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,144 @@
+// upgrades of the on-disk format of the bolt backend
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+// Versions of the layout of the whole database, the one of a database is
+// kept in its meta bucket. Databases without one store their vertices and
+// edges as json. Opening a database applies the upgrades it is missing in
+// order, all in the transaction opening it.
+var boltUpgrades = []struct {
+	Format  byte
+	Upgrade func(*bolt.Tx) error
+}{
+	{1, upgradeJSONRecords},
+	{2, upgradeEdgeKeys},
+}
+
+var boltFormatKey = []byte("format")
+
+func upgradeBoltFormat(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
+	if err != nil {
+		return err
+	}
+
+	var format byte
+	if f := meta.Get(boltFormatKey); f != nil {
+		format = f[0]
+	}
+
+	latest := boltUpgrades[len(boltUpgrades)-1].Format
+	if format > latest {
+		return fmt.Errorf("Database format %d is newer than this version supports", format)
+	}
+
+	for _, u := range boltUpgrades {
+		if u.Format <= format {
+			continue
+		}
+
+		err = u.Upgrade(tx)
+		if err != nil {
+			return fmt.Errorf("Cannot upgrade database to format %d: %s", u.Format, err.Error())
+		}
+	}
+
+	return meta.Put(boltFormatKey, []byte{latest})
+}
+
+// rewrites the json vertices and edges as binary records
+func upgradeJSONRecords(tx *bolt.Tx) error {
+	err := recodeBucket(tx.Bucket([]byte("vertex")), func(vbytes []byte) ([]byte, error) {
+		vertex := blend.Vertex{}
+		err := json.Unmarshal(vbytes, &vertex)
+		return encodeVertex(vertex), err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return recodeBucket(tx.Bucket([]byte("edge")), func(ebytes []byte) ([]byte, error) {
+		edge := blend.Edge{}
+		err := json.Unmarshal(ebytes, &edge)
+		return encodeEdge(edge), err
+	})
+}
+
+func recodeBucket(bucket *bolt.Bucket, recode func([]byte) ([]byte, error)) error {
+	records := map[string][]byte{}
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		record, err := recode(v)
+		if err != nil {
+			return fmt.Errorf("Cannot upgrade record %s: %s", k, err.Error())
+		}
+
+		records[string(k)] = record
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// bolt does not allow changing a bucket while iterating it
+	for k, record := range records {
+		err = bucket.Put([]byte(k), record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Edges used to be keyed by their ids and names joined with colons, which
+// mixed up the edges of a vertex with those of any vertex whose id starts
+// with its id and a colon. Moves every edge and incoming index entry to
+// the length prefixed keys.
+func upgradeEdgeKeys(tx *bolt.Tx) error {
+	edges := []blend.Edge{}
+
+	err := tx.Bucket([]byte("edge")).ForEach(func(k, ebytes []byte) error {
+		edge, err := decodeEdge(ebytes)
+		if err != nil {
+			return fmt.Errorf("Cannot upgrade edge %s: %s", k, err.Error())
+		}
+
+		edges = append(edges, edge)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"edge", "incoming"} {
+		err = tx.DeleteBucket([]byte(name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, edge := range edges {
+		err = putEdge(tx, edge)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,137 +3,98 @@ package db
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/ziahamza/blend"
 
 	"github.com/gocql/gocql"
 )
 
+func init() {
+	Register("cassandra", func() Storage { return &CassandraStorage{} })
+}
+
 type CassandraStorage struct {
-	session *gocql.Session
+	session cqlSession
+	opts    CassandraOptions
+
+	// opens sessions on the cluster, connects with gocql if nil
+	connect func(keyspace string) (cqlSession, error)
 }
 
+// The uri is either a comma separated list of hosts or a cassandra:// url
+// with the keyspace, replication and consistency options, see
+// ParseCassandraURI
 func (backend *CassandraStorage) Init(cqlurl string) error {
 	var err error
 
-	if len(cqlurl) == 0 {
-		cqlurl = "localhost"
-	}
-
-	fmt.Printf("using cassandra cluster at IP=%s\n", cqlurl)
-
-	// connect to the cluster
-	cluster := gocql.NewCluster(cqlurl)
-	cluster.Consistency = gocql.Quorum
-	session, err := cluster.CreateSession()
-
+	backend.opts, err = ParseCassandraURI(cqlurl)
 	if err != nil {
 		return err
 	}
 
-	err = session.Query(`
-		CREATE KEYSPACE graph WITH replication = {
-			'class' : 'SimpleStrategy',
-			'replication_factor' : 2
-		}
-	`).Consistency(gocql.All).Exec()
-
-	session.Close()
+	opts := backend.opts
 
-	refreshDb := false
-	if err != nil {
-		fmt.Printf("graph keyspace already created: %s\n", err.Error())
-	} else {
-		fmt.Printf("Keyspace 'graph' created. \n")
-
-		// newly created keyspace ... drop the database
-		refreshDb = true
+	if backend.connect == nil {
+		backend.connect = opts.connect
 	}
 
-	cluster.Keyspace = "graph"
-	backend.session, err = cluster.CreateSession()
+	fmt.Printf("using cassandra cluster at %s\n", strings.Join(opts.Hosts, ","))
 
-	if err != nil && refreshDb {
-		backend.Drop()
+	// connect to the cluster
+	session, err := backend.connect("")
+	if err != nil {
+		return err
 	}
 
-	return err
-}
+	err = session.Query(fmt.Sprintf(
+		"CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s", opts.Keyspace, opts.replication(),
+	)).Consistency(gocql.All).Exec()
 
-func (backend *CassandraStorage) Close() {
-	backend.session.Close()
-}
+	session.Close()
 
-func (backend *CassandraStorage) Drop() error {
-	// drop vertices table for development
-	err := backend.session.Query("DROP TABLE vertices;").Exec()
 	if err != nil {
-		fmt.Println("Cannot drop vertices table: ", err.Error())
+		return err
 	}
 
-	// drop vertices table for development
-	err = backend.session.Query("DROP TABLE edges;").Exec()
+	backend.session, err = backend.connect(opts.Keyspace)
 	if err != nil {
-		fmt.Println("Cannot drop edges table: ", err.Error())
+		return err
 	}
 
-	// initialize vertices table
-	err = backend.session.Query(
-		`CREATE TABLE vertices (
-			edge_family varchar,
-			edge_type varchar,
-			edge_name varchar,
-			from_vertex_id varchar,
-
-			public_data varchar static,
-			private_data varchar static,
-			private_key varchar static,
-
-			vertex_type varchar static,
-			vertex_name varchar static,
-
-			last_changed timeuuid static,
-
-			vertex_id varchar,
-			PRIMARY KEY (vertex_id, edge_family, edge_type, edge_name, from_vertex_id)
-		);`,
-	).Exec()
-
+	err = backend.Migrate()
 	if err != nil {
-		fmt.Println("Canoot create a new table called vertex ... ", err.Error())
+		backend.session.Close()
 		return err
 	}
 
-	// initialize edges table
-	err = backend.session.Query(
-		`CREATE TABLE edges (
-			edge_family varchar,
-			edge_type varchar,
-			edge_name varchar,
-			edge_data varchar,
-			from_vertex_id varchar,
-			to_vertex_id varchar,
-
-			last_changed timeuuid static,
+	return nil
+}
 
-			PRIMARY KEY (from_vertex_id, edge_family, edge_type, edge_name, to_vertex_id)
-		);`,
-	).Exec()
+func (backend *CassandraStorage) Close() {
+	backend.session.Close()
+}
 
-	if err != nil {
-		fmt.Println("Canoot create a new table called edge ... ", err.Error())
-		return err
+// Deletes everything stored and starts over with the latest schema
+func (backend *CassandraStorage) Drop() error {
+	for _, table := range []string{"vertices", "edges", "schema_version"} {
+		err := backend.session.Query("DROP TABLE IF EXISTS " + table + ";").Exec()
+		if err != nil {
+			fmt.Printf("Cannot drop %s table: %s \n", table, err.Error())
+			return err
+		}
 	}
 
-	return nil
+	return backend.Migrate()
 }
 
 func (backend *CassandraStorage) UpdateVertex(vertex *blend.Vertex) error {
 	err := backend.session.Query(
-		`UPDATE vertices SET vertex_name = ?, vertex_type = ?, public_data = ?, private_data = ?
-		WHERE vertex_id = ? `,
-		vertex.Name, vertex.Type, vertex.Public, &vertex.Private, vertex.Id,
-	).Consistency(gocql.Two).Exec()
+		`UPDATE vertices SET vertex_name = ?, vertex_type = ?, public_data = ?, private_data = ?,
+		changed_at = ? WHERE vertex_id = ? `,
+		vertex.Name, vertex.Type, vertex.Public, &vertex.Private, vertex.LastChanged, vertex.Id,
+	).Consistency(backend.opts.WriteConsistency).Exec()
 
 	if err != nil {
 		return err
@@ -141,7 +102,7 @@ func (backend *CassandraStorage) UpdateVertex(vertex *blend.Vertex) error {
 
 	err = backend.session.Query(
 		`SELECT private_key FROM vertices WHERE vertex_id = ? LIMIT 1;`, vertex.Id,
-	).Consistency(gocql.One).Scan(&vertex.PrivateKey)
+	).Consistency(backend.opts.ReadConsistency).Scan(&vertex.PrivateKey)
 
 	return err
 }
@@ -150,12 +111,12 @@ func (backend *CassandraStorage) GetVertex(vertex *blend.Vertex) error {
 	vkey := vertex.PrivateKey
 	if vkey != "" {
 		err := backend.session.Query(
-			`SELECT vertex_name, vertex_type, public_data, private_data, private_key
+			`SELECT vertex_name, vertex_type, public_data, private_data, private_key, changed_at
 			FROM vertices WHERE vertex_id = ? LIMIT 1;`,
 			vertex.Id,
-		).Consistency(gocql.One).Scan(
+		).Consistency(backend.opts.ReadConsistency).Scan(
 			&vertex.Name, &vertex.Type,
-			&vertex.Public, &vertex.Private, &vertex.PrivateKey,
+			&vertex.Public, &vertex.Private, &vertex.PrivateKey, &vertex.LastChanged,
 		)
 
 		if err != nil {
@@ -168,47 +129,196 @@ func (backend *CassandraStorage) GetVertex(vertex *blend.Vertex) error {
 	}
 
 	return backend.session.Query(
-		`SELECT vertex_name, vertex_type, public_data
+		`SELECT vertex_name, vertex_type, public_data, changed_at
 		FROM vertices WHERE vertex_id = ? LIMIT 1;`,
 		vertex.Id,
-	).Consistency(gocql.One).Scan(
+	).Consistency(backend.opts.ReadConsistency).Scan(
 		&vertex.Name, &vertex.Type,
-		&vertex.Public,
+		&vertex.Public, &vertex.LastChanged,
 	)
 }
 
+// The driver fetches the edges from the cluster a page at a time, so
+// vertices with lots of edges do not have to fit into a single response
 func (backend *CassandraStorage) GetEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
+	iter := backend.edgesQuery(v, e).PageSize(backend.opts.PageSize).Iter()
+
+	edges := readEdges(iter, v.Id)
+
+	err := iter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return edges, nil
+}
+
+// Reads a single page of at most size edges, the page size of the options
+// if size is not positive. An empty state reads the first page, every
+// other page is read with the state returned along with the page before.
+// The state returned is empty after the last page.
+func (backend *CassandraStorage) GetEdgesPage(v blend.Vertex, e blend.Edge, state []byte, size int) ([]blend.Edge, []byte, error) {
+	if size < 1 {
+		size = backend.opts.PageSize
+	}
+
+	iter := backend.edgesQuery(v, e).PageSize(size).PageState(state).Iter()
+
+	edges := readEdges(iter, v.Id)
+	next := iter.PageState()
+
+	err := iter.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return edges, next, nil
+}
+
+// query for the edges of the vertex narrowed down by family, type and
+// name in that order
+func (backend *CassandraStorage) edgesQuery(v blend.Vertex, e blend.Edge) cqlQuery {
+	if e.Family == "" {
+		e.Family = "public"
+	}
+
+	query := `SELECT edge_name, edge_type, edge_family, to_vertex_id, edge_data, edge_changed
+		FROM edges WHERE from_vertex_id = ? AND edge_family = ?`
+	values := []interface{}{v.Id, e.Family}
+
+	if e.Type != "" {
+		query += ` AND edge_type = ?`
+		values = append(values, e.Type)
+
+		if e.Name != "" {
+			query += ` AND edge_name = ?`
+			values = append(values, e.Name)
+		}
+	}
+
+	return backend.session.Query(query+";", values...).Consistency(backend.opts.ReadConsistency)
+}
+
+func readEdges(iter cqlIter, from string) []blend.Edge {
 	edges := []blend.Edge{}
 
-	var iter *gocql.Iter
-	if e.Type == "" {
-		// get all edges by a specific family
-		iter = backend.session.Query(
-			`SELECT edge_name, edge_type, edge_family, to_vertex_id, edge_data
-			FROM edges WHERE from_vertex_id = ? AND edge_family = ?;`,
-			v.Id, e.Family,
-		).Consistency(gocql.One).Iter()
-	} else if e.Name == "" {
-		// get all edges by a specific family and a specific type
-		iter = backend.session.Query(
-			`SELECT edge_name, edge_type, edge_family, to_vertex_id, edge_data
-			FROM edges WHERE from_vertex_id = ? AND edge_family = ? AND edge_type = ?;`,
-			v.Id, e.Family, e.Type,
-		).Consistency(gocql.One).Iter()
-	} else {
-		// get all edges by a specific family, type and name
-		iter = backend.session.Query(
-			`SELECT edge_name, edge_type, edge_family, to_vertex_id, edge_data
-			FROM edges WHERE from_vertex_id = ? AND edge_family = ? AND edge_type = ? AND edge_name = ?;`,
-			v.Id, e.Family, e.Type, e.Name,
-		).Consistency(gocql.One).Iter()
+	var changed gocql.UUID
+
+	edge := blend.Edge{From: from}
+	for iter.Scan(&edge.Name, &edge.Type, &edge.Family, &edge.To, &edge.Data, &changed) {
+		edge.LastChanged = edgeChanged(changed)
+		edges = append(edges, edge)
 	}
 
-	for iter.Scan(&e.Name, &e.Type, &e.Family, &e.To, &e.Data) {
-		edges = append(edges, e)
+	return edges
+}
+
+// empty for edges written before their changes were tracked
+func edgeChanged(changed gocql.UUID) string {
+	if changed == (gocql.UUID{}) {
+		return ""
 	}
 
-	return edges, nil
+	return changed.Time().UTC().Format(time.RFC3339Nano)
+}
+
+// Vertices are scanned a partition at a time across the whole cluster,
+// which is slow on large graphs but fine for backups and offline tools
+func (backend *CassandraStorage) ScanVertices(fn func(blend.Vertex) error) error {
+	iter := backend.session.Query(
+		`SELECT DISTINCT vertex_id, vertex_name, vertex_type, public_data, private_data,
+			private_key, changed_at
+		FROM vertices;`,
+	).Consistency(backend.opts.ReadConsistency).PageSize(backend.opts.PageSize).Iter()
+
+	vertex := blend.Vertex{}
+	for iter.Scan(&vertex.Id, &vertex.Name, &vertex.Type, &vertex.Public, &vertex.Private,
+		&vertex.PrivateKey, &vertex.LastChanged) {
+
+		// partitions only holding edges pointing at a deleted vertex
+		if vertex.Name == "" {
+			continue
+		}
+
+		err := fn(vertex)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	return iter.Close()
+}
+
+func (backend *CassandraStorage) ScanEdges(fn func(blend.Edge) error) error {
+	iter := backend.session.Query(
+		`SELECT from_vertex_id, to_vertex_id, edge_family, edge_type, edge_name, edge_data,
+			edge_changed
+		FROM edges;`,
+	).Consistency(backend.opts.ReadConsistency).PageSize(backend.opts.PageSize).Iter()
+
+	var changed gocql.UUID
+
+	edge := blend.Edge{}
+	for iter.Scan(&edge.From, &edge.To, &edge.Family, &edge.Type, &edge.Name, &edge.Data, &changed) {
+		// partitions left with only their static columns
+		if edge.To == "" {
+			continue
+		}
+
+		edge.LastChanged = edgeChanged(changed)
+
+		err := fn(edge)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	return iter.Close()
+}
+
+func (backend *CassandraStorage) GetIncomingEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
+	edges := []blend.Edge{}
+
+	// incoming edges are kept as clustering rows in the partition of
+	// the vertex they point to
+	query := `SELECT from_vertex_id, edge_family, edge_type, edge_name
+		FROM vertices WHERE vertex_id = ?`
+	values := []interface{}{v.Id}
+
+	if e.Family != "" {
+		query += ` AND edge_family = ?`
+		values = append(values, e.Family)
+
+		if e.Type != "" {
+			query += ` AND edge_type = ?`
+			values = append(values, e.Type)
+
+			if e.Name != "" {
+				query += ` AND edge_name = ?`
+				values = append(values, e.Name)
+			}
+		}
+	}
+
+	iter := backend.session.Query(query+";", values...).
+		Consistency(backend.opts.ReadConsistency).
+		PageSize(backend.opts.PageSize).
+		Iter()
+
+	edge := blend.Edge{To: v.Id}
+	for iter.Scan(&edge.From, &edge.Family, &edge.Type, &edge.Name) {
+		// a vertex without incoming edges still has a row for its
+		// static columns
+		if edge.From == "" {
+			continue
+		}
+
+		edges = append(edges, edge)
+	}
+
+	return edges, iter.Close()
 }
 
 func (backend *CassandraStorage) GetChildVertex(v blend.Vertex, e blend.Edge) (blend.Vertex, error) {
@@ -217,7 +327,7 @@ func (backend *CassandraStorage) GetChildVertex(v blend.Vertex, e blend.Edge) (b
 		`SELECT to_vertex_id
 		FROM edges WHERE from_vertex_id = ? AND edge_family = ? AND edge_type = ? AND edge_name = ?;`,
 		v.Id, e.Family, e.Type, e.Name,
-	).Consistency(gocql.One).Scan(&e.To)
+	).Consistency(backend.opts.ReadConsistency).Scan(&e.To)
 
 	vertex := blend.Vertex{Id: e.To}
 
@@ -231,28 +341,32 @@ func (backend *CassandraStorage) GetChildVertex(v blend.Vertex, e blend.Edge) (b
 
 }
 
+// Conditions in a batch cannot span tables or partitions, writing an
+// edge again simply overwrites it
 func (backend *CassandraStorage) CreateEdge(v, vc blend.Vertex, edge *blend.Edge) error {
 	return backend.session.Query(
 		`BEGIN BATCH
 			INSERT INTO edges (
 				from_vertex_id, to_vertex_id,
 				edge_family, edge_type,
-				edge_name, edge_data)
-			VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS
+				edge_name, edge_data, edge_changed)
+			VALUES (?, ?, ?, ?, ?, ?, now())
 
 			INSERT INTO vertices(
 				vertex_id, from_vertex_id,
 				edge_family, edge_type,
 				edge_name)
-			VALUES (?, ?, ?, ?, ?) IF NOT EXISTS
+			VALUES (?, ?, ?, ?, ?)
 
 		APPLY BATCH;
 		`,
 		v.Id, vc.Id, edge.Family, edge.Type, edge.Name, edge.Data,
 		vc.Id, v.Id, edge.Family, edge.Type, edge.Name,
-	).Consistency(gocql.Two).Exec()
+	).Consistency(backend.opts.WriteConsistency).Exec()
 }
 
+// The ownership edge goes from the parent v to the child vc, with its
+// incoming row kept in the partition of the child
 func (backend *CassandraStorage) CreateChildVertex(v, vc *blend.Vertex, e blend.Edge) error {
 	e.Family = "ownership"
 
@@ -266,72 +380,114 @@ func (backend *CassandraStorage) CreateChildVertex(v, vc *blend.Vertex, e blend.
 	return backend.session.Query(
 		`BEGIN BATCH
 			INSERT INTO vertices (
-				vertex_id, vertex_name, vertex_type, public_data, private_data, private_key
-			) VALUES (?, ?, ?, ?, ?, ?)
+				vertex_id, vertex_name, vertex_type, public_data, private_data, private_key, changed_at
+			) VALUES (?, ?, ?, ?, ?, ?, ?)
 
 			INSERT INTO edges (
 				from_vertex_id, to_vertex_id,
 				edge_family, edge_type,
-				edge_name, edge_data)
-			VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS
+				edge_name, edge_data, edge_changed)
+			VALUES (?, ?, ?, ?, ?, ?, now())
 
 			INSERT INTO vertices(
 				vertex_id, from_vertex_id,
 				edge_family, edge_type,
 				edge_name)
-			VALUES (?, ?, ?, ?, ?) IF NOT EXISTS
+			VALUES (?, ?, ?, ?, ?)
 
 		APPLY BATCH;`,
-		vc.Id, vc.Name, vc.Type, vc.Public, vc.Private, vc.PrivateKey,
-		vc.Id, e.To, e.Family, e.Type, e.Name, e.Data,
-		e.To, vc.Id, e.Family, e.Type, e.Name,
-	).Consistency(gocql.Two).Exec()
+		vc.Id, vc.Name, vc.Type, vc.Public, vc.Private, vc.PrivateKey, vc.LastChanged,
+		v.Id, vc.Id, e.Family, e.Type, e.Name, e.Data,
+		vc.Id, v.Id, e.Family, e.Type, e.Name,
+	).Consistency(backend.opts.WriteConsistency).Exec()
 }
 
 func (backend *CassandraStorage) CreateVertex(vertex *blend.Vertex) error {
 	err := backend.session.Query(
 		`INSERT INTO vertices (
-			vertex_id, vertex_name, vertex_type, public_data, private_data, private_key
-		) VALUES (?, ?, ?, ?, ?, ?);`,
+			vertex_id, vertex_name, vertex_type, public_data, private_data, private_key, changed_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?);`,
 		vertex.Id, vertex.Name, vertex.Type, vertex.Public, vertex.Private, vertex.PrivateKey,
-	).Consistency(gocql.Two).Exec()
+		vertex.LastChanged,
+	).Consistency(backend.opts.WriteConsistency).Exec()
 
 	return err
 }
 
-func (backend *CassandraStorage) DeleteVertex(vertex *blend.Vertex) error {
+func (backend *CassandraStorage) DeleteEdge(edge blend.Edge) error {
 	return backend.session.Query(
 		`BEGIN BATCH
-			DELETE FROM vertices WHERE vertex_id = ?
-			DELETE FROM edges WHERE from_vertex_id = ?
+			DELETE FROM edges WHERE from_vertex_id = ? AND edge_family = ?
+				AND edge_type = ? AND edge_name = ? AND to_vertex_id = ?
+
+			DELETE FROM vertices WHERE vertex_id = ? AND edge_family = ?
+				AND edge_type = ? AND edge_name = ? AND from_vertex_id = ?
 		APPLY BATCH;`,
-		vertex.Id, vertex.Id,
-	).Consistency(gocql.Two).Exec()
+		edge.From, edge.Family, edge.Type, edge.Name, edge.To,
+		edge.To, edge.Family, edge.Type, edge.Name, edge.From,
+	).Consistency(backend.opts.WriteConsistency).Exec()
 }
 
-func (backend *CassandraStorage) DeleteVertexTree(vertices []*blend.Vertex) error {
-	if len(vertices) == 0 {
-		return nil
-	}
+func (backend *CassandraStorage) DeleteVertex(vertex *blend.Vertex) error {
+	_, err := backend.deleteVertex(vertex)
+	return err
+}
 
-	vertex := vertices[0]
-	vertices = vertices[1:]
+// removes the vertex along with its outgoing edges, returns the number
+// of edges removed
+func (backend *CassandraStorage) deleteVertex(vertex *blend.Vertex) (int, error) {
+	// first drop the entries of the outgoing edges from the partitions
+	// of the vertices they point to
+	iter := backend.session.Query(
+		`SELECT to_vertex_id, edge_family, edge_type, edge_name
+		FROM edges WHERE from_vertex_id = ?;`,
+		vertex.Id,
+	).Consistency(backend.opts.ReadConsistency).PageSize(backend.opts.PageSize).Iter()
 
-	backEdges, err := backend.GetEdges(*vertex, blend.Edge{Family: "ownership"})
+	count := 0
+	edge := blend.Edge{From: vertex.Id}
+	for iter.Scan(&edge.To, &edge.Family, &edge.Type, &edge.Name) {
+		err := backend.session.Query(
+			`DELETE FROM vertices WHERE vertex_id = ? AND edge_family = ?
+				AND edge_type = ? AND edge_name = ? AND from_vertex_id = ?;`,
+			edge.To, edge.Family, edge.Type, edge.Name, edge.From,
+		).Consistency(backend.opts.WriteConsistency).Exec()
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
 
-	// Breadth first deletion
-	for _, edge := range backEdges {
-		vertices = append(vertices, &blend.Vertex{Id: edge.To})
+		count++
 	}
-	err = backend.DeleteVertexTree(vertices)
 
+	err := iter.Close()
 	if err != nil {
-		return err
+		return count, err
 	}
 
-	return backend.DeleteVertex(vertex)
+	return count, backend.session.Query(
+		`BEGIN BATCH
+			DELETE FROM vertices WHERE vertex_id = ?
+			DELETE FROM edges WHERE from_vertex_id = ?
+		APPLY BATCH;`,
+		vertex.Id, vertex.Id,
+	).Consistency(backend.opts.WriteConsistency).Exec()
+}
+
+// Cassandra has no transactions across partitions, every vertex is
+// deleted on its own
+func (backend *CassandraStorage) DeleteVertices(vertices []*blend.Vertex) (int, error) {
+	edges := 0
+
+	for _, vertex := range vertices {
+		count, err := backend.deleteVertex(vertex)
+		edges += count
+
+		if err != nil {
+			return edges, err
+		}
+	}
+
+	return edges, nil
 }
@@ -0,0 +1,55 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/ziahamza/blend/db"
+)
+
+func TestParseCassandraURI(t *testing.T) {
+	opts, err := db.ParseCassandraURI("10.0.0.1,10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(opts.Hosts) != 2 || opts.Keyspace != "graph" || opts.ReplicationFactor != 2 {
+		t.Fatal("Got back different options then expected", opts)
+	}
+
+	opts, err = db.ParseCassandraURI("cassandra://blend:secret@a:9042,b:9042/teams" +
+		"?replication=east:3,west:2&read_consistency=local_quorum&write_consistency=each_quorum&ca=/ca.pem")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(opts.Hosts) != 2 || opts.Hosts[1] != "b:9042" || opts.Keyspace != "teams" {
+		t.Fatal("Got back different hosts or keyspace then expected", opts)
+	}
+
+	if opts.DataCenters["east"] != 3 || opts.DataCenters["west"] != 2 {
+		t.Fatal("Got back different replication then expected", opts.DataCenters)
+	}
+
+	if opts.ReadConsistency != gocql.LocalQuorum || opts.WriteConsistency != gocql.EachQuorum {
+		t.Fatal("Got back different consistency then expected", opts)
+	}
+
+	if opts.Username != "blend" || opts.Password != "secret" || !opts.TLS {
+		t.Fatal("Got back different credentials then expected", opts)
+	}
+
+	for _, uri := range []string{
+		"cassandra://a/graph;drop",
+		"cassandra://a/graph?replication=east",
+		"cassandra://a/graph?read_consistency=most",
+		"cassandra://a/graph?unknown=1",
+	} {
+		_, err = db.ParseCassandraURI(uri)
+		if err == nil {
+			t.Error("Parsed an invalid uri", uri)
+			return
+		}
+	}
+}
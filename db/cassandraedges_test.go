@@ -0,0 +1,217 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/ziahamza/blend"
+)
+
+// session answering every query with the rows of the next scripted page,
+// keeping the queries it was asked
+type scriptedSession struct {
+	pages   []scriptedPage
+	queries []*scriptedQuery
+}
+
+type scriptedPage struct {
+	rows  [][]interface{}
+	state []byte
+	err   error
+}
+
+type scriptedQuery struct {
+	session *scriptedSession
+
+	stmt   string
+	values []interface{}
+
+	pageSize  int
+	pageState []byte
+	paged     bool
+}
+
+func (s *scriptedSession) Query(stmt string, values ...interface{}) cqlQuery {
+	q := &scriptedQuery{session: s, stmt: stmt, values: values}
+	s.queries = append(s.queries, q)
+	return q
+}
+
+func (s *scriptedSession) Close() {}
+
+func (q *scriptedQuery) Consistency(gocql.Consistency) cqlQuery { return q }
+
+func (q *scriptedQuery) PageSize(n int) cqlQuery {
+	q.pageSize = n
+	return q
+}
+
+func (q *scriptedQuery) PageState(state []byte) cqlQuery {
+	q.pageState = state
+	q.paged = true
+	return q
+}
+
+func (q *scriptedQuery) Exec() error                    { return errors.New("Not scripted") }
+func (q *scriptedQuery) Scan(dest ...interface{}) error { return errors.New("Not scripted") }
+
+func (q *scriptedQuery) MapScanCAS(map[string]interface{}) (bool, error) {
+	return false, errors.New("Not scripted")
+}
+
+func (q *scriptedQuery) Iter() cqlIter {
+	if len(q.session.pages) == 0 {
+		return &scriptedIter{}
+	}
+
+	page := q.session.pages[0]
+	q.session.pages = q.session.pages[1:]
+
+	return &scriptedIter{page: page}
+}
+
+type scriptedIter struct {
+	page scriptedPage
+}
+
+func (it *scriptedIter) Scan(dest ...interface{}) bool {
+	if len(it.page.rows) == 0 {
+		return false
+	}
+
+	for i, value := range it.page.rows[0] {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+
+	it.page.rows = it.page.rows[1:]
+	return true
+}
+
+func (it *scriptedIter) PageState() []byte { return it.page.state }
+func (it *scriptedIter) Close() error      { return it.page.err }
+
+func edgeRow(name, to string, changed gocql.UUID) []interface{} {
+	return []interface{}{name, "link", "public", to, "data", changed}
+}
+
+func TestCassandraGetEdges(t *testing.T) {
+	changed := gocql.UUIDFromTime(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	session := &scriptedSession{pages: []scriptedPage{
+		{rows: [][]interface{}{edgeRow("a", "to-a", changed), edgeRow("b", "to-b", gocql.UUID{})}},
+	}}
+
+	opts := DefaultCassandraOptions()
+	storage := &CassandraStorage{session: session, opts: opts}
+
+	edges, err := storage.GetEdges(blend.Vertex{Id: "from"}, blend.Edge{Type: "link", Name: "a"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	expected := []blend.Edge{
+		{Family: "public", Type: "link", Name: "a", From: "from", To: "to-a", Data: "data", LastChanged: "2020-01-02T03:04:05Z"},
+		// written before the changes of edges were tracked
+		{Family: "public", Type: "link", Name: "b", From: "from", To: "to-b", Data: "data"},
+	}
+
+	if !reflect.DeepEqual(edges, expected) {
+		t.Error("Got back different edges then expected", edges)
+		return
+	}
+
+	q := session.queries[0]
+	if !strings.HasSuffix(q.stmt, "AND edge_type = ? AND edge_name = ?;") ||
+		!reflect.DeepEqual(q.values, []interface{}{"from", "public", "link", "a"}) {
+		t.Error("Got back a different query then expected", q.stmt, q.values)
+		return
+	}
+
+	// every edge is read at once, the driver fetches the pages
+	if q.pageSize != opts.PageSize || q.paged {
+		t.Error("Got back a different paging then expected", q.pageSize, q.paged)
+		return
+	}
+
+	// a name is only used along with a type
+	_, err = storage.GetEdges(blend.Vertex{Id: "from"}, blend.Edge{Family: "private", Name: "a"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	q = session.queries[1]
+	if !strings.HasSuffix(q.stmt, "edge_family = ?;") || !reflect.DeepEqual(q.values, []interface{}{"from", "private"}) {
+		t.Error("Got back a different query then expected", q.stmt, q.values)
+		return
+	}
+
+	session.pages = []scriptedPage{
+		{rows: [][]interface{}{edgeRow("a", "to-a", changed)}, err: errors.New("Read failed")},
+	}
+
+	edges, err = storage.GetEdges(blend.Vertex{Id: "from"}, blend.Edge{})
+	if err == nil || edges != nil {
+		t.Error("Failing read did not fail", edges)
+	}
+}
+
+func TestCassandraGetEdgesPage(t *testing.T) {
+	session := &scriptedSession{pages: []scriptedPage{
+		{rows: [][]interface{}{edgeRow("a", "to-a", gocql.UUID{}), edgeRow("b", "to-b", gocql.UUID{})}, state: []byte("b")},
+		{rows: [][]interface{}{edgeRow("c", "to-c", gocql.UUID{})}},
+	}}
+
+	storage := &CassandraStorage{session: session, opts: DefaultCassandraOptions()}
+
+	names := []string{}
+	var state []byte
+
+	for page := 0; page == 0 || len(state) > 0; page++ {
+		if page == 2 {
+			t.Error("Paging did not stop after the last page")
+			return
+		}
+
+		edges, next, err := storage.GetEdgesPage(blend.Vertex{Id: "from"}, blend.Edge{}, state, 2)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		q := session.queries[page]
+		if !q.paged || q.pageSize != 2 || string(q.pageState) != string(state) {
+			t.Error("Got back a different page query then expected", q.pageSize, q.pageState, state)
+			return
+		}
+
+		for _, e := range edges {
+			names = append(names, e.Name)
+		}
+
+		state = next
+	}
+
+	if !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Error("Got back different pages then expected", names)
+		return
+	}
+
+	// without a size the page size of the options is used
+	session.pages = []scriptedPage{{err: errors.New("Read failed")}}
+
+	edges, next, err := storage.GetEdgesPage(blend.Vertex{Id: "from"}, blend.Edge{}, []byte("b"), 0)
+	if err == nil || edges != nil || next != nil {
+		t.Error("Failing page did not fail", edges, next)
+		return
+	}
+
+	if q := session.queries[2]; q.pageSize != storage.opts.PageSize {
+		t.Error("Got back a different page size then expected", q.pageSize)
+	}
+}
@@ -0,0 +1,362 @@
+// versioned schema of the cassandra backend
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/nu7hatch/gouuid"
+)
+
+// A step in the evolution of the schema. Steps are applied in order of
+// their versions and each one exactly once, so released steps must never
+// change. Statements run first, then the backfill if there is one. A step
+// failing half way is run again in full, so both have to cope with the
+// part that was applied before.
+type cassandraMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+	Backfill    func(*CassandraStorage) error
+}
+
+var cassandraMigrations = []cassandraMigration{
+	{
+		Version:     1,
+		Description: "vertices and edges tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS vertices (
+				edge_family varchar,
+				edge_type varchar,
+				edge_name varchar,
+				from_vertex_id varchar,
+
+				public_data varchar static,
+				private_data varchar static,
+				private_key varchar static,
+
+				vertex_type varchar static,
+				vertex_name varchar static,
+
+				last_changed timeuuid static,
+
+				vertex_id varchar,
+				PRIMARY KEY (vertex_id, edge_family, edge_type, edge_name, from_vertex_id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS edges (
+				edge_family varchar,
+				edge_type varchar,
+				edge_name varchar,
+				edge_data varchar,
+				from_vertex_id varchar,
+				to_vertex_id varchar,
+
+				last_changed timeuuid static,
+
+				PRIMARY KEY (from_vertex_id, edge_family, edge_type, edge_name, to_vertex_id)
+			);`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "time of the last change of every vertex",
+		Statements: []string{
+			`ALTER TABLE vertices ADD changed_at timestamp static;`,
+		},
+		Backfill: backfillChangedAt,
+	},
+	{
+		Version:     3,
+		Description: "time every edge was written",
+		Statements: []string{
+			`ALTER TABLE edges ADD edge_changed timeuuid;`,
+		},
+	},
+}
+
+// version reserved for the row locking the schema during migrations
+const schemaLockVersion = 0
+
+// how long a crashed migration keeps others from migrating, a running
+// one renews the lock well before it expires
+var (
+	schemaLockTTL     = 10 * time.Minute
+	schemaLockRenewal = time.Minute
+)
+
+// Brings the schema up to the latest version without touching the data
+// already stored. Migrations are serialized across every node sharing the
+// keyspace, nodes starting up together wait for the first one.
+func (backend *CassandraStorage) Migrate() error {
+	err := backend.session.Query(
+		`CREATE TABLE IF NOT EXISTS schema_version (
+			version int PRIMARY KEY,
+			description varchar,
+			applied timestamp
+		);`,
+	).Consistency(gocql.All).Exec()
+
+	if err != nil {
+		return err
+	}
+
+	lease, err := backend.lockSchema()
+	if err != nil {
+		return err
+	}
+
+	defer lease.release()
+
+	current, err := backend.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range cassandraMigrations {
+		if m.Version <= current {
+			continue
+		}
+
+		fmt.Printf("Migrating cassandra schema to version %d: %s \n", m.Version, m.Description)
+
+		for _, stmt := range m.Statements {
+			err = lease.check()
+			if err == nil {
+				err = backend.session.Query(stmt).Consistency(gocql.All).Exec()
+			}
+
+			if err != nil && !columnExists(err) {
+				return fmt.Errorf("Schema migration %d failed: %s", m.Version, err.Error())
+			}
+		}
+
+		err = lease.check()
+		if err == nil && m.Backfill != nil {
+			err = m.Backfill(backend)
+		}
+
+		if err == nil {
+			err = lease.check()
+		}
+
+		if err != nil {
+			return fmt.Errorf("Schema migration %d failed: %s", m.Version, err.Error())
+		}
+
+		err = backend.session.Query(
+			`INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?);`,
+			m.Version, m.Description, time.Now(),
+		).Consistency(backend.opts.WriteConsistency).Exec()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adding a column is not idempotent, a step that failed after adding its
+// columns finds them in place when it is run again
+func columnExists(err error) bool {
+	return strings.Contains(err.Error(), "conflicts with an existing column")
+}
+
+// The lock on the schema held by a running migration, renewed in the
+// background until it is released. The description of the lock row names
+// the node holding it.
+type schemaLease struct {
+	backend *CassandraStorage
+	owner   string
+	done    chan bool
+
+	ttl, renewal time.Duration
+
+	sync.Mutex
+	expires time.Time
+
+	// taken over by another node after it expired
+	lost bool
+}
+
+// Waits until no other node is migrating the schema and locks it. Nodes
+// keep waiting as long as the migration holding the lock renews it, and
+// take it over once it expired.
+func (backend *CassandraStorage) lockSchema() (*schemaLease, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &schemaLease{
+		backend: backend,
+		owner:   "migration lock " + id.String(),
+		done:    make(chan bool),
+		ttl:     schemaLockTTL,
+		renewal: schemaLockRenewal,
+	}
+
+	deadline := time.Now().Add(lease.ttl)
+	var renewed time.Time
+
+	for {
+		now := time.Now()
+
+		applied, err := backend.session.Query(
+			`INSERT INTO schema_version (version, description, applied)
+			VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?;`,
+			schemaLockVersion, lease.owner, now, int(lease.ttl.Seconds()),
+		).Consistency(backend.opts.WriteConsistency).MapScanCAS(map[string]interface{}{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if applied {
+			lease.expires = now.Add(lease.ttl)
+			go lease.renew()
+
+			return lease, nil
+		}
+
+		var held time.Time
+		err = backend.session.Query(
+			`SELECT applied FROM schema_version WHERE version = ?;`, schemaLockVersion,
+		).Consistency(backend.opts.ReadConsistency).Scan(&held)
+
+		if err != nil && err != gocql.ErrNotFound {
+			return nil, err
+		}
+
+		// the lock expires at the latest a ttl after it was last renewed
+		if held.After(renewed) {
+			renewed = held
+			deadline = time.Now().Add(lease.ttl)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timed out waiting for another schema migration to finish")
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// Renewing writes every column of the lock row, so none of them expires
+// before the renewed ttl
+func (lease *schemaLease) renew() {
+	ticker := time.NewTicker(lease.renewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-lease.done:
+			return
+		}
+
+		now := time.Now()
+
+		applied, err := lease.backend.session.Query(
+			`UPDATE schema_version USING TTL ? SET description = ?, applied = ?
+			WHERE version = ? IF description = ?;`,
+			int(lease.ttl.Seconds()), lease.owner, now, schemaLockVersion, lease.owner,
+		).Consistency(lease.backend.opts.WriteConsistency).MapScanCAS(map[string]interface{}{})
+
+		lease.Lock()
+
+		// failed renewals are tried again until the lock expires
+		if err == nil && applied {
+			lease.expires = now.Add(lease.ttl)
+		} else if err == nil {
+			lease.lost = true
+		}
+
+		lost := lease.lost
+		lease.Unlock()
+
+		if lost {
+			return
+		}
+	}
+}
+
+// fails once the lock might be held by another node, which stops the
+// migration before its next step
+func (lease *schemaLease) check() error {
+	lease.Lock()
+	defer lease.Unlock()
+
+	if lease.lost || time.Now().After(lease.expires) {
+		return errors.New("Lost the schema migration lock to another node")
+	}
+
+	return nil
+}
+
+// The lock was taken with a lightweight transaction, releasing it without
+// one could get lost against the paxos state of the row. A lock taken over
+// by another node is left to it.
+func (lease *schemaLease) release() {
+	close(lease.done)
+
+	lease.backend.session.Query(
+		`DELETE FROM schema_version WHERE version = ? IF description = ?;`, schemaLockVersion, lease.owner,
+	).Consistency(lease.backend.opts.WriteConsistency).MapScanCAS(map[string]interface{}{})
+}
+
+// The latest migration applied to the keyspace, zero if none is
+func (backend *CassandraStorage) SchemaVersion() (int, error) {
+	current := 0
+
+	iter := backend.session.Query(
+		`SELECT version FROM schema_version;`,
+	).Consistency(backend.opts.ReadConsistency).Iter()
+
+	var version int
+	for iter.Scan(&version) {
+		if version > current {
+			current = version
+		}
+	}
+
+	return current, iter.Close()
+}
+
+// vertices written before their changes were tracked are assumed to
+// have changed when the schema was migrated, the ones already having a
+// time are kept as they are
+func backfillChangedAt(backend *CassandraStorage) error {
+	now := time.Now()
+
+	iter := backend.session.Query(
+		`SELECT DISTINCT vertex_id, vertex_name, changed_at FROM vertices;`,
+	).Consistency(backend.opts.ReadConsistency).Iter()
+
+	var (
+		id, name string
+		changed  time.Time
+	)
+
+	for iter.Scan(&id, &name, &changed) {
+		// partitions only holding edges pointing at a deleted vertex
+		if name == "" || !changed.IsZero() {
+			continue
+		}
+
+		err := backend.session.Query(
+			`UPDATE vertices SET changed_at = ? WHERE vertex_id = ?;`, now, id,
+		).Consistency(backend.opts.WriteConsistency).Exec()
+
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	return iter.Close()
+}
@@ -0,0 +1,329 @@
+// ordered log of every change committed to the graph
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+// How long the changelog keeps changes. Zero values keep changes forever.
+type ChangelogOptions struct {
+	// number of the latest changes kept
+	MaxChanges int
+
+	// age after which changes are dropped
+	MaxAge time.Duration
+}
+
+// changes buffered per subscriber, subscribers falling further behind
+// are dropped so they can resume from the log instead
+const changeSubscriberBuffer = 256
+
+// changes appended between applying the retention
+const changelogPruneInterval = 100
+
+type changeLog struct {
+	sync.Mutex
+
+	store *bolt.DB
+	opts  ChangelogOptions
+
+	subscribers []chan blend.Change
+	appended    int
+}
+
+// nil while the changelog is disabled
+var changelog *changeLog
+
+// Starts logging every change to the graph in the bolt database at the
+// path, independent of the storage backend. Not safe to call concurrently
+// with changes, meant to be called on startup.
+func OpenChangelog(path string, opts ChangelogOptions) error {
+	store, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	cl := &changeLog{store: store, opts: opts}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("changes"))
+		if err != nil {
+			return err
+		}
+
+		return cl.prune(bucket)
+	})
+
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	changelog = cl
+
+	return nil
+}
+
+// Stops logging changes, subscribers are dropped
+func CloseChangelog() {
+	cl := changelog
+	if cl == nil {
+		return
+	}
+
+	changelog = nil
+
+	cl.Lock()
+	defer cl.Unlock()
+
+	for _, ch := range cl.subscribers {
+		close(ch)
+	}
+
+	cl.subscribers = nil
+	cl.store.Close()
+}
+
+// Changes after the sequence number in order, at most limit of them if
+// limit is positive. Changes dropped by the retention are skipped.
+func Changes(since uint64, limit int) ([]blend.Change, error) {
+	cl := changelog
+	if cl == nil {
+		return nil, errors.New("Changelog not enabled")
+	}
+
+	changes := []blend.Change{}
+
+	err := cl.store.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte("changes")).Cursor()
+
+		for k, v := cursor.Seek(sequenceKey(since + 1)); k != nil; k, v = cursor.Next() {
+			if limit > 0 && len(changes) >= limit {
+				break
+			}
+
+			change := blend.Change{}
+			err := json.Unmarshal(v, &change)
+			if err != nil {
+				return err
+			}
+
+			changes = append(changes, change)
+		}
+
+		return nil
+	})
+
+	return changes, err
+}
+
+// Delivers every change appended from now on in order. The channel is
+// closed if the subscriber falls too far behind or the changelog closes,
+// the changes after the last one received can then be read with Changes.
+func SubscribeChanges() (chan blend.Change, error) {
+	cl := changelog
+	if cl == nil {
+		return nil, errors.New("Changelog not enabled")
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+
+	ch := make(chan blend.Change, changeSubscriberBuffer)
+	cl.subscribers = append(cl.subscribers, ch)
+
+	return ch, nil
+}
+
+func UnsubscribeChanges(ch chan blend.Change) {
+	cl := changelog
+	if cl == nil {
+		return
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+
+	cl.drop(ch)
+}
+
+func (cl *changeLog) drop(ch chan blend.Change) {
+	for i, sub := range cl.subscribers {
+		if sub == ch {
+			cl.subscribers = append(cl.subscribers[:i], cl.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// held by a write while changes are tracked, from reading what it is about
+// to change until its changes are recorded, so the log and the revisions
+// follow the order the backend committed the writes in
+var changeLock sync.Mutex
+
+// Serializes the write about to be made with every other one while changes
+// are tracked. Returns the function releasing it.
+func trackChanges() func() {
+	if !changesTracked() {
+		return func() {}
+	}
+
+	changeLock.Lock()
+
+	return changeLock.Unlock
+}
+
+// Appends a committed change to the log and keeps the revisions it made.
+// The change already happened, so failing to log it is only reported.
+// Has to be called by the write that made the change before it releases
+// trackChanges.
+func recordChange(change blend.Change) {
+	change.Time = time.Now()
+	recordRevision(change)
+
+	cl := changelog
+	if cl == nil {
+		return
+	}
+
+	change.VertexBefore = publicVertex(change.VertexBefore)
+	change.VertexAfter = publicVertex(change.VertexAfter)
+
+	err := cl.append(&change)
+	if err != nil {
+		fmt.Printf("Cannot log %s change: %s \n", change.Type, err.Error())
+	}
+}
+
+func publicVertex(v *blend.Vertex) *blend.Vertex {
+	if v == nil {
+		return nil
+	}
+
+	public := *v
+	public.Private = ""
+	public.PrivateKey = ""
+
+	return &public
+}
+
+func (cl *changeLog) append(change *blend.Change) error {
+	// sequence numbers are handed out in the order subscribers see them
+	cl.Lock()
+	defer cl.Unlock()
+
+	err := cl.store.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("changes"))
+
+		var err error
+		change.Seq, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		cbytes, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put(sequenceKey(change.Seq), cbytes)
+		if err != nil {
+			return err
+		}
+
+		cl.appended++
+		if cl.appended%changelogPruneInterval == 0 {
+			return cl.prune(bucket)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range append([]chan blend.Change{}, cl.subscribers...) {
+		select {
+		case ch <- *change:
+		default:
+			cl.drop(ch)
+		}
+	}
+
+	return nil
+}
+
+// drops the oldest changes beyond the retention
+func (cl *changeLog) prune(bucket *bolt.Bucket) error {
+	last := bucket.Sequence()
+	cutoff := time.Now().Add(-cl.opts.MaxAge)
+
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.First() {
+		seq := binary.BigEndian.Uint64(k)
+
+		expired := cl.opts.MaxChanges > 0 && last-seq >= uint64(cl.opts.MaxChanges)
+		if !expired && cl.opts.MaxAge > 0 {
+			change := blend.Change{}
+			err := json.Unmarshal(v, &change)
+			if err != nil {
+				return err
+			}
+
+			expired = change.Time.Before(cutoff)
+		}
+
+		if !expired {
+			return nil
+		}
+
+		err := bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// edge families a vertex can have outgoing edges of
+var edgeFamilies = []string{"ownership", "private", "public", "event"}
+
+// Logs the deletion of the vertices with their outgoing edges. Reads
+// them before they are deleted, only while changes are tracked.
+func deletedVertices(vertices []*blend.Vertex) []blend.Change {
+	if !changesTracked() {
+		return nil
+	}
+
+	changes := []blend.Change{}
+	for _, v := range vertices {
+		for _, family := range edgeFamilies {
+			edges, err := backend.GetEdges(blend.Vertex{Id: v.Id}, blend.Edge{Family: family})
+			if err != nil {
+				continue
+			}
+
+			for i := range edges {
+				changes = append(changes, blend.Change{Type: "edge:delete", EdgeBefore: &edges[i]})
+			}
+		}
+
+		before := blend.Vertex{Id: v.Id}
+		if backend.GetVertex(&before) == nil {
+			changes = append(changes, blend.Change{Type: "vertex:delete", VertexBefore: &before})
+		}
+	}
+
+	return changes
+}
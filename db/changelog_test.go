@@ -0,0 +1,264 @@
+package db
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestChangelog(t *testing.T) {
+	dir := initTestGraph(t)
+
+	err := OpenChangelog(path.Join(dir, "changes.db"), ChangelogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := SubscribeChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := &blend.Vertex{Name: "parent", Type: "test", PrivateKey: "key", Private: "secret"}
+	child := &blend.Vertex{Name: "child", Type: "test"}
+
+	err = CreateVertex(parent)
+	if err == nil {
+		err = CreateChildVertex(parent, child, blend.Edge{Type: "child", Name: "child"})
+	}
+
+	if err == nil {
+		parent.Name = "renamed"
+		err = UpdateVertex(parent)
+	}
+
+	if err == nil {
+		err = DeleteVertex(parent)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Changes(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"vertex:create", "vertex:create", "edge:create", "vertex:update",
+		"vertex:delete", "edge:delete", "vertex:delete",
+	}
+
+	if len(changes) != len(expected) {
+		t.Fatal("Got back different changes then expected", changes)
+	}
+
+	for i, change := range changes {
+		if change.Seq != uint64(i+1) || change.Type != expected[i] {
+			t.Fatal("Got back a different change then expected", i, change)
+		}
+
+		live := <-ch
+		if live.Seq != change.Seq {
+			t.Fatal("Subscriber got the changes out of order", live, change)
+		}
+	}
+
+	update := changes[3]
+	if update.VertexBefore.Name != "parent" || update.VertexAfter.Name != "renamed" ||
+		update.VertexAfter.Private != "" || update.VertexAfter.PrivateKey != "" {
+		t.Fatal("Got back a different update then expected", update.VertexBefore, update.VertexAfter)
+	}
+
+	changes, err = Changes(5, 1)
+	if err != nil || len(changes) != 1 || changes[0].Seq != 6 {
+		t.Fatal("Reading after a sequence number failed", changes, err)
+	}
+
+	// concurrent updates are logged in the order they were committed,
+	// each one starting from where the one before left off
+	v := &blend.Vertex{Name: "0", Type: "test"}
+	err = CreateVertex(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			UpdateVertex(&blend.Vertex{Id: v.Id, Name: fmt.Sprint(i), Type: "test"})
+		}(i)
+	}
+
+	wg.Wait()
+
+	changes, err = Changes(7, 0)
+	if err != nil || len(changes) != 21 {
+		t.Fatal("Got back different changes then expected", changes, err)
+	}
+
+	for i := 1; i < len(changes); i++ {
+		if changes[i].VertexBefore.Name != changes[i-1].VertexAfter.Name ||
+			changes[i].Time.Before(changes[i-1].Time) {
+			t.Fatal("Concurrent updates logged out of order", changes[i-1], changes[i])
+		}
+	}
+
+	last := blend.Vertex{Id: v.Id}
+	err = GetVertex(&last)
+	if err != nil || last.Name != changes[20].VertexAfter.Name {
+		t.Fatal("Last logged update is not the one committed last", last, err)
+	}
+
+	// garbage collection logs the vertices it removes
+	orphan := &blend.Vertex{Name: "orphan", Type: "test"}
+	err = CreateChildVertex(v, orphan, blend.Edge{Type: "child", Name: "orphan"})
+	if err == nil {
+		err = DeleteEdge(blend.Edge{Family: "ownership", Type: "child", Name: "orphan", From: v.Id, To: orphan.Id})
+	}
+
+	if err == nil {
+		_, err = CollectGarbage(GCOptions{})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = Changes(28, 0)
+	if err != nil || len(changes) != 4 || changes[3].Type != "vertex:delete" || changes[3].VertexBefore.Id != orphan.Id {
+		t.Fatal("Vertex removed by garbage collection not logged", changes, err)
+	}
+
+	// the retention applies when the changelog is opened again
+	CloseChangelog()
+
+	err = OpenChangelog(path.Join(dir, "changes.db"), ChangelogOptions{MaxChanges: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseChangelog()
+
+	changes, err = Changes(0, 0)
+	if err != nil || len(changes) != 3 || changes[0].Seq != 30 {
+		t.Fatal("Changelog not pruned down to the latest changes", changes, err)
+	}
+}
+
+func TestChangelogEdges(t *testing.T) {
+	dir := t.TempDir()
+
+	for uri, storage := range map[string]Storage{
+		path.Join(dir, "graph.db"): &BoltStorage{},
+		"sqlite::memory:":          &SQLStorage{},
+
+		// writing an edge again overwrites or adds a row
+		"": &CassandraStorage{connect: newFakeCluster().connect},
+	} {
+		err := Init(uri, storage)
+		if err == nil {
+			err = OpenChangelog(path.Join(dir, "changes-"+path.Base(uri)), ChangelogOptions{})
+		}
+
+		if err == nil {
+			err = OpenHistory(path.Join(dir, "history-"+path.Base(uri)), HistoryOptions{})
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, rewrites := storage.(*CassandraStorage)
+		testChangelogEdges(t, rewrites)
+
+		CloseHistory()
+		CloseChangelog()
+		Close()
+	}
+}
+
+func testChangelogEdges(t *testing.T, rewrites bool) {
+	a := &blend.Vertex{Name: "a", Type: "test"}
+	b := &blend.Vertex{Name: "b", Type: "test"}
+	c := &blend.Vertex{Name: "c", Type: "test"}
+
+	for _, v := range []*blend.Vertex{a, b, c} {
+		err := CreateVertex(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := Changes(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := changes[len(changes)-1].Seq
+
+	edge := &blend.Edge{Family: "public", Type: "link", Name: "link", Data: "first"}
+	err = CreateEdge(*a, *b, edge)
+	if err == nil {
+		edge = &blend.Edge{Family: "public", Type: "link", Name: "link", Data: "second"}
+		err = CreateEdge(*a, *b, edge)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := map[bool]string{false: "first", true: "second"}[rewrites]; edge.Data != expected {
+		t.Fatal("Got back a different edge then expected", edge)
+	}
+
+	err = CreateEdge(*a, *c, &blend.Edge{Family: "public", Type: "link", Name: "link"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = Changes(since, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rewrites {
+		// the edge is kept as it is
+		if len(changes) != 1 || changes[0].Type != "edge:create" || changes[0].EdgeAfter.Data != "first" {
+			t.Fatal("Got back different changes then expected", changes)
+		}
+
+		return
+	}
+
+	if len(changes) != 3 || changes[0].Type != "edge:create" ||
+		changes[1].Type != "edge:update" || changes[2].Type != "edge:create" {
+		t.Fatal("Got back different changes then expected", changes)
+	}
+
+	update := changes[1]
+	if update.EdgeBefore.Data != "first" || update.EdgeAfter.Data != "second" || update.EdgeAfter.To != b.Id {
+		t.Fatal("Got back a different update then expected", update.EdgeBefore, update.EdgeAfter)
+	}
+
+	if changes[2].EdgeAfter.To != c.Id {
+		t.Fatal("Got back a different edge then expected", changes[2].EdgeAfter)
+	}
+
+	// the revisions of the edge keep the data it had before
+	edges, err := GetEdgesAsOf(*a, blend.Edge{Family: "public", Type: "link"}, changes[0].Time)
+	if err != nil || len(edges) != 1 || edges[0].Data != "first" {
+		t.Fatal("Got back different edges then expected", edges, err)
+	}
+
+	edges, err = GetEdgesAsOf(*a, blend.Edge{Family: "public", Type: "link", Name: "link"}, changes[1].Time)
+	if err != nil || len(edges) != 1 || edges[0].Data != "second" {
+		t.Fatal("Got back different edges then expected", edges, err)
+	}
+}
@@ -0,0 +1,202 @@
+// deep copies of vertex trees
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+	"github.com/ziahamza/blend"
+)
+
+// Optionally implemented by backends that can read a vertex along with its
+// private data without its private key. Cloning needs it to copy the
+// private data of a whole tree while only the key of its top vertex is
+// known.
+type PrivateReader interface {
+	GetPrivateVertex(*blend.Vertex) error
+}
+
+type CloneOptions struct {
+	// copy the private data and keys of the vertices along with the data
+	// of their non public edges, otherwise the clones go without them
+	Private bool
+
+	// key of every copy made without the private data, generated if empty
+	// and returned along with the copy of the vertex
+	PrivateKey string
+}
+
+// Copies the vertex and everything it owns below the parent, owned through
+// the given edge. Every copy gets a new id, edges between the copied
+// vertices point at the copies while edges leaving the tree keep pointing
+// at the same vertices. Returns the copy of the vertex along with its key.
+func CloneVertexTree(v, parent blend.Vertex, e blend.Edge, opts CloneOptions) (blend.Vertex, error) {
+	err := rejectMounted(v.Id, parent.Id)
+	if err != nil {
+		return blend.Vertex{}, err
+	}
+
+	for _, id := range []string{v.Id, parent.Id} {
+		if !ConfirmVertex(id) {
+			return blend.Vertex{}, fmt.Errorf("Vertex %s not found", id)
+		}
+	}
+
+	if e.Type == "" || e.Name == "" {
+		return blend.Vertex{}, errors.New("Edge type and name of the copy have to be supplied")
+	}
+
+	reader, ok := backend.(PrivateReader)
+	if opts.Private && !ok {
+		return blend.Vertex{}, errors.New("Storage backend cannot copy private data")
+	}
+
+	taken, err := backend.GetEdges(parent, blend.Edge{Family: "ownership", Type: e.Type, Name: e.Name})
+	if err != nil {
+		return blend.Vertex{}, err
+	}
+
+	if len(taken) > 0 {
+		return blend.Vertex{}, fmt.Errorf("Vertex %s already owns a vertex as %s:%s", parent.Id, e.Type, e.Name)
+	}
+
+	if !opts.Private && opts.PrivateKey == "" {
+		key, err := uuid.NewV4()
+		if err != nil {
+			return blend.Vertex{}, err
+		}
+
+		opts.PrivateKey = key.String()
+	}
+
+	ids, _, err := collectTree([]*blend.Vertex{&v})
+	if err != nil {
+		return blend.Vertex{}, err
+	}
+
+	// owners are copied before the vertices they own
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+
+	clones := map[string]*blend.Vertex{}
+	for _, id := range ids {
+		vertex := &blend.Vertex{Id: id}
+		if opts.Private {
+			err = reader.GetPrivateVertex(vertex)
+		} else {
+			err = backend.GetVertex(vertex)
+			vertex.PrivateKey = opts.PrivateKey
+		}
+
+		if err != nil {
+			return blend.Vertex{}, err
+		}
+
+		vertex.Id = ""
+		vertex.LastChanged = time.Time{}
+
+		err = newVertex(vertex)
+		if err != nil {
+			return blend.Vertex{}, err
+		}
+
+		clones[id] = vertex
+	}
+
+	edges := []blend.Edge{}
+	for _, id := range ids {
+		for _, family := range edgeFamilies {
+			outgoing, err := backend.GetEdges(blend.Vertex{Id: id}, blend.Edge{Family: family})
+			if err != nil {
+				return blend.Vertex{}, err
+			}
+
+			for _, edge := range outgoing {
+				edge.From = clones[id].Id
+				edge.LastChanged = ""
+
+				if clone, ok := clones[edge.To]; ok {
+					edge.To = clone.Id
+				} else if !ConfirmVertex(edge.To) {
+					continue
+				}
+
+				if !opts.Private && edge.Family != "public" {
+					edge.Data = ""
+				}
+
+				edges = append(edges, edge)
+			}
+		}
+	}
+
+	root := clones[v.Id]
+
+	err = CreateChildVertex(&parent, root, e)
+	if err != nil {
+		return blend.Vertex{}, err
+	}
+
+	// every other copy is created along with an ownership edge from a copy
+	// created before it, so the tree is never left with unowned vertices
+	created := map[string]bool{root.Id: true}
+	copied := make([]bool, len(edges))
+
+	for _, id := range ids[1:] {
+		clone := clones[id]
+
+		for i, edge := range edges {
+			if copied[i] || edge.Family != "ownership" || edge.To != clone.Id || !created[edge.From] {
+				continue
+			}
+
+			unlock := trackChanges()
+
+			err = backend.CreateChildVertex(&blend.Vertex{Id: edge.From}, clone, edge)
+			if err == nil {
+				recordChange(blend.Change{Type: "vertex:create", VertexAfter: clone})
+				recordChange(blend.Change{Type: "edge:create", EdgeAfter: &edges[i]})
+			}
+
+			unlock()
+
+			if err != nil {
+				return *root, err
+			}
+
+			notify(clone.Id, "vertex:create")
+
+			created[clone.Id] = true
+			copied[i] = true
+
+			break
+		}
+	}
+
+	for i := range edges {
+		if copied[i] {
+			continue
+		}
+
+		edge := &edges[i]
+
+		unlock := trackChanges()
+
+		err = backend.CreateEdge(blend.Vertex{Id: edge.From}, blend.Vertex{Id: edge.To}, edge)
+		if err == nil {
+			recordChange(blend.Change{Type: "edge:create", EdgeAfter: edge})
+		}
+
+		unlock()
+
+		if err != nil {
+			return *root, err
+		}
+		notify(edge.From, "edge:create")
+	}
+
+	return *root, nil
+}
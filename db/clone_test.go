@@ -0,0 +1,141 @@
+package db
+
+import (
+	"path"
+	"testing"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestClone(t *testing.T) {
+	dir := t.TempDir()
+
+	for uri, storage := range map[string]Storage{
+		path.Join(dir, "graph.db"): &BoltStorage{},
+		"sqlite::memory:":          &SQLStorage{},
+
+		// without reading private data without the key
+		"": &CassandraStorage{connect: newFakeCluster().connect},
+	} {
+		err := Init(uri, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, private := storage.(PrivateReader)
+		testClone(t, private)
+
+		Close()
+	}
+}
+
+func testClone(t *testing.T, private bool) {
+	parent := &blend.Vertex{Name: "parent", Type: "test"}
+	template := &blend.Vertex{Name: "template", Type: "test", PrivateKey: "key", Private: "secret"}
+	child := &blend.Vertex{Name: "child", Type: "test", PrivateKey: "child", Private: "child secret"}
+	outside := &blend.Vertex{Name: "outside", Type: "test"}
+
+	err := CreateVertex(parent)
+	if err == nil {
+		err = CreateVertex(outside)
+	}
+
+	if err == nil {
+		err = CreateChildVertex(parent, template, blend.Edge{Type: "folder", Name: "template"})
+	}
+
+	if err == nil {
+		err = CreateChildVertex(template, child, blend.Edge{Type: "folder", Name: "child"})
+	}
+
+	if err == nil {
+		err = CreateEdge(*template, *child, &blend.Edge{Family: "private", Type: "link", Name: "inside", Data: "data"})
+	}
+
+	if err == nil {
+		err = CreateEdge(*child, *outside, &blend.Edge{Family: "public", Type: "link", Name: "outside"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone, err := CloneVertexTree(*template, *parent, blend.Edge{Type: "folder", Name: "copy"}, CloneOptions{Private: true})
+	if !private {
+		if err == nil {
+			t.Fatal("Copied private data the backend cannot read")
+		}
+
+		testClonePublic(t, parent, template, outside)
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clone.Id == template.Id || clone.Name != "template" || clone.Private != "secret" {
+		t.Fatal("Got back a different copy then expected", clone)
+	}
+
+	childClone, err := GetChildVertex(clone, blend.Edge{Family: "ownership", Type: "folder", Name: "child"})
+	if err != nil || childClone.Id == child.Id {
+		t.Fatal("Owned vertex not copied", childClone, err)
+	}
+
+	v := blend.Vertex{Id: childClone.Id, PrivateKey: "child"}
+	err = GetVertex(&v)
+	if err != nil || v.Private != "child secret" {
+		t.Fatal("Private data not copied", v, err)
+	}
+
+	edges, err := GetEdges(clone, blend.Edge{Family: "private"})
+	if err != nil || len(edges) != 1 || edges[0].To != childClone.Id || edges[0].Data != "data" {
+		t.Fatal("Edge within the tree not pointing at the copy", edges, err)
+	}
+
+	edges, err = GetEdges(childClone, blend.Edge{Family: "public"})
+	if err != nil || len(edges) != 1 || edges[0].To != outside.Id {
+		t.Fatal("Edge leaving the tree not kept", edges, err)
+	}
+
+	_, err = CloneVertexTree(*template, *parent, blend.Edge{Type: "folder", Name: "copy"}, CloneOptions{})
+	if err == nil {
+		t.Fatal("Copied a vertex over an existing child")
+	}
+
+	testClonePublic(t, parent, template, outside)
+}
+
+// copies without the private data get the key given or a generated one
+func testClonePublic(t *testing.T, parent, template, outside *blend.Vertex) {
+	clone, err := CloneVertexTree(*template, *parent, blend.Edge{Type: "folder", Name: "public"}, CloneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clone.Private != "" || clone.PrivateKey == "" || clone.PrivateKey == template.PrivateKey {
+		t.Fatal("Got back a different copy then expected", clone)
+	}
+
+	childClone, err := GetChildVertex(clone, blend.Edge{Family: "ownership", Type: "folder", Name: "child"})
+	if err != nil || !ConfirmVertexKey(clone.Id, clone.PrivateKey) || !ConfirmVertexKey(childClone.Id, clone.PrivateKey) {
+		t.Fatal("Copies cannot be changed with their returned key", childClone, err)
+	}
+
+	edges, err := GetEdges(clone, blend.Edge{Family: "private"})
+	if err != nil || len(edges) != 1 || edges[0].Data != "" {
+		t.Fatal("Data of a private edge copied without asking for it", edges, err)
+	}
+
+	keyed, err := CloneVertexTree(*template, *parent, blend.Edge{Type: "folder", Name: "keyed"}, CloneOptions{PrivateKey: "copy"})
+	if err != nil || keyed.PrivateKey != "copy" || !ConfirmVertexKey(keyed.Id, "copy") {
+		t.Fatal("Copy did not get the given key", keyed, err)
+	}
+
+	// the clones are owned, so nothing is garbage
+	result, err := CollectGarbage(GCOptions{Roots: []string{parent.Id, outside.Id}, DryRun: true})
+	if err != nil || len(result.Unreachable) != 0 {
+		t.Fatal("Copies are not owned by their parent", result, err)
+	}
+}
@@ -0,0 +1,97 @@
+// the cql session used by the cassandra backend
+package db
+
+import (
+	"github.com/gocql/gocql"
+)
+
+// The parts of a gocql session used by the cassandra backend. Keeping the
+// backend behind these lets it run against a local stand-in for the
+// cluster in tests.
+type cqlSession interface {
+	Query(stmt string, values ...interface{}) cqlQuery
+	Close()
+}
+
+type cqlQuery interface {
+	Consistency(gocql.Consistency) cqlQuery
+	PageSize(int) cqlQuery
+
+	// resumes reading at the state returned by the iterator of the
+	// previous page, the iterator then stops at the end of the page
+	PageState([]byte) cqlQuery
+
+	Exec() error
+	Scan(dest ...interface{}) error
+	MapScanCAS(dest map[string]interface{}) (bool, error)
+	Iter() cqlIter
+}
+
+type cqlIter interface {
+	Scan(dest ...interface{}) bool
+
+	// state to read the next page with, empty after the last page
+	PageState() []byte
+
+	Close() error
+}
+
+type gocqlSession struct {
+	session *gocql.Session
+}
+
+func (s gocqlSession) Query(stmt string, values ...interface{}) cqlQuery {
+	return gocqlQuery{s.session.Query(stmt, values...)}
+}
+
+func (s gocqlSession) Close() {
+	s.session.Close()
+}
+
+type gocqlQuery struct {
+	query *gocql.Query
+}
+
+func (q gocqlQuery) Consistency(c gocql.Consistency) cqlQuery {
+	q.query.Consistency(c)
+	return q
+}
+
+func (q gocqlQuery) PageSize(n int) cqlQuery {
+	q.query.PageSize(n)
+	return q
+}
+
+func (q gocqlQuery) PageState(state []byte) cqlQuery {
+	q.query.PageState(state)
+	return q
+}
+
+func (q gocqlQuery) Exec() error {
+	return q.query.Exec()
+}
+
+func (q gocqlQuery) Scan(dest ...interface{}) error {
+	return q.query.Scan(dest...)
+}
+
+func (q gocqlQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+	return q.query.MapScanCAS(dest)
+}
+
+func (q gocqlQuery) Iter() cqlIter {
+	return q.query.Iter()
+}
+
+// opens a session on the cluster, without a keyspace if it is empty
+func (opts CassandraOptions) connect(keyspace string) (cqlSession, error) {
+	cluster := opts.cluster()
+	cluster.Keyspace = keyspace
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return gocqlSession{session}, nil
+}
@@ -0,0 +1,1355 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gocql/gocql"
+)
+
+// An in memory stand-in for a cassandra cluster, understanding just
+// enough cql for the statements of the cassandra backend. It follows
+// cassandra where the backend could get it wrong: unknown tables and
+// columns fail, static columns are shared by a partition, a partition
+// with only static columns still reads as a single row and conditional
+// batches have to stay within a single partition. Cassandra accepts plain
+// deletes of rows written with a lightweight transaction but they can get
+// lost against the paxos state, so the stand-in refuses them.
+type fakeCluster struct {
+	sync.Mutex
+	tables map[string]*fakeTable
+
+	// returned by iterators once they read all their rows, like a next
+	// page that cannot be fetched
+	failPages error
+}
+
+type fakeTable struct {
+	columns    map[string]string
+	static     map[string]bool
+	partition  string
+	clustering []string
+	partitions map[string]*fakePartition
+}
+
+type fakePartition struct {
+	key    interface{}
+	static map[string]interface{}
+	rows   []*fakeRow
+
+	// written with a lightweight transaction
+	paxos bool
+}
+
+type fakeRow struct {
+	key     []interface{}
+	values  map[string]interface{}
+	expires time.Time
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{tables: map[string]*fakeTable{}}
+}
+
+func (c *fakeCluster) connect(keyspace string) (cqlSession, error) {
+	return fakeSession{c}, nil
+}
+
+type fakeSession struct {
+	cluster *fakeCluster
+}
+
+func (s fakeSession) Query(stmt string, values ...interface{}) cqlQuery {
+	return &fakeQuery{cluster: s.cluster, stmt: stmt, values: values}
+}
+
+func (s fakeSession) Close() {}
+
+type fakeQuery struct {
+	cluster *fakeCluster
+	stmt    string
+	values  []interface{}
+
+	// set once a page state is passed, the iterator then only reads
+	// a page of the rows
+	paged     bool
+	pageSize  int
+	pageState []byte
+}
+
+func (q *fakeQuery) Consistency(gocql.Consistency) cqlQuery { return q }
+
+func (q *fakeQuery) PageSize(n int) cqlQuery {
+	q.pageSize = n
+	return q
+}
+
+// the state is the number of rows read by the pages before
+func (q *fakeQuery) PageState(state []byte) cqlQuery {
+	q.paged = true
+	q.pageState = state
+	return q
+}
+
+func (q *fakeQuery) Exec() error {
+	_, err := q.cluster.exec(q.stmt, q.values)
+	return err
+}
+
+func (q *fakeQuery) Scan(dest ...interface{}) error {
+	result, err := q.cluster.exec(q.stmt, q.values)
+	if err != nil {
+		return err
+	}
+
+	if len(result.rows) == 0 {
+		return gocql.ErrNotFound
+	}
+
+	return scanFakeRow(result.rows[0], dest)
+}
+
+func (q *fakeQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+	result, err := q.cluster.exec(q.stmt, q.values)
+	if err != nil {
+		return false, err
+	}
+
+	if !result.conditional {
+		return false, errors.New("Statement is not conditional")
+	}
+
+	return result.applied, nil
+}
+
+func (q *fakeQuery) Iter() cqlIter {
+	result, err := q.cluster.exec(q.stmt, q.values)
+	if err != nil || !q.paged || q.pageSize < 1 {
+		return &fakeIter{rows: result.rows, err: err, failPage: q.cluster.failPages}
+	}
+
+	offset := 0
+	if len(q.pageState) > 0 {
+		offset, err = strconv.Atoi(string(q.pageState))
+		if err != nil || offset > len(result.rows) {
+			return &fakeIter{err: fmt.Errorf("Invalid page state %q", q.pageState)}
+		}
+	}
+
+	it := &fakeIter{rows: result.rows[offset:]}
+	if len(it.rows) > q.pageSize {
+		it.rows = it.rows[:q.pageSize]
+		it.state = []byte(strconv.Itoa(offset + q.pageSize))
+	}
+
+	return it
+}
+
+type fakeIter struct {
+	rows     [][]interface{}
+	err      error
+	failPage error
+	state    []byte
+}
+
+func (it *fakeIter) Scan(dest ...interface{}) bool {
+	if it.err == nil && len(it.rows) == 0 {
+		it.err = it.failPage
+	}
+
+	if it.err != nil || len(it.rows) == 0 {
+		return false
+	}
+
+	it.err = scanFakeRow(it.rows[0], dest)
+	it.rows = it.rows[1:]
+
+	return it.err == nil
+}
+
+func (it *fakeIter) PageState() []byte {
+	return it.state
+}
+
+func (it *fakeIter) Close() error {
+	return it.err
+}
+
+func scanFakeRow(row []interface{}, dest []interface{}) error {
+	if len(dest) != len(row) {
+		return fmt.Errorf("Scanning %d columns into %d values", len(row), len(dest))
+	}
+
+	for i, value := range row {
+		var ok bool
+
+		switch d := dest[i].(type) {
+		case *string:
+			*d, ok = "", true
+			if value != nil {
+				*d, ok = value.(string)
+			}
+		case *int:
+			*d, ok = 0, true
+			if value != nil {
+				*d, ok = value.(int)
+			}
+		case *time.Time:
+			*d, ok = time.Time{}, true
+			if value != nil {
+				*d, ok = value.(time.Time)
+			}
+		case *gocql.UUID:
+			*d, ok = gocql.UUID{}, true
+			if value != nil {
+				*d, ok = value.(gocql.UUID)
+			}
+		case *interface{}:
+			*d, ok = value, true
+		}
+
+		if !ok {
+			return fmt.Errorf("Cannot scan %T into %T", value, dest[i])
+		}
+	}
+
+	return nil
+}
+
+type fakeResult struct {
+	rows        [][]interface{}
+	conditional bool
+	applied     bool
+}
+
+type fakeCondition struct {
+	column string
+	value  interface{}
+}
+
+type fakeStatement struct {
+	kind  string
+	table string
+
+	columns []string
+	values  []interface{}
+	where   []fakeCondition
+
+	ifNotExists bool
+	ifExists    bool
+	ttl         int
+	distinct    bool
+	limit       int
+
+	// values an update or delete is conditional on
+	ifValues []fakeCondition
+
+	// definitions of a created table or added column
+	define *fakeTable
+
+	batch []*fakeStatement
+}
+
+func (c *fakeCluster) exec(stmt string, values []interface{}) (fakeResult, error) {
+	p := &fakeParser{tokens: tokenizeCQL(stmt), values: values}
+
+	s, err := p.statement()
+	if err != nil {
+		return fakeResult{}, fmt.Errorf("%s in: %s", err.Error(), strings.Join(strings.Fields(stmt), " "))
+	}
+
+	if p.arg != len(values) {
+		return fakeResult{}, fmt.Errorf("Statement takes %d values, %d given", p.arg, len(values))
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.run(s)
+}
+
+func (c *fakeCluster) run(s *fakeStatement) (fakeResult, error) {
+	switch s.kind {
+	case "skip":
+		return fakeResult{}, nil
+	case "create":
+		if c.tables[s.table] != nil {
+			if s.ifNotExists {
+				return fakeResult{}, nil
+			}
+
+			return fakeResult{}, fmt.Errorf("Table %s already exists", s.table)
+		}
+
+		c.tables[s.table] = s.define
+		return fakeResult{}, nil
+	case "drop":
+		if c.tables[s.table] == nil && !s.ifNotExists {
+			return fakeResult{}, fmt.Errorf("unconfigured table %s", s.table)
+		}
+
+		delete(c.tables, s.table)
+		return fakeResult{}, nil
+	case "batch":
+		return c.runBatch(s.batch)
+	}
+
+	t := c.tables[s.table]
+	if t == nil {
+		return fakeResult{}, fmt.Errorf("unconfigured table %s", s.table)
+	}
+
+	switch s.kind {
+	case "alter":
+		for col, typ := range s.define.columns {
+			if t.columns[col] != "" {
+				return fakeResult{}, fmt.Errorf(
+					"Invalid column name %s because it conflicts with an existing column", col)
+			}
+
+			t.columns[col] = typ
+			t.static[col] = s.define.static[col]
+		}
+
+		return fakeResult{}, nil
+	case "select":
+		return t.sel(s)
+	case "insert":
+		return t.insert(s, true)
+	case "update":
+		return t.update(s)
+	case "delete":
+		return t.remove(s)
+	}
+
+	return fakeResult{}, errors.New("Unknown statement " + s.kind)
+}
+
+// conditions of a batch have to hold for all of its statements at once,
+// which cassandra only checks within a single partition
+func (c *fakeCluster) runBatch(batch []*fakeStatement) (fakeResult, error) {
+	conditional := false
+	for _, s := range batch {
+		conditional = conditional || s.ifNotExists
+	}
+
+	if conditional {
+		for _, s := range batch {
+			if s.table != batch[0].table {
+				return fakeResult{}, errors.New("Batch with conditions cannot span multiple tables")
+			}
+
+			key, err := c.partitionKey(s)
+			if err != nil {
+				return fakeResult{}, err
+			}
+
+			first, _ := c.partitionKey(batch[0])
+			if fakeKey(key) != fakeKey(first) {
+				return fakeResult{}, errors.New("Batch with conditions cannot span multiple partitions")
+			}
+		}
+	}
+
+	for _, s := range batch {
+		t := c.tables[s.table]
+		if t == nil {
+			return fakeResult{}, fmt.Errorf("unconfigured table %s", s.table)
+		}
+
+		if s.kind == "insert" && s.ifNotExists {
+			exists, err := t.exists(s)
+			if err != nil || exists {
+				return fakeResult{conditional: true}, err
+			}
+		}
+	}
+
+	for _, s := range batch {
+		t := c.tables[s.table]
+
+		var err error
+		switch s.kind {
+		case "insert":
+			_, err = t.insert(s, false)
+		case "update":
+			_, err = t.update(s)
+		case "delete":
+			_, err = t.remove(s)
+		default:
+			err = errors.New("Only inserts, updates and deletes can be batched")
+		}
+
+		if err != nil {
+			return fakeResult{}, err
+		}
+	}
+
+	return fakeResult{conditional: conditional, applied: true}, nil
+}
+
+// the partition a statement of a batch writes to
+func (c *fakeCluster) partitionKey(s *fakeStatement) (interface{}, error) {
+	t := c.tables[s.table]
+	if t == nil {
+		return nil, fmt.Errorf("unconfigured table %s", s.table)
+	}
+
+	if s.kind == "insert" {
+		key, _, err := t.insertKey(s)
+		return key, err
+	}
+
+	key, _, err := t.restrict(s.where)
+	return key, err
+}
+
+func fakeKey(value interface{}) string {
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+func compareFakeKeys(a, b []interface{}) int {
+	for i := range a {
+		if i >= len(b) {
+			return 1
+		}
+
+		as, bs := fmt.Sprint(a[i]), fmt.Sprint(b[i])
+		if as != bs {
+			if as < bs {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	if len(a) < len(b) {
+		return -1
+	}
+
+	return 0
+}
+
+func (t *fakeTable) checkValue(col string, value interface{}) error {
+	typ := t.columns[col]
+	if typ == "" {
+		return fmt.Errorf("Undefined column name %s", col)
+	}
+
+	if value == nil {
+		return nil
+	}
+
+	ok := false
+	switch typ {
+	case "varchar", "text":
+		_, ok = value.(string)
+	case "int":
+		_, ok = value.(int)
+	case "timestamp":
+		_, ok = value.(time.Time)
+	case "timeuuid":
+		_, ok = value.(gocql.UUID)
+	}
+
+	if !ok {
+		return fmt.Errorf("Cannot store %T in %s column %s", value, typ, col)
+	}
+
+	return nil
+}
+
+// splits the conditions into the partition key and a prefix of the
+// clustering key
+func (t *fakeTable) restrict(where []fakeCondition) (interface{}, []interface{}, error) {
+	if len(where) == 0 {
+		return nil, nil, nil
+	}
+
+	if where[0].column != t.partition {
+		return nil, nil, errors.New("Restrictions have to start with the partition key")
+	}
+
+	prefix := []interface{}{}
+	for i, cond := range where[1:] {
+		if i >= len(t.clustering) || cond.column != t.clustering[i] {
+			return nil, nil, errors.New("Clustering columns have to be restricted in order")
+		}
+
+		prefix = append(prefix, cond.value)
+	}
+
+	return where[0].value, prefix, nil
+}
+
+func (p *fakePartition) live() []*fakeRow {
+	rows := []*fakeRow{}
+	for _, row := range p.rows {
+		if row.expires.IsZero() || time.Now().Before(row.expires) {
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+func (t *fakeTable) sel(s *fakeStatement) (fakeResult, error) {
+	for _, col := range s.columns {
+		if t.columns[col] == "" {
+			return fakeResult{}, fmt.Errorf("Undefined column name %s", col)
+		}
+	}
+
+	key, prefix, err := t.restrict(s.where)
+	if err != nil {
+		return fakeResult{}, err
+	}
+
+	partitions := []*fakePartition{}
+	if len(s.where) > 0 {
+		if p := t.partitions[fakeKey(key)]; p != nil {
+			partitions = append(partitions, p)
+		}
+	} else {
+		keys := []string{}
+		for k := range t.partitions {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			partitions = append(partitions, t.partitions[k])
+		}
+	}
+
+	result := fakeResult{}
+	for _, p := range partitions {
+		rows := p.live()
+
+		if s.distinct || (len(rows) == 0 && len(p.static) > 0 && len(prefix) == 0) {
+			rows = []*fakeRow{{values: map[string]interface{}{}}}
+		}
+
+		for _, row := range rows {
+			if len(prefix) > 0 && compareFakeKeys(row.key[:len(prefix)], prefix) != 0 {
+				continue
+			}
+
+			values := []interface{}{}
+			for _, col := range s.columns {
+				values = append(values, t.value(p, row, col))
+			}
+
+			result.rows = append(result.rows, values)
+
+			if s.distinct {
+				break
+			}
+		}
+	}
+
+	if s.limit > 0 && len(result.rows) > s.limit {
+		result.rows = result.rows[:s.limit]
+	}
+
+	return result, nil
+}
+
+func (t *fakeTable) value(p *fakePartition, row *fakeRow, col string) interface{} {
+	if col == t.partition {
+		return p.key
+	}
+
+	for i, ccol := range t.clustering {
+		if col == ccol {
+			if i < len(row.key) {
+				return row.key[i]
+			}
+
+			return nil
+		}
+	}
+
+	if t.static[col] {
+		return p.static[col]
+	}
+
+	return row.values[col]
+}
+
+// the partition and clustering key written by an insert, a nil clustering
+// key for inserts of static columns only
+func (t *fakeTable) insertKey(s *fakeStatement) (interface{}, []interface{}, error) {
+	var key interface{}
+	clustering := make([]interface{}, len(t.clustering))
+	found := 0
+
+	for i, col := range s.columns {
+		if col == t.partition {
+			key = s.values[i]
+		}
+
+		for j, ccol := range t.clustering {
+			if col == ccol {
+				clustering[j] = s.values[i]
+				found++
+			}
+		}
+	}
+
+	if key == nil {
+		return nil, nil, errors.New("Missing partition key " + t.partition)
+	}
+
+	if found == 0 && len(t.clustering) > 0 {
+		return key, nil, nil
+	}
+
+	if found != len(t.clustering) {
+		return nil, nil, errors.New("Missing clustering columns")
+	}
+
+	return key, clustering, nil
+}
+
+func (t *fakeTable) exists(s *fakeStatement) (bool, error) {
+	key, clustering, err := t.insertKey(s)
+	if err != nil {
+		return false, err
+	}
+
+	p := t.partitions[fakeKey(key)]
+	if p == nil {
+		return false, nil
+	}
+
+	if clustering == nil {
+		return len(p.static) > 0, nil
+	}
+
+	for _, row := range p.live() {
+		if compareFakeKeys(row.key, clustering) == 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (t *fakeTable) partitionFor(key interface{}) *fakePartition {
+	p := t.partitions[fakeKey(key)]
+	if p == nil {
+		p = &fakePartition{key: key, static: map[string]interface{}{}}
+		t.partitions[fakeKey(key)] = p
+	}
+
+	return p
+}
+
+func (p *fakePartition) row(clustering []interface{}) *fakeRow {
+	i := sort.Search(len(p.rows), func(i int) bool {
+		return compareFakeKeys(p.rows[i].key, clustering) >= 0
+	})
+
+	if i < len(p.rows) && compareFakeKeys(p.rows[i].key, clustering) == 0 {
+		return p.rows[i]
+	}
+
+	row := &fakeRow{key: clustering, values: map[string]interface{}{}}
+	p.rows = append(p.rows, nil)
+	copy(p.rows[i+1:], p.rows[i:])
+	p.rows[i] = row
+
+	return row
+}
+
+func (t *fakeTable) insert(s *fakeStatement, checkCondition bool) (fakeResult, error) {
+	for i, col := range s.columns {
+		err := t.checkValue(col, s.values[i])
+		if err != nil {
+			return fakeResult{}, err
+		}
+	}
+
+	key, clustering, err := t.insertKey(s)
+	if err != nil {
+		return fakeResult{}, err
+	}
+
+	result := fakeResult{conditional: s.ifNotExists, applied: true}
+
+	if checkCondition && s.ifNotExists {
+		exists, err := t.exists(s)
+		if err != nil || exists {
+			return fakeResult{conditional: true}, err
+		}
+	}
+
+	p := t.partitionFor(key)
+	p.paxos = p.paxos || s.ifNotExists
+
+	var row *fakeRow
+	if clustering != nil {
+		row = p.row(clustering)
+
+		// an expired row is written anew
+		if !row.expires.IsZero() {
+			row.values = map[string]interface{}{}
+			row.expires = time.Time{}
+		}
+
+		if s.ttl > 0 {
+			row.expires = time.Now().Add(time.Duration(s.ttl) * time.Second)
+		}
+	}
+
+	for i, col := range s.columns {
+		if col == t.partition || t.isClustering(col) {
+			continue
+		}
+
+		if t.static[col] {
+			p.static[col] = s.values[i]
+		} else if row != nil {
+			row.values[col] = s.values[i]
+		} else {
+			return fakeResult{}, errors.New("Missing clustering columns to write " + col)
+		}
+	}
+
+	return result, nil
+}
+
+func (t *fakeTable) isClustering(col string) bool {
+	for _, ccol := range t.clustering {
+		if col == ccol {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *fakeTable) update(s *fakeStatement) (fakeResult, error) {
+	key, prefix, err := t.restrict(s.where)
+	if err != nil || key == nil {
+		return fakeResult{}, errors.New("Updates have to name their partition")
+	}
+
+	for i, col := range s.columns {
+		err = t.checkValue(col, s.values[i])
+		if err != nil {
+			return fakeResult{}, err
+		}
+
+		if col == t.partition || t.isClustering(col) {
+			return fakeResult{}, errors.New("Primary key column " + col + " cannot be updated")
+		}
+	}
+
+	conditional := len(s.ifValues) > 0
+	if conditional && !t.matches(key, prefix, s.ifValues) {
+		return fakeResult{conditional: true}, nil
+	}
+
+	p := t.partitionFor(key)
+	p.paxos = p.paxos || conditional
+
+	for i, col := range s.columns {
+		if t.static[col] {
+			p.static[col] = s.values[i]
+		} else if len(prefix) == len(t.clustering) {
+			p.row(prefix).values[col] = s.values[i]
+		} else {
+			return fakeResult{}, errors.New("Missing clustering columns to update " + col)
+		}
+	}
+
+	// cassandra only expires the written columns, which is the same as
+	// long as an update with a ttl writes all of them
+	if s.ttl > 0 && len(prefix) == len(t.clustering) {
+		p.row(prefix).expires = time.Now().Add(time.Duration(s.ttl) * time.Second)
+	}
+
+	return fakeResult{conditional: conditional, applied: true}, nil
+}
+
+// true if the row exists with the values of the conditions
+func (t *fakeTable) matches(key interface{}, clustering []interface{}, conds []fakeCondition) bool {
+	p := t.partitions[fakeKey(key)]
+	if p == nil {
+		return false
+	}
+
+	for _, row := range p.live() {
+		if compareFakeKeys(row.key, clustering) != 0 {
+			continue
+		}
+
+		for _, cond := range conds {
+			if fakeKey(t.value(p, row, cond.column)) != fakeKey(cond.value) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (t *fakeTable) remove(s *fakeStatement) (fakeResult, error) {
+	key, prefix, err := t.restrict(s.where)
+	if err != nil || key == nil {
+		return fakeResult{}, errors.New("Deletes have to name their partition")
+	}
+
+	conditional := s.ifExists || len(s.ifValues) > 0
+
+	p := t.partitions[fakeKey(key)]
+	if p == nil {
+		return fakeResult{conditional: conditional}, nil
+	}
+
+	if p.paxos && !conditional {
+		return fakeResult{}, errors.New("Rows written with a lightweight transaction have to be deleted with one")
+	}
+
+	if len(s.ifValues) > 0 && !t.matches(key, prefix, s.ifValues) {
+		return fakeResult{conditional: true}, nil
+	}
+
+	if len(prefix) == 0 {
+		delete(t.partitions, fakeKey(key))
+		return fakeResult{conditional: conditional, applied: true}, nil
+	}
+
+	rows := []*fakeRow{}
+	for _, row := range p.rows {
+		if compareFakeKeys(row.key[:len(prefix)], prefix) != 0 {
+			rows = append(rows, row)
+		}
+	}
+
+	p.rows = rows
+
+	return fakeResult{conditional: conditional, applied: true}, nil
+}
+
+// splits cql into words, numbers, quoted strings and punctuation
+func tokenizeCQL(stmt string) []string {
+	tokens := []string{}
+	runes := []rune(stmt)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'':
+			j := i + 1
+			for j < len(runes) && runes[j] != '\'' {
+				j++
+			}
+
+			tokens = append(tokens, string(runes[i:min(j+1, len(runes))]))
+			i = j + 1
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+
+	return tokens
+}
+
+type fakeParser struct {
+	tokens []string
+	pos    int
+
+	values []interface{}
+	arg    int
+}
+
+func (p *fakeParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *fakeParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// consumes the words if they come next
+func (p *fakeParser) accept(words ...string) bool {
+	for i, word := range words {
+		if p.pos+i >= len(p.tokens) || !strings.EqualFold(p.tokens[p.pos+i], word) {
+			return false
+		}
+	}
+
+	p.pos += len(words)
+	return true
+}
+
+func (p *fakeParser) expect(words ...string) error {
+	if !p.accept(words...) {
+		return fmt.Errorf("Expected %s at %q", strings.Join(words, " "), p.peek())
+	}
+
+	return nil
+}
+
+func (p *fakeParser) identifier() (string, error) {
+	token := p.next()
+	if token == "" || !(unicode.IsLetter(rune(token[0])) || token[0] == '_') {
+		return "", fmt.Errorf("Expected a name at %q", token)
+	}
+
+	return strings.ToLower(token), nil
+}
+
+// a bound value, literal or call of now()
+func (p *fakeParser) value() (interface{}, error) {
+	token := p.next()
+
+	switch {
+	case token == "?":
+		if p.arg >= len(p.values) {
+			return nil, errors.New("Not enough values for the statement")
+		}
+
+		value := p.values[p.arg]
+		p.arg++
+
+		switch v := value.(type) {
+		case *string:
+			return *v, nil
+		case int64:
+			return int(v), nil
+		}
+
+		return value, nil
+	case strings.EqualFold(token, "now"):
+		err := p.expect("(", ")")
+		return gocql.TimeUUID(), err
+	case strings.HasPrefix(token, "'"):
+		return strings.Trim(token, "'"), nil
+	}
+
+	n, err := strconv.Atoi(token)
+	if err != nil {
+		return nil, fmt.Errorf("Expected a value at %q", token)
+	}
+
+	return n, nil
+}
+
+func (p *fakeParser) statement() (*fakeStatement, error) {
+	var (
+		s   *fakeStatement
+		err error
+	)
+
+	switch {
+	case p.accept("BEGIN", "BATCH"):
+		s, err = p.batch()
+	case p.accept("CREATE", "KEYSPACE"):
+		return &fakeStatement{kind: "skip"}, nil
+	case p.accept("CREATE", "TABLE"):
+		s, err = p.createTable()
+	case p.accept("ALTER", "TABLE"):
+		s, err = p.alterTable()
+	case p.accept("DROP", "TABLE"):
+		s = &fakeStatement{kind: "drop", ifNotExists: p.accept("IF", "EXISTS")}
+		s.table, err = p.identifier()
+	case p.accept("SELECT"):
+		s, err = p.sel()
+	case p.accept("INSERT", "INTO"):
+		s, err = p.insert()
+	case p.accept("UPDATE"):
+		s, err = p.update()
+	case p.accept("DELETE", "FROM"):
+		s = &fakeStatement{kind: "delete"}
+		s.table, err = p.identifier()
+		if err == nil {
+			s.where, err = p.where()
+		}
+
+		s.ifExists = p.accept("IF", "EXISTS")
+		if err == nil && !s.ifExists {
+			s.ifValues, err = p.ifConditions()
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported statement at %q", p.peek())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.accept(";")
+
+	if p.pos < len(p.tokens) && s.kind != "batch" {
+		return nil, fmt.Errorf("Unexpected %q", p.peek())
+	}
+
+	return s, nil
+}
+
+func (p *fakeParser) batch() (*fakeStatement, error) {
+	s := &fakeStatement{kind: "batch"}
+
+	for !p.accept("APPLY", "BATCH") {
+		if p.peek() == "" {
+			return nil, errors.New("Batch not applied")
+		}
+
+		var (
+			inner *fakeStatement
+			err   error
+		)
+
+		switch {
+		case p.accept("INSERT", "INTO"):
+			inner, err = p.insert()
+		case p.accept("UPDATE"):
+			inner, err = p.update()
+		case p.accept("DELETE", "FROM"):
+			inner = &fakeStatement{kind: "delete"}
+			inner.table, err = p.identifier()
+			if err == nil {
+				inner.where, err = p.where()
+			}
+		default:
+			err = fmt.Errorf("Unsupported statement in batch at %q", p.peek())
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.accept(";")
+		s.batch = append(s.batch, inner)
+	}
+
+	p.accept(";")
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q", p.peek())
+	}
+
+	return s, nil
+}
+
+func (p *fakeParser) column(t *fakeTable) (string, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return "", err
+	}
+
+	typ, err := p.identifier()
+	if err != nil {
+		return "", err
+	}
+
+	t.columns[name] = typ
+	t.static[name] = p.accept("static")
+
+	return name, nil
+}
+
+func (p *fakeParser) createTable() (*fakeStatement, error) {
+	t := &fakeTable{
+		columns:    map[string]string{},
+		static:     map[string]bool{},
+		partitions: map[string]*fakePartition{},
+	}
+
+	s := &fakeStatement{kind: "create", define: t, ifNotExists: p.accept("IF", "NOT", "EXISTS")}
+
+	var err error
+	s.table, err = p.identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+
+	for !p.accept(")") {
+		if p.accept("PRIMARY", "KEY") {
+			err = p.expect("(")
+			for err == nil && !p.accept(")") {
+				var name string
+				name, err = p.identifier()
+
+				if t.partition == "" {
+					t.partition = name
+				} else {
+					t.clustering = append(t.clustering, name)
+				}
+
+				p.accept(",")
+			}
+		} else {
+			var name string
+			name, err = p.column(t)
+
+			if err == nil && p.accept("PRIMARY", "KEY") {
+				t.partition = name
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.accept(",")
+	}
+
+	if t.partition == "" {
+		return nil, errors.New("Table without a primary key")
+	}
+
+	return s, nil
+}
+
+func (p *fakeParser) alterTable() (*fakeStatement, error) {
+	t := &fakeTable{columns: map[string]string{}, static: map[string]bool{}}
+	s := &fakeStatement{kind: "alter", define: t}
+
+	var err error
+	s.table, err = p.identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expect("ADD")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.column(t)
+
+	return s, err
+}
+
+func (p *fakeParser) sel() (*fakeStatement, error) {
+	s := &fakeStatement{kind: "select", distinct: p.accept("DISTINCT")}
+
+	for {
+		col, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+
+		s.columns = append(s.columns, col)
+
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	err := p.expect("FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	s.table, err = p.identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() != "" && !p.accept(";") {
+		if strings.EqualFold(p.peek(), "WHERE") {
+			s.where, err = p.where()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if p.accept("LIMIT") {
+			limit, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+
+			s.limit, _ = limit.(int)
+		}
+	}
+
+	return s, nil
+}
+
+func (p *fakeParser) where() ([]fakeCondition, error) {
+	err := p.expect("WHERE")
+	if err != nil {
+		return nil, err
+	}
+
+	return p.conditions()
+}
+
+// conditions of a lightweight transaction other than IF EXISTS
+func (p *fakeParser) ifConditions() ([]fakeCondition, error) {
+	if !p.accept("IF") {
+		return nil, nil
+	}
+
+	return p.conditions()
+}
+
+func (p *fakeParser) conditions() ([]fakeCondition, error) {
+	conds := []fakeCondition{}
+	for {
+		col, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expect("=")
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		conds = append(conds, fakeCondition{col, value})
+
+		if !p.accept("AND") {
+			return conds, nil
+		}
+	}
+}
+
+func (p *fakeParser) insert() (*fakeStatement, error) {
+	s := &fakeStatement{kind: "insert"}
+
+	var err error
+	s.table, err = p.identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expect("(")
+	for err == nil && !p.accept(")") {
+		var col string
+		col, err = p.identifier()
+		s.columns = append(s.columns, col)
+		p.accept(",")
+	}
+
+	if err == nil {
+		err = p.expect("VALUES", "(")
+	}
+
+	for err == nil && !p.accept(")") {
+		var value interface{}
+		value, err = p.value()
+		s.values = append(s.values, value)
+		p.accept(",")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.columns) != len(s.values) {
+		return nil, errors.New("Number of columns and values differ")
+	}
+
+	s.ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+	if p.accept("USING", "TTL") {
+		ttl, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		s.ttl, _ = ttl.(int)
+	}
+
+	return s, nil
+}
+
+func (p *fakeParser) update() (*fakeStatement, error) {
+	s := &fakeStatement{kind: "update"}
+
+	var err error
+	s.table, err = p.identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.accept("USING", "TTL") {
+		ttl, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		s.ttl, _ = ttl.(int)
+	}
+
+	err = p.expect("SET")
+	for err == nil {
+		var (
+			col   string
+			value interface{}
+		)
+
+		col, err = p.identifier()
+		if err == nil {
+			err = p.expect("=")
+		}
+
+		if err == nil {
+			value, err = p.value()
+		}
+
+		s.columns = append(s.columns, col)
+		s.values = append(s.values, value)
+
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.where, err = p.where()
+	if err == nil {
+		s.ifValues, err = p.ifConditions()
+	}
+
+	return s, err
+}
@@ -2,8 +2,10 @@ package db
 
 import (
 	"errors"
+	"time"
 
 	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/events"
 
 	"github.com/nu7hatch/gouuid"
 )
@@ -38,13 +40,48 @@ type Storage interface {
 
 	DeleteVertex(*blend.Vertex) error
 
-	DeleteVertexTree([]*blend.Vertex) error
+	// Deletes the vertices along with their outgoing edges, in a single
+	// transaction if the backend supports it. Returns the number of
+	// edges removed.
+	DeleteVertices([]*blend.Vertex) (int, error)
 
 	GetEdges(blend.Vertex, blend.Edge) ([]blend.Edge, error)
 
+	// Edges pointing at the vertex, filtered by the family, type and name of
+	// the given edge the same way as GetEdges. An empty family returns the
+	// incoming edges of every family.
+	GetIncomingEdges(blend.Vertex, blend.Edge) ([]blend.Edge, error)
+
 	// Add a specific edge to the DB. fills in the Edge pointer with the new ID
 	// of the edge
 	CreateEdge(blend.Vertex, blend.Vertex, *blend.Edge) error
+
+	// Removes a single edge identified by its from vertex, family, type,
+	// name and to vertex. Removing an edge that does not exist is not an error
+	DeleteEdge(blend.Edge) error
+}
+
+// Optionally implemented by backends that can enumerate everything they
+// store. Used by offline tools that need to look at the whole graph.
+// The scan functions must not modify the graph while scanning.
+type Scanner interface {
+	// Calls the function for every vertex in the graph, stops at the
+	// first error returned
+	ScanVertices(func(blend.Vertex) error) error
+
+	// Calls the function for every edge in the graph, stops at the
+	// first error returned
+	ScanEdges(func(blend.Edge) error) error
+}
+
+// Optionally implemented by backends keeping a cache of another graph
+type Cacher interface {
+	CacheStats() blend.CacheStats
+}
+
+// Optionally implemented by backends that queue writes for another graph
+type Syncer interface {
+	SyncStatus() blend.SyncStatus
 }
 
 var backend Storage
@@ -59,11 +96,91 @@ func Close() {
 }
 
 func Drop() error {
-	return backend.Drop()
+	err := backend.Drop()
+	if err != nil {
+		return err
+	}
+
+	// the open trash outlives the dropped graph, so the path is kept
+	if trash != nil {
+		err = recordTrash(trash.store.Path())
+	}
+
+	return err
+}
+
+func ScanVertices(fn func(blend.Vertex) error) error {
+	scanner, ok := backend.(Scanner)
+	if !ok {
+		return errors.New("Storage backend does not support scanning")
+	}
+
+	return scanner.ScanVertices(fn)
+}
+
+func ScanEdges(fn func(blend.Edge) error) error {
+	scanner, ok := backend.(Scanner)
+	if !ok {
+		return errors.New("Storage backend does not support scanning")
+	}
+
+	return scanner.ScanEdges(fn)
+}
+
+func CacheStats() (blend.CacheStats, error) {
+	cacher, ok := backend.(Cacher)
+	if !ok {
+		return blend.CacheStats{}, errors.New("Storage backend does not use a cache")
+	}
+
+	return cacher.CacheStats(), nil
+}
+
+func SyncStatus() (blend.SyncStatus, error) {
+	syncer, ok := backend.(Syncer)
+	if !ok {
+		return blend.SyncStatus{}, errors.New("Storage backend does not queue writes")
+	}
+
+	return syncer.SyncStatus(), nil
 }
 
 func GetEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
-	return backend.GetEdges(v, e)
+	if m, id := resolveMount(v.Id); m != nil {
+		return m.GetEdges(v, e, id)
+	}
+
+	if trashed(v.Id) {
+		return nil, errors.New("Vertex not found.")
+	}
+
+	edges, err := backend.GetEdges(v, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if m := getMount(v.Id); m != nil {
+		edges = append(edges, m.rootEdges(e)...)
+	}
+
+	return visibleEdges(edges), nil
+}
+
+func GetIncomingEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
+	if m, id := resolveMount(v.Id); m != nil {
+		return m.GetIncomingEdges(v, e, id)
+	}
+
+	if trashed(v.Id) {
+		return nil, errors.New("Vertex not found.")
+	}
+
+	edges, err := backend.GetIncomingEdges(v, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return visibleEdges(edges), nil
 }
 
 func GetVertex(vertex *blend.Vertex) error {
@@ -71,28 +188,84 @@ func GetVertex(vertex *blend.Vertex) error {
 		return errors.New("Vertex Id not passed")
 	}
 
+	if m, id := resolveMount(vertex.Id); m != nil {
+		return m.GetVertex(vertex, id)
+	}
+
+	if trashed(vertex.Id) {
+		return errors.New("Vertex not found.")
+	}
+
 	return backend.GetVertex(vertex)
 }
 
 func GetChildVertex(v blend.Vertex, e blend.Edge) (blend.Vertex, error) {
-	return backend.GetChildVertex(v, e)
+	if m, id := resolveMount(v.Id); m != nil {
+		return m.GetChildVertex(v, e, id)
+	}
+
+	if trashed(v.Id) {
+		return blend.Vertex{}, errors.New("Vertex not found.")
+	}
+
+	child, err := backend.GetChildVertex(v, e)
+
+	// children of the vertex itself take precedence over the
+	// ones of the graph mounted at it
+	if m := getMount(v.Id); err != nil && m != nil {
+		return m.GetChildVertex(blend.Vertex{}, e, m.Root)
+	}
+
+	return child, err
 }
 
 func CreateChildVertex(v, vc *blend.Vertex, e blend.Edge) error {
-	if vc.Id == "" {
-		vid, err := uuid.NewV4()
-
-		if err != nil {
-			return err
-		}
+	err := rejectMounted(v.Id, vc.Id)
+	if err != nil {
+		return err
+	}
 
-		vc.Id = string(vid.String())
+	err = newVertex(vc)
+	if err != nil {
+		return err
 	}
 
 	e.To = vc.Id
 	e.From = v.Id
 
-	return backend.CreateChildVertex(v, vc, e)
+	if !ConfirmVertex(v.Id) {
+		return errors.New("Parent vertex not found")
+	}
+
+	unlock := trackChanges()
+	defer unlock()
+
+	// an existing child of the same name is updated instead
+	var existing *blend.Vertex
+	if changesTracked() {
+		child, err := backend.GetChildVertex(*v, blend.Edge{Family: "ownership", Type: e.Type, Name: e.Name})
+		if err == nil {
+			existing = &child
+		}
+	}
+
+	err = backend.CreateChildVertex(v, vc, e)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		recordChange(blend.Change{Type: "vertex:update", VertexBefore: existing, VertexAfter: vc})
+	} else {
+		e.Family = "ownership"
+		recordChange(blend.Change{Type: "vertex:create", VertexAfter: vc})
+		recordChange(blend.Change{Type: "edge:create", EdgeAfter: &e})
+	}
+
+	notify(vc.Id, "vertex:create")
+	notify(v.Id, "edge:create")
+
+	return nil
 }
 
 func CreateEdge(v, vc blend.Vertex, edge *blend.Edge) error {
@@ -101,32 +274,92 @@ func CreateEdge(v, vc blend.Vertex, edge *blend.Edge) error {
 		return errors.New("Edge Family not supported")
 	}
 
+	edge.From = v.Id
+	edge.To = vc.Id
+
 	// if no name given then make it unque by the edge_vertex
 	// as edges are unique with respect to the name
 	if edge.Name == "" {
 		edge.Name = edge.To
 	}
 
-	edge.From = v.Id
-	edge.To = vc.Id
+	err := rejectMounted(v.Id, vc.Id)
+	if err != nil {
+		return err
+	}
+
+	if !ConfirmVertex(v.Id) {
+		return errors.New("The edge from vertex not found")
+	}
 
-	return backend.CreateEdge(v, vc, edge)
+	if !ConfirmVertex(vc.Id) {
+		return errors.New("The edge to vertex not found")
+	}
+
+	unlock := trackChanges()
+	defer unlock()
+
+	var existing []blend.Edge
+	if changesTracked() {
+		existing, err = backend.GetEdges(v, blend.Edge{Family: edge.Family, Type: edge.Type, Name: edge.Name})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = backend.CreateEdge(v, vc, edge)
+	if err != nil {
+		return err
+	}
+
+	// backends keeping an edge of the same name return it as it is, others
+	// write the edge again, replacing the data of an edge to the same vertex
+	var before *blend.Edge
+	for i := range existing {
+		if existing[i].To == edge.To {
+			before = &existing[i]
+		}
+	}
+
+	if before == nil {
+		recordChange(blend.Change{Type: "edge:create", EdgeAfter: edge})
+	} else if before.Data != edge.Data {
+		recordChange(blend.Change{Type: "edge:update", EdgeBefore: before, EdgeAfter: edge})
+	}
+
+	notify(v.Id, "edge:create")
+
+	return nil
 }
 
 func CreateVertex(vertex *blend.Vertex) error {
-	if vertex.Id == "" {
-		vid, err := uuid.NewV4()
+	err := rejectMounted(vertex.Id)
+	if err != nil {
+		return err
+	}
 
+	err = newVertex(vertex)
+	if err != nil {
+		return err
+	}
+
+	// kept as a root before the vertex exists, so garbage collection never
+	// finds it without being one
+	if keeper, ok := backend.(RootKeeper); ok {
+		err = keeper.AddRoot(vertex.Id)
 		if err != nil {
 			return err
 		}
-
-		vertex.Id = string(vid.String())
 	}
 
-	err := backend.CreateVertex(vertex)
+	unlock := trackChanges()
+	defer unlock()
+
+	err = backend.CreateVertex(vertex)
 
 	if err == nil {
+		recordChange(blend.Change{Type: "vertex:create", VertexAfter: vertex})
+
 		err = PropogateChanges(*vertex, blend.Event{
 			Source:  vertex.Id,
 			Type:    "vertex:create",
@@ -137,27 +370,120 @@ func CreateVertex(vertex *blend.Vertex) error {
 	return err
 }
 
+// fills in the id and creation time of a vertex about to be created
+// unless they were given
+func newVertex(vertex *blend.Vertex) error {
+	if vertex.Id == "" {
+		vid, err := uuid.NewV4()
+
+		if err != nil {
+			return err
+		}
+
+		vertex.Id = string(vid.String())
+	}
+
+	if vertex.LastChanged.IsZero() {
+		vertex.LastChanged = time.Now()
+	}
+
+	return nil
+}
+
 func UpdateVertex(vertex *blend.Vertex) error {
 	if vertex.Id == "" {
 		return errors.New("Vertex Id not passed")
 	}
 
-	return backend.UpdateVertex(vertex)
+	err := rejectMounted(vertex.Id)
+	if err != nil {
+		return err
+	}
+
+	unlock := trackChanges()
+	defer unlock()
+
+	var before *blend.Vertex
+	if changesTracked() {
+		v := blend.Vertex{Id: vertex.Id, PrivateKey: vertex.PrivateKey}
+		if backend.GetVertex(&v) == nil {
+			before = &v
+		}
+	}
+
+	err = backend.UpdateVertex(vertex)
+	if err != nil {
+		return err
+	}
+
+	recordChange(blend.Change{Type: "vertex:update", VertexBefore: before, VertexAfter: vertex})
+	notify(vertex.Id, "vertex:update")
+
+	return nil
 }
 
-func DeleteVertex(vertex *blend.Vertex) error {
-	return DeleteVertexTree([]*blend.Vertex{vertex})
+func DeleteEdge(edge blend.Edge) error {
+	if edge.From == "" || edge.Family == "" {
+		return errors.New("Edge source vertex or family not passed")
+	}
+
+	err := rejectMounted(edge.From)
+	if err != nil {
+		return err
+	}
+
+	unlock := trackChanges()
+	defer unlock()
+
+	var before *blend.Edge
+	if changesTracked() {
+		edges, _ := backend.GetEdges(blend.Vertex{Id: edge.From}, edge)
+		for i := range edges {
+			if edges[i].To == edge.To {
+				before = &edges[i]
+			}
+		}
+	}
+
+	err = backend.DeleteEdge(edge)
+	if err != nil {
+		return err
+	}
+
+	// nothing to log if the edge did not exist
+	if before != nil {
+		recordChange(blend.Change{Type: "edge:delete", EdgeBefore: before})
+	}
+
+	notify(edge.From, "edge:delete")
+
+	return nil
 }
 
-func DeleteVertexTree(vertices []*blend.Vertex) error {
-	return backend.DeleteVertexTree(vertices)
+func DeleteVertex(vertex *blend.Vertex) error {
+	_, err := DeleteVertexTree([]*blend.Vertex{vertex}, nil)
+	return err
 }
 
 func PropogateChanges(vertex blend.Vertex, event blend.Event) error {
+	events.Dispatch(vertex.Id, event)
 	return nil
 }
 
+func notify(vid, eventType string) {
+	PropogateChanges(blend.Vertex{Id: vid}, blend.Event{
+		Source:  vid,
+		Type:    eventType,
+		Created: time.Now(),
+	})
+}
+
+// trashed vertices are not confirmed
 func ConfirmVertex(vid string) bool {
+	if trashed(vid) {
+		return false
+	}
+
 	err := backend.GetVertex(&blend.Vertex{Id: vid})
 	if err != nil {
 		return false
@@ -167,6 +493,10 @@ func ConfirmVertex(vid string) bool {
 }
 
 func ConfirmVertexKey(vid, vkey string) bool {
+	if trashed(vid) {
+		return false
+	}
+
 	vertex := &blend.Vertex{Id: vid, PrivateKey: vkey}
 	err := backend.GetVertex(vertex)
 	if err != nil {
@@ -175,3 +505,16 @@ func ConfirmVertexKey(vid, vkey string) bool {
 
 	return true
 }
+
+// Leaves out the private data of a vertex read by a backend unless the
+// private key is given, fails if a different key is given
+func checkVertexKey(vertex *blend.Vertex, key string) error {
+	if key == "" {
+		vertex.PrivateKey = ""
+		vertex.Private = ""
+	} else if vertex.PrivateKey != key {
+		return errors.New("Wront private key supplied for vertex")
+	}
+
+	return nil
+}
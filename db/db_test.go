@@ -1,10 +1,33 @@
 package db
 
 import (
+	"errors"
+	"fmt"
+	"github.com/gocql/gocql"
 	"github.com/ziahamza/blend"
+	"path"
+	"sync"
 	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
 )
 
+// Opens an empty bolt graph in a temporary directory, closed along with
+// the test. Returns the directory for the other databases of the test.
+func initTestGraph(t *testing.T) string {
+	dir := t.TempDir()
+
+	err := Init(path.Join(dir, "graph.db"), &BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(Close)
+
+	return dir
+}
+
 func testVertexTree(t *testing.T) {
 
 	vertex := &blend.Vertex{
@@ -90,6 +113,456 @@ func TestBolt(t *testing.T) {
 
 	testVertexTree(t)
 	testAddDel(t)
+	testGarbageCollection(t)
+	testIntegrity(t)
+	testDeleteTree(t)
+}
+
+func TestSQL(t *testing.T) {
+	err := Init("sqlite::memory:", &SQLStorage{})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	defer Close()
+
+	testVertexTree(t)
+	testAddDel(t)
+	testGarbageCollection(t)
+	testIntegrity(t)
+	testDeleteTree(t)
+}
+
+// scans call back into the backend, like an export running next to other
+// requests, and writes to a sqlite file wait on each other
+func TestSQLConnections(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, uri := range []string{"sqlite::memory:", "sqlite://" + path.Join(dir, "graph.sqlite")} {
+		err := Init(uri, &SQLStorage{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- CreateVertex(&blend.Vertex{Name: fmt.Sprint(i), Type: "test"})
+			}(i)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal("Concurrent write failed", uri, err)
+			}
+		}
+
+		scanned := 0
+		err = ScanVertices(func(v blend.Vertex) error {
+			scanned++
+			return GetVertex(&blend.Vertex{Id: v.Id})
+		})
+
+		if err != nil || scanned != 20 {
+			t.Fatal("Got back different vertices then expected", uri, scanned, err)
+		}
+
+		err = backend.(RootKeeper).ScanRoots(func(id string) error {
+			return GetVertex(&blend.Vertex{Id: id})
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		Close()
+	}
+}
+
+// runs against the cql stand-in, the cassandra backend keeps no roots
+// so garbage collection is left out
+func TestCassandra(t *testing.T) {
+	err := Init("", &CassandraStorage{connect: newFakeCluster().connect})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	defer Close()
+
+	testVertexTree(t)
+	testAddDel(t)
+	testIntegrity(t)
+	testDeleteTree(t)
+	testCassandraEdges(t)
+	testCassandraWrites(t)
+}
+
+// a migration failing after it changed the schema is run again in full
+// on the next start
+func TestCassandraMigrateAgain(t *testing.T) {
+	storage := &CassandraStorage{connect: newFakeCluster().connect}
+
+	err := storage.Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	var lock int
+	err = storage.session.Query(
+		`SELECT version FROM schema_version WHERE version = ?;`, schemaLockVersion,
+	).Scan(&lock)
+
+	if err != gocql.ErrNotFound {
+		t.Fatal("Schema still locked after migrating", err)
+	}
+
+	changed := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	for id, at := range map[string]interface{}{"changed": changed, "unchanged": nil} {
+		err = storage.session.Query(
+			`UPDATE vertices SET vertex_name = ?, changed_at = ? WHERE vertex_id = ?;`, id, at, id,
+		).Exec()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// as if the node stopped before recording the columns it added
+	for _, m := range cassandraMigrations[1:] {
+		err = storage.session.Query(`DELETE FROM schema_version WHERE version = ?;`, m.Version).Exec()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = storage.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := storage.SchemaVersion()
+	if err != nil || version != len(cassandraMigrations) {
+		t.Fatal("Schema not migrated to the latest version", version, err)
+	}
+
+	for id, expected := range map[string]bool{"changed": true, "unchanged": false} {
+		var at time.Time
+
+		err = storage.session.Query(
+			`SELECT changed_at FROM vertices WHERE vertex_id = ?;`, id,
+		).Scan(&at)
+
+		if err != nil || at.IsZero() || at.Equal(changed) != expected {
+			t.Fatal("Got back a different change time then expected", id, at, err)
+		}
+	}
+}
+
+// a migration outlasting the ttl of the lock keeps it, nodes waiting for
+// it keep waiting and a lock taken over stops the migration
+func TestCassandraSchemaLock(t *testing.T) {
+	ttl, renewal := schemaLockTTL, schemaLockRenewal
+	schemaLockTTL, schemaLockRenewal = time.Second, 100*time.Millisecond
+
+	defer func() {
+		schemaLockTTL, schemaLockRenewal = ttl, renewal
+	}()
+
+	storage := &CassandraStorage{connect: newFakeCluster().connect}
+
+	err := storage.Init("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	lease, err := storage.lockSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another node sharing the keyspace
+	other := &CassandraStorage{session: storage.session, opts: storage.opts}
+
+	waiting := make(chan *schemaLease)
+	go func() {
+		lease, err := other.lockSchema()
+		if err != nil {
+			t.Error(err)
+		}
+
+		waiting <- lease
+	}()
+
+	time.Sleep(2 * schemaLockTTL)
+
+	if err = lease.check(); err != nil {
+		t.Fatal("Lock not renewed while migrating", err)
+	}
+
+	select {
+	case <-waiting:
+		t.Fatal("Took the lock of a running migration")
+	default:
+	}
+
+	lease.release()
+
+	taken := <-waiting
+	if taken == nil || taken.check() != nil {
+		t.Fatal("Lock not taken after the migration released it")
+	}
+
+	// as if the lock expired and a third node took it over
+	_, err = storage.session.Query(
+		`DELETE FROM schema_version WHERE version = ? IF EXISTS;`, schemaLockVersion,
+	).MapScanCAS(map[string]interface{}{})
+
+	if err == nil {
+		_, err = storage.session.Query(
+			`INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?) IF NOT EXISTS;`,
+			schemaLockVersion, "migration lock of another node", time.Now(),
+		).MapScanCAS(map[string]interface{}{})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * schemaLockRenewal)
+
+	if taken.check() == nil {
+		t.Fatal("Migration went on after losing the lock")
+	}
+
+	taken.release()
+
+	var owner string
+	err = storage.session.Query(
+		`SELECT description FROM schema_version WHERE version = ?;`, schemaLockVersion,
+	).Scan(&owner)
+
+	if err != nil || owner != "migration lock of another node" {
+		t.Fatal("Released a lock taken over by another node", owner, err)
+	}
+}
+
+// the ownership edge of a new child goes from its parent to it, and edges
+// written again are overwritten as their batches cannot be conditional
+func testCassandraWrites(t *testing.T) {
+	parent := &blend.Vertex{Name: "TestParent", Type: "test"}
+	child := &blend.Vertex{Name: "TestChild", Type: "test"}
+
+	err := CreateVertex(parent)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	err = CreateChildVertex(parent, child, blend.Edge{Type: "test", Name: "child"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	edges, err := GetEdges(*parent, blend.Edge{Family: "ownership"})
+	if err != nil || len(edges) != 1 || edges[0].To != child.Id {
+		t.Error("Got back different ownership edges then expected", edges, err)
+		return
+	}
+
+	edges, err = GetIncomingEdges(*child, blend.Edge{Family: "ownership"})
+	if err != nil || len(edges) != 1 || edges[0].From != parent.Id {
+		t.Error("Got back different incoming edges then expected", edges, err)
+		return
+	}
+
+	for _, data := range []string{"first", "second"} {
+		err = CreateEdge(*parent, *child, &blend.Edge{Family: "public", Type: "link", Name: "child", Data: data})
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+	}
+
+	edges, err = GetEdges(*parent, blend.Edge{Family: "public"})
+	if err != nil || len(edges) != 1 || edges[0].Data != "second" {
+		t.Error("Edge written again was not overwritten", edges, err)
+		return
+	}
+}
+
+func testCassandraEdges(t *testing.T) {
+	storage := backend.(*CassandraStorage)
+
+	version, err := storage.SchemaVersion()
+	if err != nil || version != len(cassandraMigrations) {
+		t.Error("Schema not migrated to the latest version", version, err)
+		return
+	}
+
+	source := &blend.Vertex{Name: "TestSource", Type: "test"}
+	target := &blend.Vertex{Name: "TestTarget", Type: "test"}
+
+	for _, v := range []*blend.Vertex{source, target} {
+		err := CreateVertex(v)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+	}
+
+	err = CreateEdge(*source, *target, &blend.Edge{Family: "public", Type: "link", Name: "target"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	edges, err := GetEdges(*source, blend.Edge{})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(edges) != 1 || edges[0].From != source.Id || edges[0].LastChanged == "" {
+		t.Error("Got back different edges then expected", edges)
+		return
+	}
+
+	changed, err := time.Parse(time.RFC3339Nano, edges[0].LastChanged)
+	if err != nil || time.Since(changed) > time.Minute {
+		t.Error("Got back a different edge change time then expected", edges[0].LastChanged, err)
+		return
+	}
+
+	for _, e := range []blend.Edge{
+		{Family: "public", Type: "link", Name: "second"},
+		{Family: "public", Type: "note", Name: "first"},
+		{Family: "private", Type: "link", Name: "secret"},
+	} {
+		err = CreateEdge(*source, *target, &e)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+	}
+
+	// the query narrows down by family, type and name in that order
+	for _, test := range []struct {
+		filter blend.Edge
+		count  int
+	}{
+		{blend.Edge{}, 3},
+		{blend.Edge{Type: "link"}, 2},
+		{blend.Edge{Type: "link", Name: "second"}, 1},
+		{blend.Edge{Name: "second"}, 3},
+		{blend.Edge{Family: "private"}, 1},
+		{blend.Edge{Family: "private", Type: "note"}, 0},
+	} {
+		edges, err = GetEdges(*source, test.filter)
+		if err != nil || len(edges) != test.count {
+			t.Error("Got back a different number of edges then expected", test.filter, edges, err)
+			return
+		}
+
+		for _, e := range edges {
+			if e.From != source.Id || e.To != target.Id {
+				t.Error("Got back a different edge then expected", e)
+				return
+			}
+		}
+	}
+
+	// pages of two edges, each resumed at the state of the page before
+	names := map[string]bool{}
+	var state []byte
+
+	for pages := 1; ; pages++ {
+		page, next, err := storage.GetEdgesPage(*source, blend.Edge{}, state, 2)
+		if err != nil || len(page) > 2 {
+			t.Error("Got back a different page then expected", page, err)
+			return
+		}
+
+		for _, e := range page {
+			names[e.Name] = true
+		}
+
+		if len(next) == 0 {
+			if pages != 2 || len(names) != 3 {
+				t.Error("Got back different pages then expected", pages, names)
+				return
+			}
+
+			break
+		}
+
+		state = next
+	}
+
+	// edges written before their changes were tracked
+	err = storage.session.Query(
+		`INSERT INTO edges (from_vertex_id, to_vertex_id, edge_family, edge_type, edge_name)
+		VALUES (?, ?, ?, ?, ?);`,
+		source.Id, target.Id, "legacy", "link", "old",
+	).Exec()
+
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	edges, err = GetEdges(*source, blend.Edge{Family: "legacy"})
+	if err != nil || len(edges) != 1 || edges[0].From != source.Id || edges[0].LastChanged != "" {
+		t.Error("Got back different untracked edges then expected", edges, err)
+		return
+	}
+
+	// a page failing half way through fails the whole read
+	cluster := storage.session.(fakeSession).cluster
+	cluster.failPages = errors.New("Page not fetched")
+
+	edges, err = GetEdges(*source, blend.Edge{})
+	cluster.failPages = nil
+
+	if err == nil || edges != nil {
+		t.Error("Reading edges with a failing page did not fail", edges)
+		return
+	}
+	err = storage.session.Query("DROP TABLE edges;").Exec()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	_, err = GetEdges(*source, blend.Edge{})
+	if err == nil {
+		t.Error("Reading edges of a missing table did not fail")
+		return
+	}
+
+	err = Drop()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if ConfirmVertex(source.Id) {
+		t.Error("Vertex still there after dropping the graph")
+	}
 }
 
 func testAddDel(t *testing.T) {
@@ -123,3 +596,308 @@ func testAddDel(t *testing.T) {
 		return
 	}
 }
+
+func testGarbageCollection(t *testing.T) {
+	root := &blend.Vertex{Name: "TestGCRoot", Type: "test"}
+	err := CreateVertex(root)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	child := &blend.Vertex{Name: "TestGCChild", Type: "test"}
+	err = CreateChildVertex(root, child, blend.Edge{Type: "child", Name: "gc"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	// a vertex created with an owner is garbage once its owner lets go
+	// of it, while one created without an owner is a root
+	orphan := &blend.Vertex{Name: "TestGCOrphan", Type: "test"}
+	err = CreateChildVertex(root, orphan, blend.Edge{Type: "child", Name: "orphan"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	err = DeleteEdge(blend.Edge{Family: "ownership", Type: "child", Name: "orphan", From: root.Id, To: orphan.Id})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	// leave a dangling edge behind by deleting its target without
+	// going through the delete policies
+	missing := &blend.Vertex{Name: "TestGCMissing", Type: "test"}
+	err = CreateVertex(missing)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	dangling := &blend.Edge{Family: "public", Type: "link", Name: "missing"}
+	err = CreateEdge(*root, *missing, dangling)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	err = backend.DeleteVertex(missing)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	orphanEdge := &blend.Edge{Family: "public", Type: "link", Name: "orphan"}
+	err = CreateEdge(*child, *orphan, orphanEdge)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	_, err = CollectGarbage(GCOptions{Roots: []string{"TestGCMissingRoot"}, DryRun: true})
+	if err == nil {
+		t.Error("Garbage collection ran with a root that does not exist")
+		return
+	}
+
+	opts := GCOptions{DryRun: true}
+
+	result, err := CollectGarbage(opts)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	found := false
+	for _, e := range result.DanglingEdges {
+		if e.From == root.Id && e.Name == dangling.Name {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("Dangling edge not reported by garbage collection")
+		return
+	}
+
+	found = false
+	for _, id := range result.Unreachable {
+		if id == root.Id || id == child.Id {
+			t.Error("Reachable vertex reported as garbage: " + id)
+			return
+		}
+
+		if id == orphan.Id {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("Unreachable vertex not reported by garbage collection")
+		return
+	}
+
+	if !ConfirmVertex(orphan.Id) {
+		t.Error("Garbage collection dry run removed a vertex")
+		return
+	}
+
+	opts.DryRun = false
+	result, err = CollectGarbage(opts)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if ConfirmVertex(orphan.Id) || !ConfirmVertex(root.Id) || !ConfirmVertex(child.Id) {
+		t.Error("Garbage collection removed the wrong vertices")
+		return
+	}
+
+	edges, err := GetEdges(*root, blend.Edge{Family: "public"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	childEdges, err := GetEdges(*child, blend.Edge{Family: "public"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(edges) != 0 || len(childEdges) != 0 {
+		t.Error("Garbage collection left dangling edges behind")
+		return
+	}
+
+	err = DeleteVertex(root)
+	if err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func testIntegrity(t *testing.T) {
+	source := &blend.Vertex{Name: "TestSource", Type: "test"}
+	target := &blend.Vertex{Name: "TestTarget", Type: "test"}
+
+	for _, v := range []*blend.Vertex{source, target} {
+		err := CreateVertex(v)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+	}
+
+	err := CreateEdge(*source, blend.Vertex{Id: "missing vertex"}, &blend.Edge{
+		Family: "public", Type: "link", Name: "missing",
+	})
+
+	if err == nil {
+		t.Error("Created an edge to a vertex that does not exist")
+		return
+	}
+
+	err = CreateEdge(*source, *target, &blend.Edge{
+		Family: "public", Type: "link", Name: "target",
+	})
+
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	incoming, err := GetIncomingEdges(*target, blend.Edge{})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(incoming) != 1 || incoming[0].From != source.Id {
+		t.Error("Got back different incoming edges then expected", incoming)
+		return
+	}
+
+	SetDeletePolicy("public", RestrictDelete)
+	defer SetDeletePolicy("public", CascadeDelete)
+
+	err = DeleteVertex(target)
+	if err == nil || !ConfirmVertex(target.Id) {
+		t.Error("Deleted a vertex with restricted incoming edges")
+		return
+	}
+
+	SetDeletePolicy("public", CascadeDelete)
+
+	err = DeleteVertex(target)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	edges, err := GetEdges(*source, blend.Edge{Family: "public"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(edges) != 0 {
+		t.Error("Incoming edges not removed along with the vertex")
+		return
+	}
+
+	err = DeleteVertex(source)
+	if err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func testDeleteTree(t *testing.T) {
+	root := &blend.Vertex{Name: "TestTreeRoot", Type: "test"}
+	err := CreateVertex(root)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	// a chain of children deep enough to span multiple delete batches
+	parent := root
+	for i := 0; i < deleteBatchSize+10; i++ {
+		child := &blend.Vertex{Name: "TestTreeChild", Type: "test"}
+		err = CreateChildVertex(parent, child, blend.Edge{Type: "child", Name: "next"})
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		parent = child
+	}
+
+	// close the chain into a cycle of ownership edges
+	err = CreateEdge(*parent, *root, &blend.Edge{Family: "ownership", Type: "child", Name: "cycle"})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	job, err := StartDeleteVertexTree([]*blend.Vertex{root})
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	for job.Status == "running" {
+		time.Sleep(10 * time.Millisecond)
+
+		job, err = GetJob(job.Id)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+	}
+
+	if job.Status != "done" {
+		t.Error("Deleting the vertex tree failed: " + job.Message)
+		return
+	}
+
+	if job.Deleted.Vertices != deleteBatchSize+11 || job.Deleted.Cycles != 1 {
+		t.Error("Got back different delete stats then expected", job.Deleted)
+		return
+	}
+
+	if job.Deleted.Edges != deleteBatchSize+11 {
+		t.Error("Got back different number of deleted edges then expected", job.Deleted)
+		return
+	}
+
+	if ConfirmVertex(root.Id) || ConfirmVertex(parent.Id) {
+		t.Error("Could not delete the entire vertex tree")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	names := Backends()
+	if len(names) != 4 || names[0] != "cassandra" || names[1] != "local" || names[3] != "sql" {
+		t.Error("Got back different backends then expected", names)
+		return
+	}
+
+	s, err := NewStorage("local")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if _, ok := s.(*BoltStorage); !ok {
+		t.Error("Local backend is not bolt storage")
+		return
+	}
+
+	_, err = NewStorage("missing")
+	if err == nil {
+		t.Error("Created a backend that was never registered")
+	}
+}
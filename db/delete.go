@@ -0,0 +1,172 @@
+// deletion of entire vertex trees
+package db
+
+import (
+	"github.com/ziahamza/blend"
+)
+
+// maximum number of vertices deleted in a single backend transaction
+const deleteBatchSize = 128
+
+// Walks the ownership edges below the vertices depth first without
+// recursing. Returns the ids with every vertex listed before its owner,
+// so deleting them in order never disconnects the part of a tree that
+// is left, along with the number of ownership edges pointing back to an
+// ancestor. Vertices owned more than once are listed only once.
+func collectTree(vertices []*blend.Vertex) ([]string, int, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	type frame struct {
+		id       string
+		children []string
+	}
+
+	state := map[string]int{}
+	order := []string{}
+	cycles := 0
+
+	stack := []*frame{}
+	push := func(id string) error {
+		edges, err := backend.GetEdges(blend.Vertex{Id: id}, blend.Edge{Family: "ownership"})
+		if err != nil {
+			return err
+		}
+
+		children := []string{}
+		for _, e := range edges {
+			children = append(children, e.To)
+		}
+
+		state[id] = visiting
+		stack = append(stack, &frame{id: id, children: children})
+
+		return nil
+	}
+
+	for _, v := range vertices {
+		if state[v.Id] != 0 {
+			continue
+		}
+
+		err := push(v.Id)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+
+			if len(top.children) == 0 {
+				state[top.id] = visited
+				order = append(order, top.id)
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			child := top.children[0]
+			top.children = top.children[1:]
+
+			switch state[child] {
+			case visiting:
+				cycles++
+			case visited:
+				// already owned by another vertex in the tree
+			default:
+				err = push(child)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+
+	return order, cycles, nil
+}
+
+// Optionally implemented by backends that hand entire tree deletions over
+// to another graph, which takes care of the delete policies on its own
+type TreeDeleter interface {
+	DeleteVertexTree([]*blend.Vertex) (blend.DeleteStats, error)
+}
+
+// Deletes the vertices and everything they own. Incoming edges from outside
+// the trees are handled according to the delete policies before anything
+// is deleted. The vertices are then deleted in bounded batches, the
+// progress function (if not nil) is called after every batch. On failure
+// the stats hold whatever was deleted so far.
+func DeleteVertexTree(vertices []*blend.Vertex, progress func(blend.DeleteStats)) (blend.DeleteStats, error) {
+	stats := blend.DeleteStats{}
+
+	for _, v := range vertices {
+		err := rejectMounted(v.Id)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if deleter, ok := backend.(TreeDeleter); ok {
+		stats, err := deleter.DeleteVertexTree(vertices)
+		if err == nil && progress != nil {
+			progress(stats)
+		}
+
+		return stats, err
+	}
+
+	ids, cycles, err := collectTree(vertices)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Cycles = cycles
+
+	stats.Edges, err = removeIncomingEdges(ids)
+	if err != nil {
+		return stats, err
+	}
+
+	for len(ids) > 0 {
+		size := deleteBatchSize
+		if len(ids) < size {
+			size = len(ids)
+		}
+
+		batch := []*blend.Vertex{}
+		for _, id := range ids[:size] {
+			batch = append(batch, &blend.Vertex{Id: id})
+		}
+
+		ids = ids[size:]
+
+		unlock := trackChanges()
+		changes := deletedVertices(batch)
+
+		edges, err := backend.DeleteVertices(batch)
+		if err != nil {
+			unlock()
+			return stats, err
+		}
+
+		for _, change := range changes {
+			recordChange(change)
+		}
+
+		unlock()
+
+		for _, v := range batch {
+			notify(v.Id, "vertex:delete")
+		}
+
+		stats.Vertices += len(batch)
+		stats.Edges += edges
+
+		if progress != nil {
+			progress(stats)
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,242 @@
+// remote graphs mounted under local vertices
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ziahamza/blend"
+)
+
+// Vertices of a mounted graph are addressed locally by the id of the
+// vertex it is mounted at, followed by this separator and their id in
+// the mounted graph. Mounting a graph that mounts others again nests
+// the ids.
+const MountSeparator = "@"
+
+type mount struct {
+	blend.Mount
+	client *rpcClient
+}
+
+var mounts struct {
+	sync.RWMutex
+	byVertex map[string]*mount
+}
+
+// Attaches the graph served by the rpc url of the mount at its local
+// vertex. Reads of the vertex also return the edges of the root vertex in
+// the mounted graph, which makes everything below it reachable from the
+// local graph. The mounted vertices cannot be changed through the local
+// graph. Mounts are only kept in memory.
+func Mount(bm blend.Mount) error {
+	if bm.Vertex == "" || bm.URL == "" {
+		return errors.New("Mount vertex and graph url have to be supplied")
+	}
+
+	if strings.Contains(bm.Vertex, MountSeparator) {
+		return errors.New("Graphs can only be mounted at local vertices")
+	}
+
+	if bm.Root == "" {
+		bm.Root = "root"
+	}
+
+	if !ConfirmVertex(bm.Vertex) {
+		return errors.New("Mount vertex not found")
+	}
+
+	m := &mount{Mount: bm, client: newRPCClient(bm.URL)}
+
+	mounts.Lock()
+	defer mounts.Unlock()
+
+	if mounts.byVertex == nil {
+		mounts.byVertex = map[string]*mount{}
+	}
+
+	if existing := mounts.byVertex[bm.Vertex]; existing != nil {
+		existing.client.Close()
+	}
+
+	mounts.byVertex[bm.Vertex] = m
+
+	return nil
+}
+
+func Unmount(vertexId string) error {
+	mounts.Lock()
+	defer mounts.Unlock()
+
+	m := mounts.byVertex[vertexId]
+	if m == nil {
+		return errors.New("No graph mounted at the vertex")
+	}
+
+	m.client.Close()
+	delete(mounts.byVertex, vertexId)
+
+	return nil
+}
+
+// Lists the mounted graphs ordered by the vertex they are mounted at
+func Mounts() []blend.Mount {
+	mounts.RLock()
+	defer mounts.RUnlock()
+
+	list := []blend.Mount{}
+	for _, m := range mounts.byVertex {
+		list = append(list, m.Mount)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Vertex < list[j].Vertex })
+
+	return list
+}
+
+func getMount(vertexId string) *mount {
+	mounts.RLock()
+	defer mounts.RUnlock()
+
+	return mounts.byVertex[vertexId]
+}
+
+// Splits the id of a vertex in a mounted graph into its mount and its id
+// in the mounted graph. Returns a nil mount for local vertices.
+func resolveMount(id string) (*mount, string) {
+	i := strings.Index(id, MountSeparator)
+	if i < 0 {
+		return nil, id
+	}
+
+	return getMount(id[:i]), id[i+len(MountSeparator):]
+}
+
+// writes only reach the local graph
+func rejectMounted(ids ...string) error {
+	for _, id := range ids {
+		if strings.Contains(id, MountSeparator) {
+			return fmt.Errorf("Vertex %s belongs to a mounted graph, change it through its own graph", id)
+		}
+	}
+
+	return nil
+}
+
+func (m *mount) call(req blend.APIRequest) (blend.APIResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultProxyTimeout)
+	defer cancel()
+
+	resp, err := m.client.Call(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	if !resp.Success {
+		return resp, errors.New(resp.Message)
+	}
+
+	return resp, nil
+}
+
+// the local id of a vertex in the mounted graph, its root is the
+// vertex it is mounted at
+func (m *mount) localId(id string) string {
+	if id == m.Root {
+		return m.Vertex
+	}
+
+	return m.Vertex + MountSeparator + id
+}
+
+func (m *mount) localEdges(edges []blend.Edge) []blend.Edge {
+	for i := range edges {
+		edges[i].From = m.localId(edges[i].From)
+		edges[i].To = m.localId(edges[i].To)
+	}
+
+	return edges
+}
+
+func (m *mount) GetVertex(v *blend.Vertex, id string) error {
+	resp, err := m.call(blend.APIRequest{
+		Method: "/vertex/get",
+		Vertex: blend.Vertex{Id: id, PrivateKey: v.PrivateKey},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	*v = *resp.Vertex
+	v.Id = m.localId(v.Id)
+
+	return nil
+}
+
+func (m *mount) GetEdges(v blend.Vertex, e blend.Edge, id string) ([]blend.Edge, error) {
+	if e.Family == "" {
+		e.Family = "public"
+	}
+
+	resp, err := m.call(blend.APIRequest{
+		Method: "/edge/get",
+		Vertex: blend.Vertex{Id: id, PrivateKey: v.PrivateKey},
+		Edge:   e,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.localEdges(*resp.Edges), nil
+}
+
+func (m *mount) GetIncomingEdges(v blend.Vertex, e blend.Edge, id string) ([]blend.Edge, error) {
+	resp, err := m.call(blend.APIRequest{
+		Method: "/edge/getIncoming",
+		Vertex: blend.Vertex{Id: id, PrivateKey: v.PrivateKey},
+		Edge:   e,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.localEdges(*resp.Edges), nil
+}
+
+func (m *mount) GetChildVertex(v blend.Vertex, e blend.Edge, id string) (blend.Vertex, error) {
+	resp, err := m.call(blend.APIRequest{
+		Method: "/vertex/getChild",
+		Vertex: blend.Vertex{Id: id, PrivateKey: v.PrivateKey},
+		Edge:   e,
+	})
+
+	if err != nil {
+		return blend.Vertex{}, err
+	}
+
+	vertex := *resp.Vertex
+	vertex.Id = m.localId(vertex.Id)
+
+	return vertex, nil
+}
+
+// The edges of the mounted root added to those of the vertex it is
+// mounted at. The private key of the local vertex means nothing to the
+// mounted graph, so only what it shows without one is added. An
+// unreachable mounted graph leaves the local edges on their own.
+func (m *mount) rootEdges(e blend.Edge) []blend.Edge {
+	edges, err := m.GetEdges(blend.Vertex{}, e, m.Root)
+	if err != nil {
+		fmt.Printf("Cannot read graph mounted at %s: %s \n", m.Vertex, err.Error())
+		return nil
+	}
+
+	return edges
+}
@@ -0,0 +1,97 @@
+package db_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/api"
+	"github.com/ziahamza/blend/db"
+)
+
+func TestMount(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = db.Init(path.Join(dir, "mount.db"), &db.BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// the graph mounts a part of itself through its own api
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	remoteRoot := &blend.Vertex{Id: "remote", Name: "remote", Type: "test", PrivateKey: "remote key"}
+	mountPoint := &blend.Vertex{Id: "team", Name: "team", Type: "test", PrivateKey: "team key"}
+
+	for _, v := range []*blend.Vertex{remoteRoot, mountPoint} {
+		err = db.CreateVertex(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	child := &blend.Vertex{Id: "doc", Name: "doc", Type: "test", Public: "remote data"}
+	err = db.CreateChildVertex(remoteRoot, child, blend.Edge{Type: "file", Name: "doc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CreateEdge(*remoteRoot, *child, &blend.Edge{Family: "public", Type: "link", Name: "doc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Mount(blend.Mount{
+		Vertex: "team",
+		URL:    "ws" + strings.TrimPrefix(server.URL, "http") + "/graph/rpc",
+		Root:   "remote",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Unmount("team")
+
+	edges, err := db.GetEdges(*mountPoint, blend.Edge{Family: "public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(edges) != 1 || edges[0].From != "team" || edges[0].To != "team"+db.MountSeparator+"doc" {
+		t.Fatal("Got back different edges then expected for the mount point", edges)
+	}
+
+	mounted, err := db.GetChildVertex(blend.Vertex{Id: "team"}, blend.Edge{
+		Family: "ownership", Type: "file", Name: "doc",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mounted.Id != edges[0].To || mounted.Public != "remote data" {
+		t.Fatal("Got back different child vertex then expected", mounted)
+	}
+
+	err = db.GetVertex(&mounted)
+	if err != nil || mounted.Id != edges[0].To {
+		t.Fatal("Cannot read a vertex of the mounted graph", mounted, err)
+	}
+
+	mounted.Public = "changed"
+	if db.UpdateVertex(&mounted) == nil {
+		t.Fatal("Updated a vertex of a mounted graph")
+	}
+}
@@ -0,0 +1,283 @@
+// garbage collection of dangling edges and unreachable vertices
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ziahamza/blend"
+)
+
+// Optionally implemented by backends that keep the ids of the vertices
+// created without an owner. Garbage collection keeps them as roots, a
+// vertex is removed from the roots along with the vertex.
+type RootKeeper interface {
+	AddRoot(id string) error
+
+	// Calls the function for every root, stops at the first error returned
+	ScanRoots(func(string) error) error
+}
+
+type GCOptions struct {
+	// vertices that are always reachable besides the ones created without
+	// an owner, every other vertex has to be owned by one of them (directly
+	// or through other vertices). Each of them has to exist.
+	Roots []string
+
+	// only report the garbage, without removing anything
+	DryRun bool
+}
+
+type GCResult struct {
+	// edges with either end pointing to a vertex that does not exist
+	DanglingEdges []blend.Edge `json:"dangling_edges"`
+
+	// vertices not owned by any of the roots
+	Unreachable []string `json:"unreachable_vertices"`
+
+	// number of edges and vertices actually removed, always zero
+	// for a dry run
+	RemovedEdges    int `json:"removed_edges"`
+	RemovedVertices int `json:"removed_vertices"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Scans the entire graph for garbage and removes it unless its a dry run.
+// The backend needs to support scanning, and has to keep its roots for
+// anything to be removed.
+func CollectGarbage(opts GCOptions) (GCResult, error) {
+	result := GCResult{
+		DanglingEdges: []blend.Edge{},
+		Unreachable:   []string{},
+		Started:       time.Now(),
+	}
+
+	vertices := map[string]bool{}
+	err := ScanVertices(func(v blend.Vertex) error {
+		vertices[v.Id] = true
+		return nil
+	})
+
+	if err != nil {
+		return result, err
+	}
+
+	edges := []blend.Edge{}
+	err = ScanEdges(func(e blend.Edge) error {
+		edges = append(edges, e)
+		return nil
+	})
+
+	if err != nil {
+		return result, err
+	}
+
+	roots := []string{}
+	for _, id := range opts.Roots {
+		if id == "" {
+			continue
+		}
+
+		if !vertices[id] {
+			return result, fmt.Errorf("Root vertex %s not found", id)
+		}
+
+		roots = append(roots, id)
+	}
+
+	if keeper, ok := backend.(RootKeeper); ok {
+		err = keeper.ScanRoots(func(id string) error {
+			roots = append(roots, id)
+			return nil
+		})
+
+		if err != nil {
+			return result, err
+		}
+	} else if !opts.DryRun {
+		// without them every vertex created through CreateVertex would be
+		// taken for garbage
+		return result, errors.New("Storage backend does not keep its root vertices, garbage can only be reported")
+	}
+
+	if trash == nil && !opts.DryRun {
+		path, err := RecordedTrash()
+		if err != nil {
+			return result, err
+		}
+
+		if path != "" {
+			return result, fmt.Errorf("Deleted trees are kept in the trash at %s, it has to be open to remove garbage", path)
+		}
+	}
+
+	owned := map[string][]string{}
+	for _, e := range edges {
+		if !vertices[e.From] || !vertices[e.To] {
+			result.DanglingEdges = append(result.DanglingEdges, e)
+		} else if e.Family == "ownership" {
+			owned[e.From] = append(owned[e.From], e.To)
+		}
+	}
+
+	// mark every vertex owned by the roots, trashed trees are kept
+	// until they are purged
+	reachable := map[string]bool{}
+	queue := []string{}
+	for _, id := range append(roots, trashedRoots()...) {
+		if vertices[id] && !reachable[id] {
+			reachable[id] = true
+			queue = append(queue, id)
+		}
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		for _, child := range owned[id] {
+			if !reachable[child] {
+				reachable[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	for id := range vertices {
+		if !reachable[id] {
+			result.Unreachable = append(result.Unreachable, id)
+		}
+	}
+
+	sort.Strings(result.Unreachable)
+
+	if opts.DryRun {
+		result.Finished = time.Now()
+		return result, nil
+	}
+
+	// the scan is not atomic with respect to writes, so vertices created
+	// after the vertices were scanned are confirmed with the backend
+	// before removing any of their edges
+	garbage := func(id string) bool {
+		if vertices[id] {
+			return !reachable[id]
+		}
+
+		return !ConfirmVertex(id)
+	}
+
+	for _, e := range edges {
+		if !garbage(e.From) && !garbage(e.To) {
+			continue
+		}
+
+		err = DeleteEdge(e)
+		if err != nil {
+			return result, err
+		}
+
+		result.RemovedEdges++
+	}
+
+	for _, id := range result.Unreachable {
+		vertex := &blend.Vertex{Id: id}
+
+		unlock := trackChanges()
+		changes := deletedVertices([]*blend.Vertex{vertex})
+
+		err = backend.DeleteVertex(vertex)
+		if err == nil {
+			for _, change := range changes {
+				recordChange(change)
+			}
+		}
+
+		unlock()
+
+		if err != nil {
+			return result, err
+		}
+
+		notify(id, "vertex:delete")
+
+		result.RemovedVertices++
+	}
+
+	result.Finished = time.Now()
+
+	return result, nil
+}
+
+// Periodically collects garbage in the background
+type Sweeper struct {
+	opts     GCOptions
+	interval time.Duration
+
+	stop chan bool
+	done chan bool
+
+	sync.Mutex
+	last *GCResult
+}
+
+func StartSweeper(interval time.Duration, opts GCOptions) *Sweeper {
+	sweeper := &Sweeper{
+		opts:     opts,
+		interval: interval,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+
+	go sweeper.run()
+
+	return sweeper
+}
+
+func (s *Sweeper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		result, err := CollectGarbage(s.opts)
+		if err != nil {
+			fmt.Printf("Garbage collection failed: %s \n", err.Error())
+			continue
+		}
+
+		fmt.Printf("Garbage collection found %d dangling edges and %d unreachable vertices, removed %d edges and %d vertices \n",
+			len(result.DanglingEdges), len(result.Unreachable),
+			result.RemovedEdges, result.RemovedVertices)
+
+		s.Lock()
+		s.last = &result
+		s.Unlock()
+	}
+}
+
+// Result of the last successful sweep, nil if none finished yet
+func (s *Sweeper) Last() *GCResult {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.last
+}
+
+// Stops the sweeper and waits for a running sweep to finish
+func (s *Sweeper) Stop() {
+	close(s.stop)
+	<-s.done
+}
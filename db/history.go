@@ -0,0 +1,573 @@
+// prior revisions of vertices and edges, for reading the graph as of a time
+package db
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+// How long revisions are kept. The latest revision of a vertex or edge is
+// always kept, zero values keep revisions forever.
+type HistoryOptions struct {
+	// number of revisions kept per vertex and per edge
+	MaxRevisions int
+
+	// age after which revisions are dropped
+	MaxAge time.Duration
+}
+
+type revisionStore struct {
+	sync.Mutex
+
+	store   *bolt.DB
+	opts    HistoryOptions
+	started time.Time
+}
+
+// nil while versioning is disabled
+var history *revisionStore
+
+var historyStartedKey = []byte("started")
+
+// Starts keeping the revisions of every vertex and edge changed from now
+// on in the bolt database at the path. Vertices and edges left unchanged
+// since versioning started are read from the backend, so the graph can be
+// read as of any time since then. Meant to be called on startup.
+func OpenHistory(path string, opts HistoryOptions) error {
+	store, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	h := &revisionStore{store: store, opts: opts}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"meta", "vertices", "edges"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket([]byte("meta"))
+		if started := meta.Get(historyStartedKey); started != nil {
+			h.started = revisionTime(started)
+		} else {
+			h.started = time.Now()
+
+			err := meta.Put(historyStartedKey, revisionKey(nil, h.started))
+			if err != nil {
+				return err
+			}
+		}
+
+		return h.pruneAll(tx)
+	})
+
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	history = h
+
+	return nil
+}
+
+func CloseHistory() {
+	h := history
+	if h == nil {
+		return
+	}
+
+	history = nil
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.store.Close()
+}
+
+// whether changes need to be read before they are made
+func changesTracked() bool {
+	return changelog != nil || history != nil
+}
+
+// revisions are keyed by the nanoseconds of their time, appended to the
+// key of the edge for edge revisions
+func revisionKey(prefix []byte, t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, prefix...), uint64(t.UnixNano()))
+}
+
+func revisionTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[len(key)-8:])))
+}
+
+// format for the key of an edge within the revisions of its vertex:
+// family type name vertexToId
+func edgeRevisionPrefix(e blend.Edge) []byte {
+	return appendKey(nil, e.Family, e.Type, e.Name, e.To)
+}
+
+// Stores the revisions made by a committed change. The change already
+// happened, so failing to store them is only reported.
+func recordRevision(change blend.Change) {
+	h := history
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	err := h.store.Update(func(tx *bolt.Tx) error {
+		switch change.Type {
+		case "vertex:create", "vertex:update":
+			return h.putVertex(tx, change.VertexBefore, change.Time, blend.Revision{Vertex: change.VertexAfter})
+		case "vertex:delete":
+			tombstone := blend.Revision{Deleted: true, Vertex: &blend.Vertex{Id: change.VertexBefore.Id}}
+			return h.putVertex(tx, change.VertexBefore, change.Time, tombstone)
+		case "edge:create":
+			return h.putEdge(tx, nil, change.Time, blend.Revision{Edge: change.EdgeAfter})
+		case "edge:update":
+			return h.putEdge(tx, change.EdgeBefore, change.Time, blend.Revision{Edge: change.EdgeAfter})
+		case "edge:delete":
+			e := *change.EdgeBefore
+			e.Data = ""
+			e.LastChanged = ""
+
+			return h.putEdge(tx, change.EdgeBefore, change.Time, blend.Revision{Deleted: true, Edge: &e})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		fmt.Printf("Cannot keep revision of %s change: %s \n", change.Type, err.Error())
+	}
+}
+
+// Vertices and edges without revisions are unchanged since versioning
+// started, their state before the change is kept as of that time first.
+func (h *revisionStore) putVertex(tx *bolt.Tx, before *blend.Vertex, t time.Time, rev blend.Revision) error {
+	bucket, err := tx.Bucket([]byte("vertices")).CreateBucketIfNotExists([]byte(rev.Vertex.Id))
+	if err != nil {
+		return err
+	}
+
+	if k, _ := bucket.Cursor().First(); before != nil && k == nil {
+		err = putRevision(bucket, nil, h.started, blend.Revision{Vertex: before})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = putRevision(bucket, nil, t, rev)
+	if err != nil {
+		return err
+	}
+
+	return h.prune(bucket, nil)
+}
+
+func (h *revisionStore) putEdge(tx *bolt.Tx, before *blend.Edge, t time.Time, rev blend.Revision) error {
+	bucket, err := tx.Bucket([]byte("edges")).CreateBucketIfNotExists([]byte(rev.Edge.From))
+	if err != nil {
+		return err
+	}
+
+	prefix := edgeRevisionPrefix(*rev.Edge)
+
+	if before != nil {
+		k, _ := bucket.Cursor().Seek(prefix)
+		if !bytes.HasPrefix(k, prefix) {
+			err = putRevision(bucket, prefix, h.started, blend.Revision{Edge: before})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = putRevision(bucket, prefix, t, rev)
+	if err != nil {
+		return err
+	}
+
+	return h.prune(bucket, prefix)
+}
+
+// revisions made within the same nanosecond are kept in order
+func putRevision(bucket *bolt.Bucket, prefix []byte, t time.Time, rev blend.Revision) error {
+	for bucket.Get(revisionKey(prefix, t)) != nil {
+		t = t.Add(time.Nanosecond)
+	}
+
+	rev.Changed = t
+
+	rbytes, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(revisionKey(prefix, t), rbytes)
+}
+
+// drops the oldest revisions with the prefix beyond the retention
+func (h *revisionStore) prune(bucket *bolt.Bucket, prefix []byte) error {
+	if h.opts.MaxRevisions <= 0 && h.opts.MaxAge <= 0 {
+		return nil
+	}
+
+	keys := [][]byte{}
+
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-h.opts.MaxAge)
+
+	for i, k := range keys[:len(keys)-1] {
+		expired := h.opts.MaxRevisions > 0 && len(keys)-i > h.opts.MaxRevisions
+		if !expired && h.opts.MaxAge > 0 {
+			expired = revisionTime(k).Before(cutoff)
+		}
+
+		if !expired {
+			return nil
+		}
+
+		err := bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applies the retention to every vertex and edge
+func (h *revisionStore) pruneAll(tx *bolt.Tx) error {
+	if h.opts.MaxRevisions <= 0 && h.opts.MaxAge <= 0 {
+		return nil
+	}
+
+	for _, name := range []string{"vertices", "edges"} {
+		parent := tx.Bucket([]byte(name))
+
+		// bolt does not allow changing a bucket while iterating it
+		ids := [][]byte{}
+		err := parent.ForEach(func(id, _ []byte) error {
+			ids = append(ids, append([]byte{}, id...))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			bucket := parent.Bucket(id)
+
+			// vertex revisions share the empty prefix, edge revisions are
+			// pruned per edge
+			prefixes := [][]byte{}
+			err = bucket.ForEach(func(k, _ []byte) error {
+				prefix := k[:len(k)-8]
+				if len(prefixes) == 0 || !bytes.Equal(prefixes[len(prefixes)-1], prefix) {
+					prefixes = append(prefixes, append([]byte{}, prefix...))
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			for _, prefix := range prefixes {
+				err = h.prune(bucket, prefix)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checks the graph can be read as of the time
+func (h *revisionStore) reaches(id string, t time.Time) error {
+	if h == nil {
+		return errors.New("Versioning not enabled")
+	}
+
+	if m, _ := resolveMount(id); m != nil {
+		return errors.New("Revisions are not kept for mounted graphs")
+	}
+
+	if t.Before(h.started) {
+		return fmt.Errorf("Revisions are only kept since %s", h.started.Format(time.RFC3339))
+	}
+
+	if h.opts.MaxAge > 0 && t.Before(time.Now().Add(-h.opts.MaxAge)) {
+		return fmt.Errorf("Revisions are only kept for %s", h.opts.MaxAge)
+	}
+
+	return nil
+}
+
+func (h *revisionStore) revisions(bucket *bolt.Bucket, prefix []byte, fn func(k []byte, rev blend.Revision) error) error {
+	if bucket == nil {
+		return nil
+	}
+
+	cursor := bucket.Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		rev := blend.Revision{}
+		err := json.Unmarshal(v, &rev)
+		if err != nil {
+			return err
+		}
+
+		err = fn(k, rev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Every revision of the vertex and its outgoing edges in the order they
+// were made, none if they are unchanged since versioning started. Private
+// data and non public edges are left out unless the current private key
+// of the vertex is given, or the key it had last once it is deleted.
+// Vertices in the trash and edges to them are hidden.
+func Revisions(id, privateKey string) ([]blend.Revision, error) {
+	h := history
+	if h == nil {
+		return nil, errors.New("Versioning not enabled")
+	}
+
+	if trashed(id) {
+		return nil, errors.New("Vertex not found.")
+	}
+
+	revisions := []blend.Revision{}
+	authorized := privateKey != "" && ConfirmVertexKey(id, privateKey)
+
+	err := h.store.View(func(tx *bolt.Tx) error {
+		err := h.revisions(tx.Bucket([]byte("vertices")).Bucket([]byte(id)), nil, func(_ []byte, rev blend.Revision) error {
+			revisions = append(revisions, rev)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return h.revisions(tx.Bucket([]byte("edges")).Bucket([]byte(id)), nil, func(_ []byte, rev blend.Revision) error {
+			if !trashed(rev.Edge.To) {
+				revisions = append(revisions, rev)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Changed.Before(revisions[j].Changed)
+	})
+
+	// a deleted vertex takes the key it had last, keys it had before
+	// are never good for the revisions made since
+	if !authorized && privateKey != "" && !ConfirmVertex(id) {
+		for i := len(revisions) - 1; i >= 0; i-- {
+			if v := revisions[i].Vertex; v != nil && !revisions[i].Deleted {
+				authorized = v.PrivateKey != "" &&
+					subtle.ConstantTimeCompare([]byte(v.PrivateKey), []byte(privateKey)) == 1
+				break
+			}
+		}
+	}
+
+	if authorized {
+		return revisions, nil
+	}
+
+	public := []blend.Revision{}
+	for _, rev := range revisions {
+		if rev.Edge != nil && rev.Edge.Family != "public" {
+			continue
+		}
+
+		rev.Vertex = publicVertex(rev.Vertex)
+		public = append(public, rev)
+	}
+
+	return public, nil
+}
+
+// Fills in the details of the vertex as they were at the time, the same
+// way as GetVertex does with the current ones. Vertices in the trash are
+// hidden whatever the time.
+func GetVertexAsOf(vertex *blend.Vertex, t time.Time) error {
+	if vertex.Id == "" {
+		return errors.New("Vertex Id not passed")
+	}
+
+	if trashed(vertex.Id) {
+		return errors.New("Vertex not found.")
+	}
+
+	h := history
+
+	err := h.reaches(vertex.Id, t)
+	if err != nil {
+		return err
+	}
+
+	var (
+		found  *blend.Revision
+		exists bool
+	)
+
+	err = h.store.View(func(tx *bolt.Tx) error {
+		return h.revisions(tx.Bucket([]byte("vertices")).Bucket([]byte(vertex.Id)), nil, func(k []byte, rev blend.Revision) error {
+			exists = true
+			if !revisionTime(k).After(t) {
+				found = &rev
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// unchanged since versioning started
+	if !exists {
+		return backend.GetVertex(vertex)
+	}
+
+	if found == nil || found.Deleted {
+		return errors.New("Vertex not found as of the time given")
+	}
+
+	v := *found.Vertex
+	key := vertex.PrivateKey
+
+	switch {
+	case key == "":
+		v.Private = ""
+		v.PrivateKey = ""
+	case v.PrivateKey == "":
+		// kept from before versioning started without its private data
+		if !ConfirmVertexKey(vertex.Id, key) {
+			return errors.New("Wront private key supplied for vertex")
+		}
+	case v.PrivateKey != key:
+		return errors.New("Wront private key supplied for vertex")
+	}
+
+	*vertex = v
+
+	return nil
+}
+
+// Edges of the vertex as they were at the time, filtered the same way as
+// GetEdges. Edges whose revisions were dropped by the retention are left
+// out for times before their oldest revision kept.
+func GetEdgesAsOf(v blend.Vertex, e blend.Edge, t time.Time) ([]blend.Edge, error) {
+	if trashed(v.Id) {
+		return nil, errors.New("Vertex not found.")
+	}
+
+	h := history
+
+	err := h.reaches(v.Id, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Family == "" {
+		e.Family = "public"
+	}
+
+	// edges with revisions by their key, nil if they did not exist
+	versioned := map[string]*blend.Edge{}
+	prefix := appendEdgeParts(nil, e)
+
+	err = h.store.View(func(tx *bolt.Tx) error {
+		return h.revisions(tx.Bucket([]byte("edges")).Bucket([]byte(v.Id)), prefix, func(k []byte, rev blend.Revision) error {
+			key := string(k[:len(k)-8])
+			if _, ok := versioned[key]; !ok {
+				versioned[key] = nil
+			}
+
+			if !revisionTime(k).After(t) {
+				versioned[key] = rev.Edge
+				if rev.Deleted {
+					versioned[key] = nil
+				}
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := backend.GetEdges(v, e)
+	if err != nil {
+		return nil, err
+	}
+
+	edges := []blend.Edge{}
+
+	// unchanged since versioning started
+	for _, edge := range current {
+		if _, ok := versioned[string(edgeRevisionPrefix(edge))]; !ok {
+			edges = append(edges, edge)
+		}
+	}
+
+	keys := []string{}
+	for key, edge := range versioned {
+		if edge != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		edges = append(edges, *versioned[key])
+	}
+
+	return visibleEdges(edges), nil
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestHistory(t *testing.T) {
+	dir := initTestGraph(t)
+
+	// created before versioning started
+	parent := &blend.Vertex{Name: "parent", Type: "test", PrivateKey: "key", Private: "secret"}
+	other := &blend.Vertex{Name: "other", Type: "test"}
+
+	err := CreateVertex(parent)
+	if err == nil {
+		err = CreateVertex(other)
+	}
+
+	if err == nil {
+		err = CreateEdge(*parent, *other, &blend.Edge{Family: "public", Type: "link", Name: "old", Data: "old"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = OpenHistory(path.Join(dir, "history.db"), HistoryOptions{MaxRevisions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseHistory()
+
+	before := time.Now()
+
+	parent.Name = "renamed"
+	parent.Private = "changed"
+	err = UpdateVertex(parent)
+	if err == nil {
+		err = DeleteEdge(blend.Edge{From: parent.Id, Family: "public", Type: "link", Name: "old", To: other.Id})
+	}
+
+	if err == nil {
+		err = CreateEdge(*parent, *other, &blend.Edge{Family: "public", Type: "link", Name: "new"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := time.Now()
+
+	v := blend.Vertex{Id: parent.Id, PrivateKey: "key"}
+	err = GetVertexAsOf(&v, before)
+	if err != nil || v.Name != "parent" {
+		t.Fatal("Cannot read the vertex as of before its update", v, err)
+	}
+
+	v = blend.Vertex{Id: parent.Id}
+	err = GetVertexAsOf(&v, after)
+	if err != nil || v.Name != "renamed" || v.Private != "" {
+		t.Fatal("Cannot read the public vertex as of after its update", v, err)
+	}
+
+	v = blend.Vertex{Id: parent.Id, PrivateKey: "wrong"}
+	if GetVertexAsOf(&v, after) == nil {
+		t.Fatal("Read a past vertex with a wrong private key")
+	}
+
+	edges, err := GetEdgesAsOf(*parent, blend.Edge{Family: "public"}, before)
+	if err != nil || len(edges) != 1 || edges[0].Name != "old" || edges[0].Data != "old" {
+		t.Fatal("Got back different edges as of before the changes", edges, err)
+	}
+
+	edges, err = GetEdgesAsOf(*parent, blend.Edge{Family: "public"}, after)
+	if err != nil || len(edges) != 1 || edges[0].Name != "new" {
+		t.Fatal("Got back different edges as of after the changes", edges, err)
+	}
+
+	v = blend.Vertex{Id: other.Id}
+	err = GetVertexAsOf(&v, before)
+	if err != nil || v.Name != "other" {
+		t.Fatal("Cannot read an unchanged vertex as of before the changes", v, err)
+	}
+
+	if GetVertexAsOf(&v, before.Add(-time.Hour)) == nil {
+		t.Fatal("Read a vertex as of before versioning started")
+	}
+
+	revisions, err := Revisions(parent.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the vertex before and after the update, the edge before its delete,
+	// its tombstone and the new edge
+	if len(revisions) != 5 {
+		t.Fatal("Got back different revisions then expected", revisions)
+	}
+
+	for _, rev := range revisions {
+		if rev.Vertex != nil && rev.Vertex.Private != "" {
+			t.Fatal("Revision leaks private data without the private key", rev)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		err = UpdateVertex(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revisions, err = Revisions(parent.Id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vertexRevisions := 0
+	for _, rev := range revisions {
+		if rev.Vertex != nil {
+			vertexRevisions++
+		}
+	}
+
+	if vertexRevisions != 3 {
+		t.Fatal("Kept more revisions than the retention allows", revisions)
+	}
+
+	updated := time.Now()
+
+	err = DeleteVertex(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v = blend.Vertex{Id: parent.Id}
+	if GetVertexAsOf(&v, time.Now()) == nil {
+		t.Fatal("Read a deleted vertex as of after its deletion")
+	}
+
+	v = blend.Vertex{Id: parent.Id}
+	err = GetVertexAsOf(&v, updated)
+	if err != nil || v.Name != "renamed" {
+		t.Fatal("Cannot read a deleted vertex as of before its deletion", v, err)
+	}
+
+	v = blend.Vertex{Id: parent.Id}
+	if GetVertexAsOf(&v, after) == nil {
+		t.Fatal("Read a vertex as of a revision dropped by the retention")
+	}
+}
+
+// private data of a vertex is only shown with its current key, or the
+// key it had last once it is deleted
+func TestRevisionsKey(t *testing.T) {
+	dir := initTestGraph(t)
+
+	err := OpenHistory(path.Join(dir, "history.db"), HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseHistory()
+
+	vertex := &blend.Vertex{Name: "vertex", Type: "test", PrivateKey: "old", Private: "old secret"}
+	err = CreateVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vertex.PrivateKey = "new"
+	vertex.Private = "new secret"
+	err = UpdateVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private := func(key string) []string {
+		revisions, err := Revisions(vertex.Id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secrets := []string{}
+		for _, rev := range revisions {
+			if rev.Vertex != nil && rev.Vertex.Private != "" {
+				secrets = append(secrets, rev.Vertex.Private)
+			}
+		}
+
+		return secrets
+	}
+
+	for _, test := range []struct {
+		key     string
+		secrets int
+	}{
+		{"", 0},
+		{"old", 0},
+		{"wrong", 0},
+		{"new", 2},
+	} {
+		if secrets := private(test.key); len(secrets) != test.secrets {
+			t.Fatal("Got back different private data then expected", test.key, secrets)
+		}
+	}
+
+	err = DeleteVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secrets := private("old"); len(secrets) != 0 {
+		t.Fatal("Got back private data of a deleted vertex with a key it had before", secrets)
+	}
+
+	if secrets := private("new"); len(secrets) != 2 {
+		t.Fatal("Got back different private data of a deleted vertex then expected", secrets)
+	}
+}
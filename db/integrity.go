@@ -0,0 +1,96 @@
+// referential integrity of edges when vertices get deleted
+package db
+
+import (
+	"fmt"
+
+	"github.com/ziahamza/blend"
+)
+
+// What happens to the edges pointing at a vertex when it gets deleted
+type DeletePolicy int
+
+const (
+	// remove the incoming edges along with the vertex
+	CascadeDelete DeletePolicy = iota
+
+	// refuse to delete a vertex while edges of the family point at it
+	RestrictDelete
+)
+
+// policies by edge family, families not present cascade
+var deletePolicies = map[string]DeletePolicy{}
+
+// Sets the policy for incoming edges of a family. Not safe to call
+// concurrently with deletes, meant to be configured on startup.
+func SetDeletePolicy(family string, policy DeletePolicy) {
+	deletePolicies[family] = policy
+}
+
+func GetDeletePolicy(family string) DeletePolicy {
+	return deletePolicies[family]
+}
+
+// Applies the delete policies to every edge pointing into the vertices
+// about to be deleted from outside of them. Either all of those edges are
+// removed or, if any of them is restricted, nothing is touched and an error
+// returned. Edges between the vertices are left to the backend as they go
+// away with their source vertices. Returns the number of edges removed.
+func removeIncomingEdges(ids []string) (int, error) {
+	cascade, err := incomingEdges(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range cascade {
+		unlock := trackChanges()
+
+		err := backend.DeleteEdge(e)
+		if err == nil {
+			recordChange(blend.Change{Type: "edge:delete", EdgeBefore: &cascade[i]})
+		}
+
+		unlock()
+
+		if err != nil {
+			return i, err
+		}
+
+		notify(e.From, "edge:delete")
+	}
+
+	return len(cascade), nil
+}
+
+// Edges pointing into the vertices from outside of them, or an error if
+// the delete policy of any of them restricts deleting the vertices
+func incomingEdges(ids []string) ([]blend.Edge, error) {
+	deleted := map[string]bool{}
+	for _, id := range ids {
+		deleted[id] = true
+	}
+
+	cascade := []blend.Edge{}
+	for _, id := range ids {
+		edges, err := backend.GetIncomingEdges(blend.Vertex{Id: id}, blend.Edge{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range edges {
+			if deleted[e.From] {
+				continue
+			}
+
+			if GetDeletePolicy(e.Family) == RestrictDelete {
+				return nil, fmt.Errorf(
+					"Vertex %s cannot be deleted, %s edge %s:%s from %s points at it",
+					id, e.Family, e.Type, e.Name, e.From)
+			}
+
+			cascade = append(cascade, e)
+		}
+	}
+
+	return cascade, nil
+}
@@ -0,0 +1,102 @@
+// long running operations executed in the background
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ziahamza/blend"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// how long finished jobs can still be queried
+const jobRetention = time.Hour
+
+var jobs struct {
+	sync.Mutex
+	byId map[string]*blend.Job
+}
+
+func newJob() (*blend.Job, error) {
+	jid, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &blend.Job{
+		Id:      jid.String(),
+		Status:  "running",
+		Started: time.Now(),
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	if jobs.byId == nil {
+		jobs.byId = map[string]*blend.Job{}
+	}
+
+	// forget about jobs finished a while back
+	for id, j := range jobs.byId {
+		if j.Status != "running" && time.Since(j.Finished) > jobRetention {
+			delete(jobs.byId, id)
+		}
+	}
+
+	jobs.byId[job.Id] = job
+
+	return job, nil
+}
+
+func updateJob(job *blend.Job, update func(*blend.Job)) {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	update(job)
+}
+
+// Returns a snapshot of the job with the given id
+func GetJob(id string) (blend.Job, error) {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	job := jobs.byId[id]
+	if job == nil {
+		return blend.Job{}, errors.New("Job not found")
+	}
+
+	return *job, nil
+}
+
+// Deletes the vertex trees in the background, the progress can be
+// followed through the returned job
+func StartDeleteVertexTree(vertices []*blend.Vertex) (blend.Job, error) {
+	job, err := newJob()
+	if err != nil {
+		return blend.Job{}, err
+	}
+
+	go func() {
+		stats, err := DeleteVertexTree(vertices, func(stats blend.DeleteStats) {
+			updateJob(job, func(job *blend.Job) {
+				job.Deleted = stats
+			})
+		})
+
+		updateJob(job, func(job *blend.Job) {
+			job.Deleted = stats
+			job.Finished = time.Now()
+
+			if err != nil {
+				job.Status = "failed"
+				job.Message = err.Error()
+			} else {
+				job.Status = "done"
+			}
+		})
+	}()
+
+	return GetJob(job.Id)
+}
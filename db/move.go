@@ -0,0 +1,142 @@
+// moving vertices from one owner to another
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ziahamza/blend"
+)
+
+// Optionally implemented by backends that can replace an edge with another
+// in a single transaction. Other backends get the new edge created before
+// the old one is deleted, so a failed move never leaves a vertex unowned.
+type EdgeMover interface {
+	MoveEdge(old blend.Edge, e *blend.Edge) error
+}
+
+// moves are serialized so two of them cannot build a cycle together
+var moveLock sync.Mutex
+
+// Moves the vertex from the old parent to the new one, which can be the
+// same to just rename its ownership edge. The type and name of the edge
+// default to the ones of the ownership edge it is moved from. Returns the
+// new ownership edge.
+func MoveVertex(v, from, to blend.Vertex, e blend.Edge) (blend.Edge, error) {
+	err := rejectMounted(v.Id, from.Id, to.Id)
+	if err != nil {
+		return blend.Edge{}, err
+	}
+
+	for _, id := range []string{v.Id, from.Id, to.Id} {
+		if !ConfirmVertex(id) {
+			return blend.Edge{}, fmt.Errorf("Vertex %s not found", id)
+		}
+	}
+
+	moveLock.Lock()
+	defer moveLock.Unlock()
+
+	unlock := trackChanges()
+	defer unlock()
+
+	edges, err := backend.GetEdges(from, blend.Edge{Family: "ownership"})
+	if err != nil {
+		return blend.Edge{}, err
+	}
+
+	var old *blend.Edge
+	for i := range edges {
+		if edges[i].To == v.Id {
+			old = &edges[i]
+			break
+		}
+	}
+
+	if old == nil {
+		return blend.Edge{}, errors.New("Vertex is not owned by the vertex it is moved from")
+	}
+
+	edge := *old
+	edge.From = to.Id
+	edge.LastChanged = ""
+
+	if e.Type != "" {
+		edge.Type = e.Type
+	}
+
+	if e.Name != "" {
+		edge.Name = e.Name
+	}
+
+	if edge.From == old.From && edge.Type == old.Type && edge.Name == old.Name {
+		return *old, nil
+	}
+
+	taken, err := backend.GetEdges(to, blend.Edge{Family: "ownership", Type: edge.Type, Name: edge.Name})
+	if err != nil {
+		return blend.Edge{}, err
+	}
+
+	if len(taken) > 0 {
+		return blend.Edge{}, fmt.Errorf("Vertex %s already owns a vertex as %s:%s", to.Id, edge.Type, edge.Name)
+	}
+
+	err = checkAncestor(v.Id, to.Id)
+	if err != nil {
+		return blend.Edge{}, err
+	}
+
+	if mover, ok := backend.(EdgeMover); ok {
+		err = mover.MoveEdge(*old, &edge)
+	} else {
+		err = backend.CreateEdge(to, v, &edge)
+		if err == nil {
+			err = backend.DeleteEdge(*old)
+		}
+	}
+
+	if err != nil {
+		return blend.Edge{}, err
+	}
+
+	recordChange(blend.Change{Type: "edge:delete", EdgeBefore: old})
+	recordChange(blend.Change{Type: "edge:create", EdgeAfter: &edge})
+
+	notify(from.Id, "edge:delete")
+	notify(to.Id, "edge:create")
+
+	return edge, nil
+}
+
+// fails if the vertex owns the other one, directly or through other
+// vertices, or is the same vertex. Walks up from the other vertex as
+// vertices have far fewer owners than descendants.
+func checkAncestor(id, other string) error {
+	seen := map[string]bool{other: true}
+	queue := []string{other}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if current == id {
+			return fmt.Errorf("Vertex %s cannot be moved below itself", id)
+		}
+
+		owners, err := backend.GetIncomingEdges(blend.Vertex{Id: current}, blend.Edge{Family: "ownership"})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range owners {
+			if !seen[e.From] {
+				seen[e.From] = true
+				queue = append(queue, e.From)
+			}
+		}
+	}
+
+	return nil
+}
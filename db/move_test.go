@@ -0,0 +1,114 @@
+package db
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestMove(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for uri, storage := range map[string]Storage{
+		path.Join(dir, "graph.db"): &BoltStorage{},
+		"sqlite::memory:":          &SQLStorage{},
+
+		// without moving edges in a single transaction
+		"": &CassandraStorage{connect: newFakeCluster().connect},
+	} {
+		err = Init(uri, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testMove(t)
+
+		Close()
+	}
+}
+
+func testMove(t *testing.T) {
+	a := &blend.Vertex{Name: "a", Type: "test"}
+	b := &blend.Vertex{Name: "b", Type: "test"}
+	child := &blend.Vertex{Name: "child", Type: "test"}
+	grandchild := &blend.Vertex{Name: "grandchild", Type: "test"}
+
+	err := CreateVertex(a)
+	if err == nil {
+		err = CreateVertex(b)
+	}
+
+	if err == nil {
+		err = CreateChildVertex(a, child, blend.Edge{Type: "folder", Name: "child"})
+	}
+
+	if err == nil {
+		err = CreateChildVertex(child, grandchild, blend.Edge{Type: "folder", Name: "grandchild"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edge, err := MoveVertex(*child, *a, *b, blend.Edge{Name: "moved"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if edge.From != b.Id || edge.To != child.Id || edge.Type != "folder" || edge.Name != "moved" {
+		t.Fatal("Got back a different ownership edge then expected", edge)
+	}
+
+	edges, err := GetEdges(*a, blend.Edge{Family: "ownership"})
+	if err != nil || len(edges) != 0 {
+		t.Fatal("Moved vertex still owned by its old parent", edges, err)
+	}
+
+	moved, err := GetChildVertex(*b, blend.Edge{Family: "ownership", Type: "folder", Name: "moved"})
+	if err != nil || moved.Id != child.Id {
+		t.Fatal("Moved vertex not owned by its new parent", moved, err)
+	}
+
+	_, err = MoveVertex(*child, *b, *grandchild, blend.Edge{})
+	if err == nil {
+		t.Fatal("Moved a vertex below its own child")
+	}
+
+	_, err = MoveVertex(*child, *b, *child, blend.Edge{})
+	if err == nil {
+		t.Fatal("Moved a vertex below itself")
+	}
+
+	_, err = MoveVertex(*child, *a, *b, blend.Edge{})
+	if err == nil {
+		t.Fatal("Moved a vertex from a vertex not owning it")
+	}
+
+	other := &blend.Vertex{Name: "other", Type: "test"}
+	err = CreateChildVertex(b, other, blend.Edge{Type: "folder", Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = MoveVertex(*child, *b, *b, blend.Edge{Name: "other"})
+	if err == nil {
+		t.Fatal("Renamed a vertex to the name of another child")
+	}
+
+	edge, err = MoveVertex(*child, *b, *b, blend.Edge{Name: "renamed"})
+	if err != nil || edge.Name != "renamed" {
+		t.Fatal("Cannot rename the ownership edge of a vertex", edge, err)
+	}
+
+	edges, err = GetEdges(*b, blend.Edge{Family: "ownership"})
+	if err != nil || len(edges) != 2 {
+		t.Fatal("Got back different ownership edges after renaming", edges, err)
+	}
+}
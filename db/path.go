@@ -0,0 +1,115 @@
+// addressing vertices by the ownership edges leading to them
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ziahamza/blend"
+)
+
+// Splits a slash separated path into the ownership edges it follows, each
+// segment given as type:name. Empty segments are skipped, so the empty
+// path leads to the vertex it starts at.
+func ParsePath(path string) ([]blend.Edge, error) {
+	edges := []blend.Edge{}
+
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+
+		i := strings.Index(segment, ":")
+		if i <= 0 || i == len(segment)-1 {
+			return nil, fmt.Errorf("Path segment %s is not given as type:name", segment)
+		}
+
+		edges = append(edges, blend.Edge{
+			Family: "ownership",
+			Type:   segment[:i],
+			Name:   segment[i+1:],
+		})
+	}
+
+	return edges, nil
+}
+
+// Follows the ownership edges from the vertex, returns the vertex at the
+// end of the path without its private data
+func ResolvePath(v blend.Vertex, path []blend.Edge) (blend.Vertex, error) {
+	v = blend.Vertex{Id: v.Id}
+
+	err := GetVertex(&v)
+	if err != nil {
+		return v, err
+	}
+
+	for _, e := range path {
+		child, err := GetChildVertex(v, e)
+		if err != nil {
+			return v, fmt.Errorf("Vertex %s does not own a vertex as %s:%s", v.Id, e.Type, e.Name)
+		}
+
+		v = child
+	}
+
+	return v, nil
+}
+
+// paths are created one at a time, so two of them sharing a vertex that
+// is missing do not both create it
+var pathLock sync.Mutex
+
+// Follows the ownership edges from the vertex the same way as ResolvePath,
+// creating the vertices missing along the way. Vertices in the middle of
+// the path are named and typed after their edge, the last one is created
+// from the given vertex which is named and typed after its edge unless
+// given. Vertices that exist already are kept as they are, including the
+// last one.
+func CreatePath(v blend.Vertex, path []blend.Edge, last blend.Vertex) (blend.Vertex, error) {
+	if len(path) == 0 {
+		return v, errors.New("Path to create is empty")
+	}
+
+	pathLock.Lock()
+	defer pathLock.Unlock()
+
+	v = blend.Vertex{Id: v.Id}
+
+	err := GetVertex(&v)
+	if err != nil {
+		return v, err
+	}
+
+	for i, e := range path {
+		child, err := GetChildVertex(v, e)
+		if err == nil {
+			v = child
+			continue
+		}
+
+		child = blend.Vertex{Name: e.Name, Type: e.Type}
+		if i == len(path)-1 {
+			child = last
+
+			if child.Name == "" {
+				child.Name = e.Name
+			}
+
+			if child.Type == "" {
+				child.Type = e.Type
+			}
+		}
+
+		err = CreateChildVertex(&v, &child, e)
+		if err != nil {
+			return v, err
+		}
+
+		v = child
+	}
+
+	return v, nil
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestPath(t *testing.T) {
+	initTestGraph(t)
+
+	for _, p := range []string{"folder", "folder:", ":name", "a:b/c"} {
+		if _, err := ParsePath(p); err == nil {
+			t.Fatal("Parsed a path with a segment missing its type or name", p)
+		}
+	}
+
+	edges, err := ParsePath("/folder:a//file:b:c/")
+	if err != nil || len(edges) != 2 || edges[1].Type != "file" || edges[1].Name != "b:c" {
+		t.Fatal("Got back a different path then expected", edges, err)
+	}
+
+	root := &blend.Vertex{Name: "root", Type: "test"}
+	err = CreateVertex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edges, _ = ParsePath("folder:a/folder:b/file:c")
+
+	file, err := CreatePath(*root, edges, blend.Vertex{Public: "content", PrivateKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Name != "c" || file.Type != "file" || file.Public != "content" {
+		t.Fatal("Vertex at the end of the path not created from the given one", file)
+	}
+
+	resolved, err := ResolvePath(*root, edges)
+	if err != nil || resolved.Id != file.Id || resolved.PrivateKey != "" {
+		t.Fatal("Cannot resolve the created path", resolved, err)
+	}
+
+	folder, err := ResolvePath(*root, edges[:1])
+	if err != nil || folder.Name != "a" || folder.Type != "folder" {
+		t.Fatal("Vertex in the middle of the path not created", folder, err)
+	}
+
+	edges, _ = ParsePath("folder:a/folder:d")
+
+	created, err := CreatePath(*root, edges, blend.Vertex{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned, err := GetEdges(folder, blend.Edge{Family: "ownership"})
+	if err != nil || len(owned) != 2 {
+		t.Fatal("Existing vertices along the path were not reused", owned, err)
+	}
+
+	again, err := CreatePath(*root, edges, blend.Vertex{Public: "changed"})
+	if err != nil || again.Id != created.Id || again.Public != "" {
+		t.Fatal("Existing vertex at the end of the path was not kept", again, err)
+	}
+
+	edges, _ = ParsePath("folder:a/folder:missing/file:c")
+	if _, err = ResolvePath(*root, edges); err == nil {
+		t.Fatal("Resolved a path that does not exist")
+	}
+
+	resolved, err = ResolvePath(*root, nil)
+	if err != nil || resolved.Id != root.Id {
+		t.Fatal("Empty path does not lead to the vertex it starts at", resolved, err)
+	}
+}
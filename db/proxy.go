@@ -1,22 +1,68 @@
 package db
 
 import (
+	"context"
 	"errors"
-	"net/http"
+	"fmt"
 	"net/url"
 	"os"
 	"path"
+	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/events"
 )
 
+func init() {
+	Register("proxy", func() Storage { return &ProxyStorage{} })
+}
+
 // HTTP API Backend
 type ProxyStorage struct {
 	rpcURL *url.URL
-	cache  Storage
+	cache  *proxyCache
+	client *rpcClient
+	queue  *writeQueue
+
+	// upper bound for a single call to the source graph, defaults
+	// to DefaultProxyTimeout
+	Timeout time.Duration
+
+	// how long vertices and edges from the source graph are served from
+	// the local cache without asking again, defaults to DefaultProxyCacheTTL
+	CacheTTL time.Duration
+
+	// bolt database for the cache, defaults to proxycache.db in the
+	// temporary directory. Required when working offline, as the writes
+	// queued in it must not be lost to a cleared temporary directory.
+	CachePath string
+
+	// admin token of the source graph, needed to listen to the events of
+	// every vertex. Without it cached vertices and edges are only ever
+	// refreshed once they are older than the CacheTTL.
+	AdminToken string
+
+	// keep working while the source graph is unreachable. Reads are served
+	// from the cache however old it is and writes are queued in the cache
+	// database, to be replayed in order once the source graph is back.
+	AllowOffline bool
+
+	// only one replay of the queue at a time
+	syncLock sync.Mutex
+
+	statusLock   sync.Mutex
+	lastSync     time.Time
+	lastConflict string
+
+	done chan struct{}
 }
 
+const DefaultProxyTimeout = 10 * time.Second
+
+// interval between attempts to replay queued writes
+const proxySyncInterval = 5 * time.Second
+
 func (db *ProxyStorage) Init(uri string) error {
 	var err error
 
@@ -25,72 +71,232 @@ func (db *ProxyStorage) Init(uri string) error {
 		return err
 	}
 
-	resp, err := db.GetAPIResponse(blend.APIRequest{Method: "/"})
+	if db.Timeout == 0 {
+		db.Timeout = DefaultProxyTimeout
+	}
+
+	if db.CacheTTL == 0 {
+		db.CacheTTL = DefaultProxyCacheTTL
+	}
+
+	if db.CachePath == "" && db.AllowOffline {
+		return errors.New("Working offline needs a cache path to keep the queued writes in")
+	}
+
+	if db.CachePath == "" {
+		db.CachePath = path.Join(os.TempDir(), "proxycache.db")
+	}
+
+	store := &BoltStorage{}
+	err = store.Init(db.CachePath)
 	if err != nil {
 		return err
 	}
 
-	if !resp.Success {
-		return errors.New("Cannot parse graph API for proxy backend:" + resp.Message)
+	db.cache = newProxyCache(store, db.CacheTTL)
+
+	db.queue, err = newWriteQueue(store)
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	db.client = newRPCClient(db.rpcURL.String())
+	db.client.failFast = db.AllowOffline
+
+	if db.AdminToken != "" {
+		db.client.header.Set(blend.AdminTokenHeader, db.AdminToken)
+	}
+
+	// changes to the source graph made by others are streamed over every
+	// new connection, whatever happened while disconnected is unknown
+	db.client.onConnect = db.reconnected
+	db.client.onDisconnect = db.cache.InvalidateAll
+
+	resp, err := db.GetAPIResponse(blend.APIRequest{Method: "/"})
+	if err == nil && !resp.Success {
+		err = errors.New("Cannot parse graph API for proxy backend:" + resp.Message)
+	} else if err != nil && db.AllowOffline {
+		fmt.Printf("Source graph unreachable, starting offline (%s) \n", err.Error())
+		err = nil
 	}
 
-	db.cache = &BoltStorage{}
+	if err != nil {
+		db.client.Close()
+		store.Close()
+		return err
+	}
 
-	db.cache.Init(path.Join(os.TempDir(), "proxycache.db"))
+	db.done = make(chan struct{})
+	go db.syncLoop()
 
 	return nil
 }
 
-func (db *ProxyStorage) Close() {
-	db.cache.Close()
+func (db *ProxyStorage) reconnected() {
+	db.listen()
+
+	err := db.Sync()
+	if err != nil {
+		fmt.Printf("Cannot replay queued writes: %s \n", err.Error())
+	}
 }
 
-func (db *ProxyStorage) Drop() error {
-	return db.cache.Drop()
+// retries replaying the queue for as long as writes are waiting, in
+// case no new connection comes along to trigger it
+func (db *ProxyStorage) syncLoop() {
+	ticker := time.NewTicker(proxySyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if db.queue.Len() > 0 {
+				db.Sync()
+			}
+		case <-db.done:
+			return
+		}
+	}
 }
 
-func (db *ProxyStorage) GetAPIResponse(req blend.APIRequest) (blend.APIResponse, error) {
-	var resp blend.APIResponse
-	conn, _, err := websocket.DefaultDialer.Dial(db.rpcURL.String(), http.Header{})
+// subscribes to the events of every vertex in the source graph to
+// invalidate cached copies of whatever changed
+func (db *ProxyStorage) listen() {
+	ctx, cancel := context.WithTimeout(context.Background(), db.Timeout)
+	defer cancel()
+
+	err := db.client.Stream(ctx, blend.APIRequest{Method: "/events/listen"}, func(resp blend.APIResponse) {
+		if resp.Event != nil && resp.Event.Type == events.Overflow {
+			// the source graph dropped events, anything might have changed
+			db.cache.InvalidateAll()
+		} else if resp.Event != nil {
+			db.cache.Invalidate(resp.Event.Source)
+		} else if !resp.Success {
+			fmt.Printf("Cannot listen to source graph events: %s \n", resp.Message)
+		}
+	})
+
 	if err != nil {
-		return resp, err
+		// without events the cache can only rely on its ttl
+		fmt.Printf("Cannot listen to source graph events: %s \n", err.Error())
 	}
+}
 
-	defer conn.Close()
+func (db *ProxyStorage) CacheStats() blend.CacheStats {
+	return db.cache.Stats()
+}
 
-	err = conn.WriteJSON(&req)
-	if err != nil {
-		return resp, err
+func (db *ProxyStorage) SyncStatus() blend.SyncStatus {
+	db.statusLock.Lock()
+	defer db.statusLock.Unlock()
+
+	return blend.SyncStatus{
+		Online:       db.client.Connected(),
+		Queued:       db.queue.Len(),
+		Conflicts:    db.queue.Conflicts(),
+		LastConflict: db.lastConflict,
+		LastSync:     db.lastSync,
 	}
+}
 
-	err = conn.ReadJSON(&resp)
-	if err != nil {
-		return resp, err
+func (db *ProxyStorage) Close() {
+	close(db.done)
+
+	// let a running replay finish its current write
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
+
+	db.client.Close()
+	db.cache.store.Close()
+}
+
+func (db *ProxyStorage) Drop() error {
+	if db.queue.Len() > 0 {
+		return errors.New("Cannot drop the proxy cache while writes are queued for the source graph")
 	}
 
-	return resp, nil
+	db.cache.InvalidateAll()
+	return db.cache.store.Drop()
+}
+
+// Calls the source graph bounded by the default timeout
+func (db *ProxyStorage) GetAPIResponse(req blend.APIRequest) (blend.APIResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.Timeout)
+	defer cancel()
+
+	return db.GetAPIResponseContext(ctx, req)
+}
+
+func (db *ProxyStorage) GetAPIResponseContext(ctx context.Context, req blend.APIRequest) (blend.APIResponse, error) {
+	return db.client.Call(ctx, req)
 }
 
 func (db *ProxyStorage) GetVertex(v *blend.Vertex) error {
+	if db.cache.FreshVertex(v.Id) {
+		cached := blend.Vertex{Id: v.Id, PrivateKey: v.PrivateKey}
+
+		// a key mismatch might just mean the vertex was cached without
+		// its key, leave it to the source graph to decide
+		if db.cache.store.GetVertex(&cached) == nil {
+			if v.PrivateKey == "" {
+				cached.Private = ""
+			}
+
+			db.cache.Record(true)
+
+			*v = cached
+			return nil
+		}
+	}
+
+	db.cache.Record(false)
+
+	generation := db.cache.Generation()
+
 	resp, err := db.GetAPIResponse(blend.APIRequest{
 		Method: "/vertex/get",
 		Vertex: *v,
 	})
 
 	if err != nil {
+		if db.AllowOffline && db.offlineVertex(v) == nil {
+			return nil
+		}
+
 		return err
 	}
 
 	if resp.Success == false {
+		// vertices created offline are only known locally until
+		// the queue is replayed
+		if db.queue.Len() > 0 && db.offlineVertex(v) == nil {
+			return nil
+		}
+
 		return errors.New(resp.Message)
 	}
 
 	*v = *resp.Vertex
 
+	db.cache.PutVertex(*v, generation)
+
 	return nil
 }
 
 func (db *ProxyStorage) GetEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
+	if db.cache.FreshEdges(v, e) {
+		edges, err := db.cache.store.GetEdges(v, e)
+		if err == nil {
+			db.cache.Record(true)
+			return edges, nil
+		}
+	}
+
+	db.cache.Record(false)
+
+	generation := db.cache.Generation()
+
 	resp, err := db.GetAPIResponse(blend.APIRequest{
 		Method: "/edge/get",
 		Vertex: v,
@@ -98,6 +304,38 @@ func (db *ProxyStorage) GetEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, er
 	})
 
 	if err != nil {
+		if db.AllowOffline {
+			return db.cache.store.GetEdges(v, e)
+		}
+
+		return nil, err
+	}
+
+	if resp.Success == false {
+		return nil, errors.New(resp.Message)
+	}
+
+	if resp.Edges == nil {
+		return nil, errors.New("Edges not returned from source graph")
+	}
+
+	db.cache.PutEdges(v, e, *resp.Edges, generation)
+
+	return *resp.Edges, nil
+}
+
+func (db *ProxyStorage) GetIncomingEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, error) {
+	resp, err := db.GetAPIResponse(blend.APIRequest{
+		Method: "/edge/getIncoming",
+		Vertex: v,
+		Edge:   e,
+	})
+
+	if err != nil {
+		if db.AllowOffline {
+			return db.cache.store.GetIncomingEdges(v, e)
+		}
+
 		return nil, err
 	}
 
@@ -109,7 +347,7 @@ func (db *ProxyStorage) GetEdges(v blend.Vertex, e blend.Edge) ([]blend.Edge, er
 		return nil, errors.New("Edges not returned from source graph")
 	}
 
-	return resp.Edges, nil
+	return *resp.Edges, nil
 }
 
 func (db *ProxyStorage) GetChildVertex(v blend.Vertex, e blend.Edge) (blend.Vertex, error) {
@@ -120,6 +358,16 @@ func (db *ProxyStorage) GetChildVertex(v blend.Vertex, e blend.Edge) (blend.Vert
 	})
 
 	if err != nil {
+		if db.AllowOffline {
+			edges, serr := db.cache.store.GetEdges(v, e)
+			if serr == nil && len(edges) > 0 {
+				child := blend.Vertex{Id: edges[0].To}
+				if db.offlineVertex(&child) == nil {
+					return child, nil
+				}
+			}
+		}
+
 		return blend.Vertex{}, err
 	}
 
@@ -130,20 +378,85 @@ func (db *ProxyStorage) GetChildVertex(v blend.Vertex, e blend.Edge) (blend.Vert
 	return *resp.Vertex, nil
 }
 
+// serves a vertex from the cache regardless of its age, used while the
+// source graph is unreachable
+func (db *ProxyStorage) offlineVertex(v *blend.Vertex) error {
+	cached := blend.Vertex{Id: v.Id, PrivateKey: v.PrivateKey}
+
+	err := db.cache.store.GetVertex(&cached)
+	if err != nil {
+		return err
+	}
+
+	*v = cached
+	return nil
+}
+
+// Sends a write to the source graph. Offline, the write is queued instead
+// if the source graph is unreachable or earlier writes are still queued,
+// so they all reach it in order. Queued writes have to be applied to the
+// cache by the caller.
+func (db *ProxyStorage) write(req blend.APIRequest, base time.Time) (resp blend.APIResponse, queued bool, err error) {
+	if !db.AllowOffline || db.queue.Len() == 0 {
+		resp, err = db.GetAPIResponse(req)
+		if err == nil {
+			if !resp.Success {
+				err = errors.New(resp.Message)
+			}
+
+			return resp, false, err
+		}
+
+		if !db.AllowOffline {
+			return resp, false, err
+		}
+	}
+
+	return resp, true, db.queue.Push(req, base)
+}
+
+// the last change of the vertex as known by the cache, zero for an
+// unknown base when it is not cached
+func (db *ProxyStorage) base(v blend.Vertex) time.Time {
+	cached := blend.Vertex{Id: v.Id, PrivateKey: v.PrivateKey}
+	if db.cache.store.GetVertex(&cached) != nil {
+		return time.Time{}
+	}
+
+	return cached.LastChanged
+}
+
 func (db *ProxyStorage) CreateChildVertex(v, vc *blend.Vertex, e blend.Edge) error {
-	resp, err := db.GetAPIResponse(blend.APIRequest{
+	// queued children need an id before the source graph hands one out
+	err := newVertex(vc)
+	if err != nil {
+		return err
+	}
+
+	resp, queued, err := db.write(blend.APIRequest{
 		Method:      "/vertex/createChild",
 		Vertex:      *v,
 		ChildVertex: *vc,
 		Edge:        e,
-	})
+	}, time.Time{})
+
+	db.cache.Invalidate(v.Id)
 
 	if err != nil {
 		return err
 	}
 
-	if resp.Success == false {
-		return errors.New(resp.Message)
+	if queued {
+		e.Family = "ownership"
+		e.From = v.Id
+		e.To = vc.Id
+
+		err = db.cache.store.putVertex(*vc)
+		if err != nil {
+			return err
+		}
+
+		return db.cache.store.storeEdge(e)
 	}
 
 	*vc = *resp.Vertex
@@ -152,17 +465,22 @@ func (db *ProxyStorage) CreateChildVertex(v, vc *blend.Vertex, e blend.Edge) err
 }
 
 func (db *ProxyStorage) CreateVertex(v *blend.Vertex) error {
-	resp, err := db.GetAPIResponse(blend.APIRequest{
+	err := newVertex(v)
+	if err != nil {
+		return err
+	}
+
+	resp, queued, err := db.write(blend.APIRequest{
 		Method: "/vertex/create",
 		Vertex: *v,
-	})
+	}, time.Time{})
 
 	if err != nil {
 		return err
 	}
 
-	if resp.Success == false {
-		return errors.New(resp.Message)
+	if queued {
+		return db.cache.store.putVertex(*v)
 	}
 
 	*v = *resp.Vertex
@@ -171,23 +489,44 @@ func (db *ProxyStorage) CreateVertex(v *blend.Vertex) error {
 }
 
 func (db *ProxyStorage) UpdateVertex(v *blend.Vertex) error {
-	return nil
+	resp, queued, err := db.write(blend.APIRequest{
+		Method: "/vertex/update",
+		Vertex: *v,
+	}, db.base(*v))
+
+	db.cache.Invalidate(v.Id)
+
+	if err != nil {
+		return err
+	}
+
+	if !queued {
+		*v = *resp.Vertex
+	}
+
+	// later offline updates are based on this version
+	return db.cache.store.putVertex(*v)
 }
 
 func (db *ProxyStorage) CreateEdge(v, vc blend.Vertex, e *blend.Edge) error {
-	resp, err := db.GetAPIResponse(blend.APIRequest{
+	resp, queued, err := db.write(blend.APIRequest{
 		Method:      "/edge/create",
 		Vertex:      v,
 		ChildVertex: vc,
 		Edge:        *e,
-	})
+	}, time.Time{})
+
+	db.cache.Invalidate(v.Id)
 
 	if err != nil {
 		return err
 	}
 
-	if resp.Success == false {
-		return errors.New(resp.Message)
+	if queued {
+		e.From = v.Id
+		e.To = vc.Id
+
+		return db.cache.store.storeEdge(*e)
 	}
 
 	*e = *resp.Edge
@@ -195,10 +534,198 @@ func (db *ProxyStorage) CreateEdge(v, vc blend.Vertex, e *blend.Edge) error {
 	return nil
 }
 
+func (db *ProxyStorage) DeleteEdge(e blend.Edge) error {
+	return errors.New("Deleting edges is not supported by the proxy backend")
+}
+
+// The source graph always deletes everything owned by the vertex as well
 func (db *ProxyStorage) DeleteVertex(v *blend.Vertex) error {
-	return nil
+	_, err := db.DeleteVertexTree([]*blend.Vertex{v})
+	return err
 }
 
-func (db *ProxyStorage) DeleteVertexTree(vertices []*blend.Vertex) error {
+func (db *ProxyStorage) DeleteVertices(vertices []*blend.Vertex) (int, error) {
+	stats, err := db.DeleteVertexTree(vertices)
+	return stats.Edges, err
+}
+
+// Hands the deletion over to the source graph, the vertices need to carry
+// their private keys. Stops at the first vertex that cannot be deleted.
+func (db *ProxyStorage) DeleteVertexTree(vertices []*blend.Vertex) (blend.DeleteStats, error) {
+	stats := blend.DeleteStats{}
+
+	for _, v := range vertices {
+		resp, queued, err := db.write(blend.APIRequest{
+			Method: "/vertex/delete",
+			Vertex: *v,
+		}, db.base(*v))
+
+		// whatever the source graph deleted is unknown locally
+		db.cache.InvalidateAll()
+
+		if err != nil {
+			return stats, err
+		}
+
+		if queued {
+			deleted, err := db.deleteCachedTree(v.Id)
+			if err != nil {
+				return stats, err
+			}
+
+			stats.Vertices += deleted.Vertices
+			stats.Edges += deleted.Edges
+		} else if resp.Job != nil {
+			stats.Vertices += resp.Job.Deleted.Vertices
+			stats.Edges += resp.Job.Deleted.Edges
+			stats.Cycles += resp.Job.Deleted.Cycles
+		}
+	}
+
+	return stats, nil
+}
+
+// removes a vertex and whatever it owns as far as the cache knows
+func (db *ProxyStorage) deleteCachedTree(id string) (blend.DeleteStats, error) {
+	stats := blend.DeleteStats{}
+
+	seen := map[string]bool{id: true}
+	ids := []string{id}
+
+	for len(ids) > 0 {
+		v := &blend.Vertex{Id: ids[len(ids)-1]}
+		ids = ids[:len(ids)-1]
+
+		edges, err := db.cache.store.GetEdges(*v, blend.Edge{Family: "ownership"})
+		if err != nil {
+			return stats, err
+		}
+
+		for _, e := range edges {
+			if !seen[e.To] {
+				seen[e.To] = true
+				ids = append(ids, e.To)
+			}
+		}
+
+		count, err := db.cache.store.DeleteVertices([]*blend.Vertex{v})
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Vertices++
+		stats.Edges += count
+	}
+
+	return stats, nil
+}
+
+// Replays the queued writes in order, until the queue is empty or the
+// source graph becomes unreachable again. Writes conflicting with changes
+// made to the source graph in the mean time, or rejected by it, are
+// dropped from the queue and kept as conflicts.
+func (db *ProxyStorage) Sync() error {
+	db.syncLock.Lock()
+	defer db.syncLock.Unlock()
+
+	for {
+		seq, w, ok, err := db.queue.Peek()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		conflict, err := db.replay(w)
+		if err != nil {
+			return err
+		}
+
+		if conflict != "" {
+			fmt.Printf("Dropped queued %s: %s \n", w.Request.Method, conflict)
+
+			db.statusLock.Lock()
+			db.lastConflict = conflict
+			db.statusLock.Unlock()
+
+			err = db.queue.Reject(seq, w, conflict)
+		} else {
+			err = db.queue.Remove(seq)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	db.statusLock.Lock()
+	db.lastSync = time.Now()
+	db.statusLock.Unlock()
+
 	return nil
 }
+
+// Sends a single queued write. Returns why the write was rejected, or an
+// error if the source graph could not be reached.
+func (db *ProxyStorage) replay(w queuedWrite) (string, error) {
+	req := w.Request
+
+	check := req.Vertex
+	if req.Method == "/vertex/createChild" {
+		check = req.ChildVertex
+	}
+
+	switch req.Method {
+	case "/vertex/create", "/vertex/createChild":
+		resp, err := db.GetAPIResponse(blend.APIRequest{
+			Method: "/vertex/get",
+			Vertex: blend.Vertex{Id: check.Id},
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		if resp.Success {
+			return "Vertex " + check.Id + " already exists in the source graph", nil
+		}
+	case "/vertex/update", "/vertex/delete":
+		resp, err := db.GetAPIResponse(blend.APIRequest{
+			Method: "/vertex/get",
+			Vertex: blend.Vertex{Id: check.Id, PrivateKey: check.PrivateKey},
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		if !resp.Success {
+			return resp.Message, nil
+		}
+
+		if !w.Base.IsZero() && resp.Vertex.LastChanged.After(w.Base) {
+			return "Vertex " + check.Id + " changed in the source graph after the write was queued", nil
+		}
+	}
+
+	resp, err := db.GetAPIResponse(req)
+	if err != nil {
+		return "", err
+	}
+
+	db.cache.Invalidate(req.Vertex.Id)
+	db.cache.Invalidate(check.Id)
+
+	if !resp.Success {
+		return resp.Message, nil
+	}
+
+	// the source graph stamps updates with its own time
+	if resp.Vertex != nil {
+		return "", db.queue.Rebase(resp.Vertex.Id, resp.Vertex.LastChanged)
+	}
+
+	return "", nil
+}
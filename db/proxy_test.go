@@ -0,0 +1,298 @@
+package db_test
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ziahamza/blend"
+	"github.com/ziahamza/blend/api"
+	"github.com/ziahamza/blend/db"
+)
+
+// Runs an in process blend server on a bolt backend and returns a proxy
+// backend talking to it
+func startUpstream(t *testing.T) (*db.ProxyStorage, func()) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Init(path.Join(dir, "upstream.db"), &db.BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.SetAdminToken("admin token")
+	server := httptest.NewServer(api.Handler())
+
+	proxy := &db.ProxyStorage{CachePath: path.Join(dir, "cache.db"), AdminToken: "admin token"}
+	err = proxy.Init("ws" + strings.TrimPrefix(server.URL, "http") + "/graph/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proxy, func() {
+		proxy.Close()
+		server.Close()
+		api.SetAdminToken("")
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxy, stop := startUpstream(t)
+	defer stop()
+
+	vertex := &blend.Vertex{
+		Name:       "TestProxyRoot",
+		Type:       "test",
+		Private:    "secret data",
+		PrivateKey: "test key",
+	}
+
+	err := proxy.CreateVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vertex.PrivateKey = "test key"
+	vertex.Public = "updated data"
+
+	err = proxy.UpdateVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := &blend.Vertex{Id: vertex.Id}
+	err = db.GetVertex(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upstream.Public != "updated data" {
+		t.Fatal("Vertex update not forwarded to the source graph")
+	}
+
+	proxied := &blend.Vertex{Id: vertex.Id}
+	err = proxy.GetVertex(proxied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proxied.Public != "updated data" || proxied.Private != "" {
+		t.Fatal("Got back different vertex then expected", proxied)
+	}
+
+	// changes made by others invalidate the cached copy long before its ttl
+	err = db.UpdateVertex(&blend.Vertex{
+		Id: vertex.Id, Name: vertex.Name, Type: "test", Public: "changed upstream", PrivateKey: "test key",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxied.Public != "changed upstream" {
+		if time.Now().After(deadline) {
+			t.Fatal("Cached vertex not invalidated by a change to the source graph", proxied)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		proxied = &blend.Vertex{Id: vertex.Id}
+		err = proxy.GetVertex(proxied)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = proxy.UpdateVertex(&blend.Vertex{
+		Id: vertex.Id, Name: "x", Type: "test", PrivateKey: "wrong key",
+	})
+
+	if err == nil {
+		t.Fatal("Updated a vertex with the wrong private key")
+	}
+
+	child := &blend.Vertex{Id: "proxy child", Name: "TestProxyChild", Type: "test"}
+	err = proxy.CreateChildVertex(vertex, child, blend.Edge{
+		From: vertex.Id, To: child.Id, Family: "ownership", Type: "child", Name: "child",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = proxy.DeleteVertex(&blend.Vertex{Id: vertex.Id})
+	if err == nil {
+		t.Fatal("Deleted a vertex without its private key")
+	}
+
+	stats, err := proxy.DeleteVertexTree([]*blend.Vertex{vertex})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Vertices != 2 {
+		t.Fatal("Got back different delete stats then expected", stats)
+	}
+
+	if db.ConfirmVertex(vertex.Id) || db.ConfirmVertex(child.Id) {
+		t.Fatal("Vertex tree not deleted from the source graph")
+	}
+
+	if proxy.GetVertex(&blend.Vertex{Id: vertex.Id}) == nil {
+		t.Fatal("Proxy still serves a deleted vertex")
+	}
+}
+
+func TestProxyOffline(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = db.Init(path.Join(dir, "upstream.db"), &db.BoltStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = db.CreateVertex(&blend.Vertex{Id: "taken", Name: "Taken", Type: "test"})
+	if err == nil {
+		err = db.CreateVertex(&blend.Vertex{Id: "uncached", Name: "Uncached", Type: "test", PrivateKey: "key"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reserve an address for the source graph to come up on later
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// queued writes are not left to the temporary directory
+	proxy := &db.ProxyStorage{AllowOffline: true}
+	err = proxy.Init("ws://" + addr + "/graph/rpc")
+	if err == nil {
+		proxy.Close()
+		t.Fatal("Started offline without a cache path")
+	}
+
+	proxy = &db.ProxyStorage{CachePath: path.Join(dir, "cache.db"), AllowOffline: true}
+	err = proxy.Init("ws://" + addr + "/graph/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		proxy.Close()
+	}()
+
+	vertex := &blend.Vertex{Name: "TestOffline", Type: "test", PrivateKey: "test key"}
+	err = proxy.CreateVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = proxy.CreateVertex(&blend.Vertex{Id: "taken", Name: "Conflict", Type: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vertex.Public = "offline data"
+	err = proxy.UpdateVertex(vertex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a cached copy the base of the update is unknown
+	err = proxy.UpdateVertex(&blend.Vertex{Id: "uncached", Name: "Updated", Type: "test", PrivateKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := &blend.Vertex{Id: vertex.Id}
+	err = proxy.GetVertex(cached)
+	if err != nil || cached.Public != "offline data" {
+		t.Fatal("Offline proxy does not serve its own writes", cached, err)
+	}
+
+	status := proxy.SyncStatus()
+	if status.Online || status.Queued != 4 {
+		t.Fatal("Got back different sync status then expected", status)
+	}
+
+	// the queued writes are counted along with them
+	proxy.Close()
+
+	proxy = &db.ProxyStorage{CachePath: path.Join(dir, "cache.db"), AllowOffline: true}
+	err = proxy.Init("ws://" + addr + "/graph/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status = proxy.SyncStatus(); status.Queued != 4 {
+		t.Fatal("Got back different sync status after a restart then expected", status)
+	}
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(api.Handler())
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+
+	defer server.Close()
+
+	// the proxy backs off from reconnecting for a while
+	deadline := time.Now().Add(5 * time.Second)
+	for proxy.Sync() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Queued writes not replayed once the source graph is back")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	status = proxy.SyncStatus()
+	if status.Queued != 0 || status.Conflicts != 1 {
+		t.Fatal("Got back different sync status then expected", status)
+	}
+
+	upstream := &blend.Vertex{Id: vertex.Id}
+	err = db.GetVertex(upstream)
+	if err != nil || upstream.Public != "offline data" {
+		t.Fatal("Queued writes not applied to the source graph", upstream, err)
+	}
+
+	taken := &blend.Vertex{Id: "taken"}
+	err = db.GetVertex(taken)
+	if err != nil || taken.Name != "Taken" {
+		t.Fatal("Conflicting write overwrote the source graph", taken, err)
+	}
+
+	uncached := &blend.Vertex{Id: "uncached"}
+	err = db.GetVertex(uncached)
+	if err != nil || uncached.Name != "Updated" {
+		t.Fatal("Update with an unknown base not applied to the source graph", uncached, err)
+	}
+}
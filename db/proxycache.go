@@ -0,0 +1,148 @@
+// local cache of the graph behind a proxy backend
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ziahamza/blend"
+)
+
+const DefaultProxyCacheTTL = 30 * time.Second
+
+// Copies of vertices and edges from the source graph are kept in a bolt
+// database, along with in memory expiry times. Entries without an expiry
+// time (like everything left over from an earlier run) are stale and only
+// served again after being fetched from the source graph.
+type proxyCache struct {
+	store *BoltStorage
+	ttl   time.Duration
+
+	sync.Mutex
+
+	// expiry of cached vertices by id
+	vertices map[string]time.Time
+
+	// expiry of cached edge queries by the id of their source vertex
+	edges map[string]map[string]time.Time
+
+	// bumped by every invalidation, results fetched while it changed
+	// might already be outdated and are not marked fresh
+	generation uint64
+
+	stats blend.CacheStats
+}
+
+func newProxyCache(store *BoltStorage, ttl time.Duration) *proxyCache {
+	return &proxyCache{
+		store:    store,
+		ttl:      ttl,
+		vertices: map[string]time.Time{},
+		edges:    map[string]map[string]time.Time{},
+	}
+}
+
+// edges queried with a private key might carry data hidden from
+// queries without one, so they are cached separately
+func edgeQuery(v blend.Vertex, e blend.Edge) string {
+	return fmt.Sprintf("%t:%s:%s:%s", v.PrivateKey != "", e.Family, e.Type, e.Name)
+}
+
+// true if the cached vertex has not expired yet
+func (c *proxyCache) FreshVertex(id string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return time.Now().Before(c.vertices[id])
+}
+
+func (c *proxyCache) FreshEdges(v blend.Vertex, e blend.Edge) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return time.Now().Before(c.edges[v.Id][edgeQuery(v, e)])
+}
+
+// Counts a read either served from the cache or from the source graph
+func (c *proxyCache) Record(hit bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+func (c *proxyCache) Generation() uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.generation
+}
+
+// Caches a vertex fetched from the source graph when the fetch started
+// at the given generation
+func (c *proxyCache) PutVertex(v blend.Vertex, generation uint64) {
+	if c.store.putVertex(v) != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.generation == generation {
+		c.vertices[v.Id] = time.Now().Add(c.ttl)
+	}
+}
+
+func (c *proxyCache) PutEdges(v blend.Vertex, e blend.Edge, edges []blend.Edge, generation uint64) {
+	if c.store.replaceEdges(v, e, edges) != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// the stored edges might overlap with other queries of the vertex
+	// that are now cached with different data
+	c.edges[v.Id] = map[string]time.Time{}
+
+	if c.generation == generation {
+		c.edges[v.Id][edgeQuery(v, e)] = time.Now().Add(c.ttl)
+	}
+}
+
+// Marks the vertex and its edges stale
+func (c *proxyCache) Invalidate(id string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.generation++
+	c.stats.Invalidations++
+
+	delete(c.vertices, id)
+	delete(c.edges, id)
+}
+
+// Marks everything stale, when changes to the source graph might
+// have been missed
+func (c *proxyCache) InvalidateAll() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.generation++
+	c.stats.Invalidations++
+
+	c.vertices = map[string]time.Time{}
+	c.edges = map[string]map[string]time.Time{}
+}
+
+func (c *proxyCache) Stats() blend.CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.stats
+}
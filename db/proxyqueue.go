@@ -0,0 +1,257 @@
+// durable queue of writes for a proxy backend working offline
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+// A write accepted while the source graph was unreachable. Base is the
+// last change of the vertex as known locally when the write was queued,
+// replaying the write is a conflict if the source graph changed the
+// vertex after that. A zero base is unknown, the write is replayed
+// without checking for conflicts.
+type queuedWrite struct {
+	Request  blend.APIRequest `json:"request"`
+	Base     time.Time        `json:"base"`
+	Queued   time.Time        `json:"queued"`
+	Conflict string           `json:"conflict,omitempty"`
+}
+
+// Writes are kept in order in the queue bucket of the cache database,
+// the ones rejected during replay are moved to the conflicts bucket
+// for inspection. The writes in both are counted in the meta bucket, as
+// counting the keys of a bucket reads all of it.
+type writeQueue struct {
+	store *BoltStorage
+}
+
+// Counts the writes of caches queued in before they were counted
+func newWriteQueue(store *BoltStorage) (*writeQueue, error) {
+	err := store.store.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"queue", "conflicts"} {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil || tx.Bucket([]byte("meta")).Get(countKey(name)) != nil {
+				continue
+			}
+
+			err := addCount(tx, name, bucket.Stats().KeyN)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeQueue{store: store}, nil
+}
+
+func countKey(name string) []byte {
+	return []byte(name + " count")
+}
+
+func readCount(tx *bolt.Tx, name string) int {
+	cbytes := tx.Bucket([]byte("meta")).Get(countKey(name))
+	if cbytes == nil {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint64(cbytes))
+}
+
+func addCount(tx *bolt.Tx, name string, n int) error {
+	count := uint64(readCount(tx, name) + n)
+	return tx.Bucket([]byte("meta")).Put(countKey(name), binary.BigEndian.AppendUint64(nil, count))
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func (q *writeQueue) Push(req blend.APIRequest, base time.Time) error {
+	wbytes, err := json.Marshal(queuedWrite{Request: req, Base: base, Queued: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	return q.store.store.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("queue"))
+		if err != nil {
+			return err
+		}
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put(sequenceKey(seq), wbytes)
+		if err != nil {
+			return err
+		}
+
+		return addCount(tx, "queue", 1)
+	})
+}
+
+// Returns the oldest write in the queue, ok is false if it is empty
+func (q *writeQueue) Peek() (seq uint64, w queuedWrite, ok bool, err error) {
+	err = q.store.store.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("queue"))
+		if bucket == nil {
+			return nil
+		}
+
+		k, wbytes := bucket.Cursor().First()
+		if k == nil {
+			return nil
+		}
+
+		seq, ok = binary.BigEndian.Uint64(k), true
+
+		return json.Unmarshal(wbytes, &w)
+	})
+
+	return seq, w, ok, err
+}
+
+func (q *writeQueue) Remove(seq uint64) error {
+	return q.store.store.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("queue"))
+		if bucket == nil || bucket.Get(sequenceKey(seq)) == nil {
+			return nil
+		}
+
+		err := bucket.Delete(sequenceKey(seq))
+		if err != nil {
+			return err
+		}
+
+		return addCount(tx, "queue", -1)
+	})
+}
+
+// Drops the write from the queue, keeping it along with the reason
+// it was rejected
+func (q *writeQueue) Reject(seq uint64, w queuedWrite, reason string) error {
+	w.Conflict = reason
+
+	wbytes, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	return q.store.store.Update(func(tx *bolt.Tx) error {
+		conflicts, err := tx.CreateBucketIfNotExists([]byte("conflicts"))
+		if err != nil {
+			return err
+		}
+
+		cseq, err := conflicts.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		err = conflicts.Put(sequenceKey(cseq), wbytes)
+		if err == nil {
+			err = addCount(tx, "conflicts", 1)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		queue := tx.Bucket([]byte("queue"))
+		if queue.Get(sequenceKey(seq)) == nil {
+			return nil
+		}
+
+		err = queue.Delete(sequenceKey(seq))
+		if err != nil {
+			return err
+		}
+
+		return addCount(tx, "queue", -1)
+	})
+}
+
+// Moves the base of the queued updates and deletes of the vertex up to
+// a change made by replaying an earlier write, so later writes do not
+// conflict with changes of their own
+func (q *writeQueue) Rebase(id string, base time.Time) error {
+	return q.store.store.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("queue"))
+		if bucket == nil {
+			return nil
+		}
+
+		rebased := map[string][]byte{}
+
+		err := bucket.ForEach(func(k, wbytes []byte) error {
+			w := queuedWrite{}
+			err := json.Unmarshal(wbytes, &w)
+			if err != nil {
+				return err
+			}
+
+			if w.Request.Vertex.Id != id ||
+				(w.Request.Method != "/vertex/update" && w.Request.Method != "/vertex/delete") {
+				return nil
+			}
+
+			w.Base = base
+
+			wbytes, err = json.Marshal(w)
+			if err != nil {
+				return err
+			}
+
+			rebased[string(k)] = wbytes
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for k, wbytes := range rebased {
+			err = bucket.Put([]byte(k), wbytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (q *writeQueue) count(name string) int {
+	count := 0
+
+	q.store.store.View(func(tx *bolt.Tx) error {
+		count = readCount(tx, name)
+		return nil
+	})
+
+	return count
+}
+
+func (q *writeQueue) Len() int {
+	return q.count("queue")
+}
+
+func (q *writeQueue) Conflicts() int {
+	return q.count("conflicts")
+}
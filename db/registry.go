@@ -0,0 +1,81 @@
+// registry of the storage backends available by name
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returns a new, uninitialized backend. The backend is configured by the
+// uri passed to its Init.
+type Factory func() Storage
+
+var registry struct {
+	sync.RWMutex
+	factories map[string]Factory
+}
+
+// Makes a backend available by name, usually from the init function of the
+// package implementing it. Registering the same name twice or a nil factory
+// panics, the same as database/sql drivers.
+func Register(name string, factory Factory) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if factory == nil {
+		panic("db: Register factory is nil for backend " + name)
+	}
+
+	if registry.factories == nil {
+		registry.factories = map[string]Factory{}
+	}
+
+	if _, ok := registry.factories[name]; ok {
+		panic("db: Register called twice for backend " + name)
+	}
+
+	registry.factories[name] = factory
+}
+
+// Names of the registered backends in alphabetical order
+func Backends() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	names := []string{}
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Creates a backend registered under the name, without initializing it so
+// its options can still be set before passing it to Init
+func NewStorage(name string) (Storage, error) {
+	registry.RLock()
+	factory := registry.factories[name]
+	registry.RUnlock()
+
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown storage backend %s, available backends are %s",
+			name, strings.Join(Backends(), ", "))
+	}
+
+	return factory(), nil
+}
+
+// Creates the backend registered under the name and initializes it with
+// the uri
+func Open(name, uri string) error {
+	s, err := NewStorage(name)
+	if err != nil {
+		return err
+	}
+
+	return Init(uri, s)
+}
@@ -0,0 +1,307 @@
+// multiplexed websocket connection to the rpc api of a blend graph
+package db
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ziahamza/blend"
+)
+
+const (
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// A single long lived connection shared by every call. Requests are tagged
+// with an id so responses can be matched up in whatever order the server
+// sends them back. A broken connection fails all the calls waiting on it
+// and is redialed by the next call, backing off exponentially while the
+// server stays unreachable.
+type rpcClient struct {
+	url string
+
+	// sent along when dialing
+	header http.Header
+
+	sync.Mutex
+	conn    *websocket.Conn
+	pending map[uint64]chan blend.APIResponse
+	streams map[uint64]func(blend.APIResponse)
+	nextId  uint64
+	closed  bool
+
+	// called in the background after every new connection and once a
+	// connection breaks, streams have to be requested again on every
+	// new connection
+	onConnect    func()
+	onDisconnect func()
+
+	// consecutive failed dials and when the next one is allowed
+	failures int
+	retryAt  time.Time
+
+	// closed once the dial in progress is done, nil while there is none
+	dialing chan struct{}
+
+	// fail calls right away while backing off instead of waiting
+	// for the next dial
+	failFast bool
+
+	// gorilla connections support only one concurrent writer
+	writeLock sync.Mutex
+}
+
+func newRPCClient(url string) *rpcClient {
+	return &rpcClient{
+		url:     url,
+		header:  http.Header{},
+		pending: map[uint64]chan blend.APIResponse{},
+		streams: map[uint64]func(blend.APIResponse){},
+	}
+}
+
+// returns the current connection, dialing a new one if needed.
+// Has to be called with the client locked, the lock is let go while
+// dialing or waiting so other calls are not held up by the network.
+func (c *rpcClient) connect(ctx context.Context) (*websocket.Conn, error) {
+	for c.conn == nil {
+		if c.closed {
+			return nil, errors.New("Connection to the graph closed")
+		}
+
+		// one dial at a time, the others use the connection it makes
+		if dialing := c.dialing; dialing != nil {
+			c.Unlock()
+
+			select {
+			case <-dialing:
+				c.Lock()
+			case <-ctx.Done():
+				c.Lock()
+				return nil, ctx.Err()
+			}
+
+			continue
+		}
+
+		if wait := time.Until(c.retryAt); wait > 0 {
+			if c.failFast {
+				return nil, errors.New("Graph unreachable, waiting to reconnect")
+			}
+
+			c.Unlock()
+
+			select {
+			case <-time.After(wait):
+				c.Lock()
+			case <-ctx.Done():
+				c.Lock()
+				return nil, ctx.Err()
+			}
+
+			// somebody else might have connected in the mean time
+			continue
+		}
+
+		dialing := make(chan struct{})
+		c.dialing = dialing
+
+		c.Unlock()
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.url, c.header)
+		c.Lock()
+
+		c.dialing = nil
+		close(dialing)
+
+		if err != nil {
+			delay := minReconnectDelay << uint(c.failures)
+			if delay > maxReconnectDelay || delay <= 0 {
+				delay = maxReconnectDelay
+			} else {
+				c.failures++
+			}
+
+			c.retryAt = time.Now().Add(delay)
+
+			return nil, err
+		}
+
+		if c.closed {
+			conn.Close()
+			return nil, errors.New("Connection to the graph closed")
+		}
+
+		c.failures = 0
+		c.conn = conn
+
+		go c.read(conn)
+
+		if c.onConnect != nil {
+			go c.onConnect()
+		}
+	}
+
+	return c.conn, nil
+}
+
+// dispatches responses to the waiting calls until the connection breaks
+func (c *rpcClient) read(conn *websocket.Conn) {
+	for {
+		var resp blend.APIResponse
+
+		err := conn.ReadJSON(&resp)
+		if err != nil {
+			break
+		}
+
+		c.Lock()
+		ch := c.pending[resp.RequestId]
+		delete(c.pending, resp.RequestId)
+		stream := c.streams[resp.RequestId]
+		c.Unlock()
+
+		if ch != nil {
+			ch <- resp
+		} else if stream != nil {
+			stream(resp)
+		}
+	}
+
+	conn.Close()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.conn != conn {
+		return
+	}
+
+	c.conn = nil
+
+	// the calls still waiting will never get a response
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+
+	c.streams = map[uint64]func(blend.APIResponse){}
+
+	if c.onDisconnect != nil {
+		go c.onDisconnect()
+	}
+}
+
+func (c *rpcClient) Call(ctx context.Context, req blend.APIRequest) (blend.APIResponse, error) {
+	c.Lock()
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.Unlock()
+		return blend.APIResponse{}, err
+	}
+
+	c.nextId++
+	req.RequestId = c.nextId
+
+	ch := make(chan blend.APIResponse, 1)
+	c.pending[req.RequestId] = ch
+
+	c.Unlock()
+
+	// no deadline clears the one left behind by an earlier call
+	deadline, _ := ctx.Deadline()
+
+	c.writeLock.Lock()
+	conn.SetWriteDeadline(deadline)
+
+	err = conn.WriteJSON(&req)
+	c.writeLock.Unlock()
+
+	if err != nil {
+		c.forget(req.RequestId)
+
+		// let the reader notice the broken connection and clean up
+		conn.Close()
+
+		return blend.APIResponse{}, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return resp, errors.New("Connection to the graph lost")
+		}
+
+		return resp, nil
+	case <-ctx.Done():
+		c.forget(req.RequestId)
+		return blend.APIResponse{}, ctx.Err()
+	}
+}
+
+// Sends a request answered by a stream of responses, every one of them is
+// passed to the handler from the connection reader. The stream ends with
+// the connection it was requested on.
+func (c *rpcClient) Stream(ctx context.Context, req blend.APIRequest, handler func(blend.APIResponse)) error {
+	c.Lock()
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.Unlock()
+		return err
+	}
+
+	c.nextId++
+	req.RequestId = c.nextId
+	c.streams[req.RequestId] = handler
+
+	c.Unlock()
+
+	deadline, _ := ctx.Deadline()
+
+	c.writeLock.Lock()
+	conn.SetWriteDeadline(deadline)
+
+	err = conn.WriteJSON(&req)
+	c.writeLock.Unlock()
+
+	if err != nil {
+		c.Lock()
+		delete(c.streams, req.RequestId)
+		c.Unlock()
+
+		conn.Close()
+	}
+
+	return err
+}
+
+func (c *rpcClient) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.conn != nil
+}
+
+func (c *rpcClient) forget(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *rpcClient) Close() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closed = true
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
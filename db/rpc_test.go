@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ziahamza/blend"
+)
+
+// a slow handshake holds up neither the client nor the calls giving up on
+// it, and the calls waiting for it share its connection
+func TestRPCDial(t *testing.T) {
+	dials := int32(0)
+	dialed, release := make(chan bool, 1), make(chan bool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		atomic.AddInt32(&dials, 1)
+		dialed <- true
+		<-release
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(wr, rq, nil)
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		for {
+			var req blend.APIRequest
+			if conn.ReadJSON(&req) != nil {
+				return
+			}
+
+			conn.WriteJSON(blend.APIResponse{RequestId: req.RequestId, Success: true})
+		}
+	}))
+
+	defer server.Close()
+
+	client := newRPCClient("ws" + strings.TrimPrefix(server.URL, "http"))
+	defer client.Close()
+
+	// lets the handshake finish when the test fails half way
+	var once sync.Once
+	finish := func() { once.Do(func() { close(release) }) }
+	defer finish()
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Call(context.Background(), blend.APIRequest{Method: "/"})
+			results <- err
+		}()
+	}
+
+	<-dialed
+
+	connected := make(chan bool)
+	go func() { connected <- client.Connected() }()
+
+	select {
+	case ok := <-connected:
+		if ok {
+			t.Fatal("Connected before the handshake finished")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Client locked while dialing")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err := client.Call(ctx, blend.APIRequest{Method: "/"})
+	cancel()
+
+	if err != context.DeadlineExceeded {
+		t.Fatal("Call did not give up waiting for the dial", err)
+	}
+
+	finish()
+
+	for i := 0; i < 2; i++ {
+		err = <-results
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatal("Got a different number of dials then expected", dials)
+	}
+}
@@ -0,0 +1,530 @@
+// deleted vertex trees kept in a trash until they are restored or purged
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ziahamza/blend"
+)
+
+type TrashOptions struct {
+	// how long trashed trees are kept before they are purged, forever
+	// if zero
+	Retention time.Duration
+}
+
+// interval between looking for trashed trees past their retention
+const trashPurgeInterval = time.Minute
+
+type trashCan struct {
+	sync.Mutex
+
+	store *bolt.DB
+	opts  TrashOptions
+
+	// every trashed vertex by the vertex its tree was trashed with
+	hidden map[string]string
+
+	stop chan bool
+	done chan bool
+}
+
+// nil while deletes are permanent
+var trash *trashCan
+
+// Optionally implemented by backends that keep the path of the trash
+// opened along with them. Trashed trees are owned by nothing, so garbage
+// collection refuses to remove anything without the trash they are in.
+type TrashRecorder interface {
+	RecordTrash(path string) error
+
+	// empty if no trash was ever opened along with the backend
+	RecordedTrash() (string, error)
+}
+
+// The path of the trash last opened along with the graph, empty if none
+// was or the backend does not keep it
+func RecordedTrash() (string, error) {
+	recorder, ok := backend.(TrashRecorder)
+	if !ok {
+		return "", nil
+	}
+
+	return recorder.RecordedTrash()
+}
+
+// kept absolute, as the garbage collector might run elsewhere
+func recordTrash(path string) error {
+	recorder, ok := backend.(TrashRecorder)
+	if !ok {
+		return nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	return recorder.RecordTrash(abs)
+}
+
+// Makes deleting a vertex tree through TrashVertexTree keep the tree,
+// hidden from reads, with the trash entries kept in the bolt database at
+// the path. Trashed trees are purged after the retention. Meant to be
+// called on startup, after the graph is opened so it can record the path.
+func OpenTrash(path string, opts TrashOptions) error {
+	store, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	tc := &trashCan{
+		store:  store,
+		opts:   opts,
+		hidden: map[string]string{},
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("trash"))
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(_, ebytes []byte) error {
+			entry := blend.TrashEntry{}
+			err := json.Unmarshal(ebytes, &entry)
+			if err != nil {
+				return err
+			}
+
+			for _, id := range entry.Vertices {
+				tc.hidden[id] = entry.Vertex
+			}
+
+			return nil
+		})
+	})
+
+	if err == nil {
+		err = recordTrash(path)
+	}
+
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	trash = tc
+
+	go tc.run()
+
+	return nil
+}
+
+// Makes deletes permanent again. Trashed trees are left detached from
+// their owners, and only hidden again once the trash is reopened.
+func CloseTrash() {
+	tc := trash
+	if tc == nil {
+		return
+	}
+
+	trash = nil
+
+	close(tc.stop)
+	<-tc.done
+
+	tc.store.Close()
+}
+
+func TrashEnabled() bool {
+	return trash != nil
+}
+
+// whether the vertex is hidden in the trash
+func trashed(id string) bool {
+	tc := trash
+	if tc == nil {
+		return false
+	}
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	_, ok := tc.hidden[id]
+	return ok
+}
+
+// leaves out the edges from or to trashed vertices
+func visibleEdges(edges []blend.Edge) []blend.Edge {
+	if trash == nil {
+		return edges
+	}
+
+	visible := []blend.Edge{}
+	for _, e := range edges {
+		if !trashed(e.From) && !trashed(e.To) {
+			visible = append(visible, e)
+		}
+	}
+
+	return visible
+}
+
+// vertices trashed trees were trashed with, kept by garbage collection
+// as their trees are no longer owned by anything
+func trashedRoots() []string {
+	tc := trash
+	if tc == nil {
+		return nil
+	}
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	roots := []string{}
+	for id, root := range tc.hidden {
+		if id == root {
+			roots = append(roots, id)
+		}
+	}
+
+	return roots
+}
+
+// Moves the vertex and everything it owns into the trash. The ownership
+// edges of the vertex are removed to be restored along with it, every
+// other edge pointing into the tree stays but is hidden until the tree is
+// restored. The address the delete came from and who deleted the vertex
+// as claimed by the client are kept in the entry. Fails the same way as
+// deleting the tree would.
+func TrashVertexTree(vertex *blend.Vertex, from, by string) (blend.TrashEntry, error) {
+	tc := trash
+	if tc == nil {
+		return blend.TrashEntry{}, errors.New("Trash not enabled")
+	}
+
+	err := rejectMounted(vertex.Id)
+	if err != nil {
+		return blend.TrashEntry{}, err
+	}
+
+	if trashed(vertex.Id) {
+		return blend.TrashEntry{}, errors.New("Vertex is already in the trash")
+	}
+
+	ids, _, err := collectTree([]*blend.Vertex{vertex})
+	if err != nil {
+		return blend.TrashEntry{}, err
+	}
+
+	incoming, err := incomingEdges(ids)
+	if err != nil {
+		return blend.TrashEntry{}, err
+	}
+
+	entry := blend.TrashEntry{
+		Vertex:      vertex.Id,
+		Vertices:    []string{},
+		Parents:     []blend.Edge{},
+		Deleted:     time.Now(),
+		DeletedFrom: from,
+		DeletedBy:   by,
+	}
+
+	for _, id := range ids {
+		if !trashed(id) {
+			entry.Vertices = append(entry.Vertices, id)
+		}
+	}
+
+	for _, e := range incoming {
+		if e.Family == "ownership" && e.To == vertex.Id {
+			entry.Parents = append(entry.Parents, e)
+		}
+	}
+
+	// hidden before being detached, so the tree is never seen without
+	// its owners
+	err = tc.put(entry)
+	if err != nil {
+		return blend.TrashEntry{}, err
+	}
+
+	for _, e := range entry.Parents {
+		err = DeleteEdge(e)
+		if err != nil {
+			return entry, err
+		}
+	}
+
+	for _, id := range entry.Vertices {
+		notify(id, "vertex:delete")
+	}
+
+	return entry, nil
+}
+
+func (tc *trashCan) put(entry blend.TrashEntry) error {
+	tc.Lock()
+	defer tc.Unlock()
+
+	ebytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = tc.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("trash")).Put([]byte(entry.Vertex), ebytes)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range entry.Vertices {
+		tc.hidden[id] = entry.Vertex
+	}
+
+	return nil
+}
+
+func (tc *trashCan) remove(entry blend.TrashEntry) error {
+	tc.Lock()
+	defer tc.Unlock()
+
+	err := tc.store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("trash")).Delete([]byte(entry.Vertex))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range entry.Vertices {
+		delete(tc.hidden, id)
+	}
+
+	return nil
+}
+
+// Every tree in the trash, the oldest first
+func TrashEntries() ([]blend.TrashEntry, error) {
+	tc := trash
+	if tc == nil {
+		return nil, errors.New("Trash not enabled")
+	}
+
+	return tc.entries()
+}
+
+func (tc *trashCan) entries() ([]blend.TrashEntry, error) {
+	entries := []blend.TrashEntry{}
+
+	err := tc.store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("trash")).ForEach(func(_, ebytes []byte) error {
+			entry := blend.TrashEntry{}
+			err := json.Unmarshal(ebytes, &entry)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+
+	return entries, err
+}
+
+// The trash entry of the tree trashed with the vertex
+func GetTrashEntry(id string) (blend.TrashEntry, error) {
+	tc := trash
+	if tc == nil {
+		return blend.TrashEntry{}, errors.New("Trash not enabled")
+	}
+
+	return tc.get(id)
+}
+
+func (tc *trashCan) get(id string) (blend.TrashEntry, error) {
+	entry := blend.TrashEntry{}
+
+	err := tc.store.View(func(tx *bolt.Tx) error {
+		ebytes := tx.Bucket([]byte("trash")).Get([]byte(id))
+		if ebytes == nil {
+			return errors.New("Vertex not found in the trash")
+		}
+
+		return json.Unmarshal(ebytes, &entry)
+	})
+
+	return entry, err
+}
+
+// Confirms the private key of a vertex trashed with its tree
+func ConfirmTrashKey(id, key string) bool {
+	if _, err := GetTrashEntry(id); err != nil {
+		return false
+	}
+
+	return key != "" && backend.GetVertex(&blend.Vertex{Id: id, PrivateKey: key}) == nil
+}
+
+// Brings the tree trashed with the vertex back, owned by the parents it
+// was detached from. Fails if none of them is left, unless the vertex was
+// not owned by any vertex to begin with.
+func RestoreTrash(id string) (blend.TrashEntry, error) {
+	tc := trash
+	if tc == nil {
+		return blend.TrashEntry{}, errors.New("Trash not enabled")
+	}
+
+	entry, err := tc.get(id)
+	if err != nil {
+		return entry, err
+	}
+
+	parents := []blend.Edge{}
+	for _, e := range entry.Parents {
+		if ConfirmVertex(e.From) {
+			parents = append(parents, e)
+		}
+	}
+
+	if len(parents) == 0 && len(entry.Parents) > 0 {
+		return entry, errors.New("None of the vertices the trashed vertex was owned by are left")
+	}
+
+	// creating an ownership edge keeps one of the same type and name, so a
+	// parent owning another vertex by its name now would leave the tree
+	// without an owner
+	for _, e := range parents {
+		taken, err := backend.GetEdges(blend.Vertex{Id: e.From}, blend.Edge{Family: "ownership", Type: e.Type, Name: e.Name})
+		if err != nil {
+			return entry, err
+		}
+
+		for _, owned := range taken {
+			if owned.To != e.To {
+				return entry, fmt.Errorf("Vertex %s already owns a vertex as %s:%s", e.From, e.Type, e.Name)
+			}
+		}
+	}
+
+	// the tree has to be visible for its edges to be created, it goes back
+	// into the trash if any of them cannot be
+	err = tc.remove(entry)
+	if err != nil {
+		return entry, err
+	}
+
+	for i := range parents {
+		e := &parents[i]
+
+		err = CreateEdge(blend.Vertex{Id: e.From}, blend.Vertex{Id: e.To}, e)
+		if err != nil {
+			for _, created := range parents[:i] {
+				DeleteEdge(created)
+			}
+
+			if serr := tc.put(entry); serr != nil {
+				return entry, serr
+			}
+
+			return entry, err
+		}
+	}
+
+	for _, id := range entry.Vertices {
+		notify(id, "vertex:create")
+	}
+
+	entry.Parents = parents
+
+	return entry, nil
+}
+
+// Permanently deletes the tree trashed with the vertex
+func PurgeTrash(id string) (blend.DeleteStats, error) {
+	tc := trash
+	if tc == nil {
+		return blend.DeleteStats{}, errors.New("Trash not enabled")
+	}
+
+	entry, err := tc.get(id)
+	if err != nil {
+		return blend.DeleteStats{}, err
+	}
+
+	return tc.purge(entry)
+}
+
+func (tc *trashCan) purge(entry blend.TrashEntry) (blend.DeleteStats, error) {
+	stats, err := DeleteVertexTree([]*blend.Vertex{{Id: entry.Vertex}}, nil)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, tc.remove(entry)
+}
+
+func (tc *trashCan) run() {
+	defer close(tc.done)
+
+	if tc.opts.Retention <= 0 {
+		<-tc.stop
+		return
+	}
+
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		tc.purgeExpired()
+
+		select {
+		case <-tc.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (tc *trashCan) purgeExpired() {
+	entries, err := tc.entries()
+	if err != nil {
+		fmt.Printf("Cannot read the trash: %s \n", err.Error())
+		return
+	}
+
+	cutoff := time.Now().Add(-tc.opts.Retention)
+
+	for _, entry := range entries {
+		if !entry.Deleted.Before(cutoff) {
+			return
+		}
+
+		stats, err := tc.purge(entry)
+		if err != nil {
+			fmt.Printf("Cannot purge vertex %s from the trash: %s \n", entry.Vertex, err.Error())
+			continue
+		}
+
+		fmt.Printf("Purged vertex %s from the trash with %d vertices and %d edges \n",
+			entry.Vertex, stats.Vertices, stats.Edges)
+	}
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestTrash(t *testing.T) {
+	dir := initTestGraph(t)
+
+	trashPath := path.Join(dir, "trash.db")
+
+	err := OpenTrash(trashPath, TrashOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = OpenHistory(path.Join(dir, "history.db"), HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseHistory()
+
+	parent := &blend.Vertex{Name: "parent", Type: "test", PrivateKey: "key"}
+	child := &blend.Vertex{Name: "child", Type: "test", PrivateKey: "child"}
+	grandchild := &blend.Vertex{Name: "grandchild", Type: "test"}
+	other := &blend.Vertex{Name: "other", Type: "test"}
+
+	err = CreateVertex(parent)
+	if err == nil {
+		err = CreateVertex(other)
+	}
+
+	if err == nil {
+		err = CreateChildVertex(parent, child, blend.Edge{Type: "child", Name: "child"})
+	}
+
+	if err == nil {
+		err = CreateChildVertex(child, grandchild, blend.Edge{Type: "child", Name: "grandchild"})
+	}
+
+	if err == nil {
+		err = CreateEdge(*other, *child, &blend.Edge{Family: "public", Type: "link", Name: "child"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := TrashVertexTree(child, "127.0.0.1:4000", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entry.Vertices) != 2 || len(entry.Parents) != 1 ||
+		entry.DeletedFrom != "127.0.0.1:4000" || entry.DeletedBy != "tester" {
+		t.Fatal("Got back a different trash entry then expected", entry)
+	}
+
+	// reading the graph as of now hides the trash the same way
+	if GetVertexAsOf(&blend.Vertex{Id: grandchild.Id}, time.Now()) == nil {
+		t.Fatal("Trashed vertex is still visible as of now")
+	}
+
+	edges, err := GetEdgesAsOf(*other, blend.Edge{Family: "public"}, time.Now())
+	if err != nil || len(edges) != 0 {
+		t.Fatal("Edge to a trashed vertex is still visible as of now", edges, err)
+	}
+
+	if _, err = Revisions(child.Id, "child"); err == nil {
+		t.Fatal("Revisions of a trashed vertex are still visible")
+	}
+
+	if GetVertex(&blend.Vertex{Id: grandchild.Id}) == nil {
+		t.Fatal("Trashed vertex is still visible")
+	}
+
+	edges, err = GetEdges(*parent, blend.Edge{Family: "ownership"})
+	if err != nil || len(edges) != 0 {
+		t.Fatal("Trashed vertex is still owned", edges, err)
+	}
+
+	edges, err = GetEdges(*other, blend.Edge{Family: "public"})
+	if err != nil || len(edges) != 0 {
+		t.Fatal("Edge to a trashed vertex is still visible", edges, err)
+	}
+
+	result, err := CollectGarbage(GCOptions{Roots: []string{parent.Id, other.Id}, DryRun: true})
+	if err != nil || len(result.Unreachable) != 0 {
+		t.Fatal("Trashed tree collected as garbage", result, err)
+	}
+
+	if !ConfirmTrashKey(child.Id, "child") || ConfirmTrashKey(child.Id, "wrong") {
+		t.Fatal("Cannot confirm the private key of a trashed vertex")
+	}
+
+	_, err = RestoreTrash(child.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := blend.Vertex{Id: grandchild.Id}
+	if GetVertex(&v) != nil {
+		t.Fatal("Restored vertex not visible")
+	}
+
+	restored, err := GetChildVertex(*parent, blend.Edge{Family: "ownership", Type: "child", Name: "child"})
+	if err != nil || restored.Id != child.Id {
+		t.Fatal("Restored vertex not owned by its parent again", restored, err)
+	}
+
+	edges, err = GetEdges(*other, blend.Edge{Family: "public"})
+	if err != nil || len(edges) != 1 {
+		t.Fatal("Edge to a restored vertex not visible", edges, err)
+	}
+
+	_, err = TrashVertexTree(child, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CloseTrash()
+
+	// past the retention as soon as it is reopened
+	err = OpenTrash(trashPath, TrashOptions{Retention: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CloseTrash()
+
+	if backend.GetVertex(&blend.Vertex{Id: grandchild.Id}) == nil {
+		t.Fatal("Trashed vertex not purged after the retention")
+	}
+
+	if backend.GetVertex(&blend.Vertex{Id: parent.Id}) != nil {
+		t.Fatal("Purging the trash removed the parent")
+	}
+}
+
+// fails to create the edges from one vertex
+type failingEdges struct {
+	Storage
+	from string
+}
+
+func (s failingEdges) CreateEdge(v, vc blend.Vertex, e *blend.Edge) error {
+	if v.Id == s.from {
+		return errors.New("Edge not created")
+	}
+
+	return s.Storage.CreateEdge(v, vc, e)
+}
+
+func TestRestoreTrashFailing(t *testing.T) {
+	dir := initTestGraph(t)
+
+	err := OpenTrash(path.Join(dir, "trash.db"), TrashOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseTrash()
+
+	first := &blend.Vertex{Name: "first", Type: "test"}
+	second := &blend.Vertex{Name: "second", Type: "test"}
+	child := &blend.Vertex{Name: "child", Type: "test"}
+
+	err = CreateVertex(first)
+	if err == nil {
+		err = CreateVertex(second)
+	}
+
+	if err == nil {
+		err = CreateChildVertex(first, child, blend.Edge{Type: "child", Name: "child"})
+	}
+
+	if err == nil {
+		err = CreateEdge(*second, *child, &blend.Edge{Family: "ownership", Type: "child", Name: "child"})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = TrashVertexTree(child, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree stays in the trash when one of its owners took another
+	// vertex by its name in the meantime
+	taken := &blend.Vertex{Name: "taken", Type: "test"}
+	err = CreateChildVertex(second, taken, blend.Edge{Type: "child", Name: "child"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = RestoreTrash(child.Id)
+	if err == nil {
+		t.Fatal("Restored a tree over a vertex owned by the same name")
+	}
+
+	if _, err = GetTrashEntry(child.Id); err != nil || !trashed(child.Id) {
+		t.Fatal("Tree not kept in the trash after failing to restore it", err)
+	}
+
+	err = DeleteVertex(taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree goes back into the trash when an edge cannot be created,
+	// without the edges created before
+	storage := backend
+	backend = failingEdges{Storage: storage, from: second.Id}
+
+	_, err = RestoreTrash(child.Id)
+	backend = storage
+
+	if err == nil {
+		t.Fatal("Restored a tree without creating its edges")
+	}
+
+	if _, err = GetTrashEntry(child.Id); err != nil || !trashed(child.Id) {
+		t.Fatal("Tree not put back into the trash after failing to restore it", err)
+	}
+
+	edges, err := backend.GetEdges(*first, blend.Edge{Family: "ownership"})
+	if err != nil || len(edges) != 0 {
+		t.Fatal("Edges of a tree put back into the trash are left", edges, err)
+	}
+
+	entry, err := RestoreTrash(child.Id)
+	if err != nil || len(entry.Parents) != 2 {
+		t.Fatal("Got back a different restored tree then expected", entry, err)
+	}
+}
+
+func TestGCRecordedTrash(t *testing.T) {
+	dir := t.TempDir()
+
+	for uri, storage := range map[string]Storage{
+		path.Join(dir, "graph.db"): &BoltStorage{},
+		"sqlite::memory:":          &SQLStorage{},
+	} {
+		err := Init(uri, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testGCRecordedTrash(t, path.Join(dir, "trash-"+path.Base(uri)))
+		Close()
+	}
+}
+
+func testGCRecordedTrash(t *testing.T, trashPath string) {
+	_, err := CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatal("Garbage collection failed without a trash", err)
+	}
+
+	err = OpenTrash(trashPath, TrashOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CloseTrash()
+
+	recorded, err := RecordedTrash()
+	if err != nil || recorded != trashPath {
+		t.Fatal("Got back a different trash path then expected", recorded, err)
+	}
+
+	// trashed trees would be taken for garbage
+	_, err = CollectGarbage(GCOptions{})
+	if err == nil {
+		t.Fatal("Garbage collection removed garbage without the recorded trash")
+	}
+
+	_, err = CollectGarbage(GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = OpenTrash(recorded, TrashOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseTrash()
+
+	err = Drop()
+	if err == nil {
+		recorded, err = RecordedTrash()
+	}
+
+	if err != nil || recorded != trashPath {
+		t.Fatal("Dropping the graph lost the path of the open trash", recorded, err)
+	}
+
+	_, err = CollectGarbage(GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
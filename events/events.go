@@ -1,16 +1,49 @@
 package events
 
 import (
-	"github.com/ziahamza/blend"
 	"sync"
-	"sync/atomic"
+	"time"
+
+	"github.com/ziahamza/blend"
 )
 
+// Subscribing to this id delivers the events of every vertex
+const AllVertices = "*"
+
+// Type of the event taking the place of the events a subscriber missed by
+// falling behind, which vertices they were about is not known
+const Overflow = "events:overflow"
+
+// events buffered per subscriber before new ones get dropped
+const subscriberBuffer = 64
+
 type VertexListener struct {
+	subscribers []*subscriber
+}
+
+type subscriber struct {
+	sync.Mutex
+
+	// one more than the buffer, keeping room for the overflow event
 	events chan blend.Event
 
-	// number of listeners listening on the events channel
-	count int32
+	// dropping events until the subscriber catches up
+	overflowed bool
+}
+
+// Delivers the event unless the buffer is full, in which case an overflow
+// event is sent once instead
+func (s *subscriber) send(event blend.Event) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.events) < subscriberBuffer {
+		s.overflowed = false
+		s.events <- event
+	} else if !s.overflowed {
+		s.overflowed = true
+		s.events <- blend.Event{Type: Overflow, Created: time.Now()}
+	}
 }
 
 var dispatcher struct {
@@ -19,83 +52,70 @@ var dispatcher struct {
 }
 
 func Init() {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
 	dispatcher.listeners = make(map[string]*VertexListener)
 }
 
-func getVertexListener(id string) *VertexListener {
+// Sends the event to everyone subscribed to the vertex. Never blocks,
+// subscribers that fall behind miss events and get an Overflow event.
+func Dispatch(id string, event blend.Event) {
 	dispatcher.RLock()
 	defer dispatcher.RUnlock()
 
-	return dispatcher.listeners[id]
+	for _, lid := range []string{id, AllVertices} {
+		listener := dispatcher.listeners[lid]
+		if listener == nil {
+			continue
+		}
+
+		for _, sub := range listener.subscribers {
+			sub.send(event)
+		}
+	}
 }
 
-func delVertexListener(id string) bool {
+func Subscribe(id string) chan blend.Event {
 	dispatcher.Lock()
 	defer dispatcher.Unlock()
 
-	listener := dispatcher.listeners[id]
-	if listener == nil {
-		return false
+	if dispatcher.listeners == nil {
+		dispatcher.listeners = make(map[string]*VertexListener)
 	}
 
-	if atomic.LoadInt32(&listener.count) > 0 {
-		return false
+	listener := dispatcher.listeners[id]
+	if listener == nil {
+		listener = &VertexListener{}
+		dispatcher.listeners[id] = listener
 	}
 
-	atomic.StoreInt32(&listener.count, -1)
-	close(listener.events)
+	sub := &subscriber{events: make(chan blend.Event, subscriberBuffer+1)}
+	listener.subscribers = append(listener.subscribers, sub)
 
-	delete(dispatcher.listeners, id)
-
-	return true
+	return sub.events
 }
 
-// tries to add a vertex listener to the id, if it already
-// exists then returns the old one, else adds a new one
-func setVertexListener(id string, listener *VertexListener) *VertexListener {
+// Removes the subscription and closes its channel
+func Unsubscribe(id string, events chan blend.Event) {
 	dispatcher.Lock()
 	defer dispatcher.Unlock()
 
-	if dispatcher.listeners[id] != nil {
-		return dispatcher.listeners[id]
-	}
-
-	dispatcher.listeners[id] = listener
-
-	return listener
-}
-
-func Dispatch(id string, event blend.Event) {
-	listener := getVertexListener(id)
-
-	if listener != nil && atomic.LoadInt32(&listener.count) > 0 {
-		listener.events <- event
-	}
-}
-
-func Subscribe(id string) chan blend.Event {
-	listener := getVertexListener(id)
-
+	listener := dispatcher.listeners[id]
 	if listener == nil {
-		listener = setVertexListener(id, &VertexListener{})
+		return
 	}
 
-	atomic.AddInt32(&listener.count, 1)
-
-	return listener.events
-}
-
-func Unsubscribe(id string) {
-	listener := getVertexListener(id)
-
-	if listener != nil {
-		val := atomic.AddInt32(&listener.count, -1)
-		if val <= 0 {
-			// vertex events not used anymore
-			if delVertexListener(id) == false {
-				// cant really delete the vertex for some reason
-				// ignore for now
-			}
+	for i, sub := range listener.subscribers {
+		if sub.events == events {
+			listener.subscribers = append(listener.subscribers[:i], listener.subscribers[i+1:]...)
+			close(events)
+			break
 		}
 	}
+
+	// vertex events not used anymore
+	if len(listener.subscribers) == 0 {
+		delete(dispatcher.listeners, id)
+	}
 }
@@ -0,0 +1,39 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/ziahamza/blend"
+)
+
+func TestDispatchOverflow(t *testing.T) {
+	Init()
+
+	ch := Subscribe("vertex")
+	defer Unsubscribe("vertex", ch)
+
+	for i := 0; i < subscriberBuffer+10; i++ {
+		Dispatch("vertex", blend.Event{Source: "vertex", Type: "vertex:update"})
+	}
+
+	for i := 0; i < subscriberBuffer; i++ {
+		if event := <-ch; event.Type != "vertex:update" {
+			t.Fatal("Got back a different event then expected", i, event)
+		}
+	}
+
+	// the missed events are reported once
+	if event := <-ch; event.Type != Overflow {
+		t.Fatal("Subscriber not told about the missed events", event)
+	}
+
+	if len(ch) != 0 {
+		t.Fatal("Got back more events then expected", len(ch))
+	}
+
+	Dispatch("vertex", blend.Event{Source: "vertex", Type: "vertex:delete"})
+
+	if event := <-ch; event.Type != "vertex:delete" {
+		t.Fatal("Subscriber did not get events again after catching up", event)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ziahamza/blend/db"
+)
+
+func main() {
+	backend := flag.String("backend", "local",
+		`Storage backend for the graph. Only backends that can scan the entire
+graph are supported, which currently is just local`)
+
+	uri := flag.String("uri", path.Join(os.TempDir(), "blend.db"),
+		`URI for the storage backend, see the server for details`)
+
+	roots := flag.String("roots", "",
+		`Comma separated ids of vertices kept besides the ones created without an
+owner, every vertex not owned by them is garbage. Each of them has to exist`)
+
+	dryRun := flag.Bool("dry-run", false, "Only report the garbage without removing it")
+
+	trash := flag.String("trash", "",
+		`Path of the trash database of the server, trees in the trash are not
+garbage. Defaults to the trash the server last opened along with the graph`)
+
+	flag.Parse()
+
+	err := db.Open(*backend, *uri)
+	if err != nil {
+		log.Fatalf("Cannot connect to the storage backend on %s: %s\n", *uri, err.Error())
+	}
+
+	defer db.Close()
+
+	if *trash == "" {
+		*trash, err = db.RecordedTrash()
+		if err != nil {
+			log.Fatal("Cannot read the trash path of the graph: ", err)
+		}
+	}
+
+	if *trash != "" {
+		err = db.OpenTrash(*trash, db.TrashOptions{})
+		if err != nil {
+			log.Fatal("Cannot open the trash: ", err)
+		}
+
+		defer db.CloseTrash()
+	}
+
+	result, err := db.CollectGarbage(db.GCOptions{
+		Roots:  strings.Split(*roots, ","),
+		DryRun: *dryRun,
+	})
+
+	if err != nil {
+		log.Fatal("Garbage collection failed: ", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	err = enc.Encode(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+}